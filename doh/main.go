@@ -80,17 +80,17 @@ func main() {
 		drivers.LoadJson(ConfigFile, cfg, false)
 	}
 
-	switch {
-	case Loglevel != "":
+	if Loglevel != "" {
 		cfg.Loglevel = Loglevel
-	case cfg.Loglevel != "":
-	case q.Trace:
-		cfg.Loglevel = "INFO"
 	}
 	drivers.SetLogging(cfg.Logfile, cfg.Loglevel)
 
 	var cli drivers.Client
 	q.Prepare()
+	if q.Stamp {
+		q.PrintStamps()
+		return
+	}
 	if cfg.Client != nil {
 		cli = cfg.CreateClient()
 	} else {
@@ -31,6 +31,7 @@ type Query struct {
 	FmtJson          bool
 	Microseconds     bool
 	Trace            bool
+	Stamp            bool
 	DNlist           []string
 }
 
@@ -40,7 +41,7 @@ func (q *Query) Parse() {
 	flag.StringVar(&q.Driver, "driver", "", "client driver")
 	flag.StringVar(&q.URL, "s", "", "server url to query")
 	flag.BoolVar(&q.TCP, "tcp", false, "use tcp as default protocol")
-	flag.IntVar(&q.Tries, "tries", 0, "retries")
+	flag.IntVar(&q.Tries, "tries", 0, "times to try each server, as attempts in resolv.conf")
 	flag.StringVar(&q.Subnet, "subnet", "", "edns client subnet")
 	flag.StringVar(&q.QType, "t", "A", "resource record type to query")
 	flag.StringVar(&q.QClass, "c", "IN", "resource record class to query")
@@ -51,6 +52,7 @@ func (q *Query) Parse() {
 	flag.BoolVar(&q.FmtJson, "json", false, "show json answer")
 	flag.BoolVar(&q.Microseconds, "u", false, "print query times in microseconds instead of milliseconds")
 	flag.BoolVar(&q.Trace, "trace", false, "trace the query")
+	flag.BoolVar(&q.Stamp, "stamp", false, "print dns stamps of server urls")
 }
 
 func (q *Query) Prepare() {
@@ -78,6 +80,14 @@ func (q *Query) Prepare() {
 		}
 	}
 
+	// the args are server urls in stamp mode.
+	if q.Stamp {
+		for _, dn := range q.DNlist {
+			q.URLs = append(q.URLs, q.FillURL(dn))
+		}
+		q.DNlist = nil
+	}
+
 	if q.ResolvFile != "" {
 		cfg, err := dns.ClientConfigFromFile(q.ResolvFile)
 		if err != nil {
@@ -116,18 +126,32 @@ func (q *Query) FillURL(u string) (URL string) {
 	return
 }
 
+func (q *Query) PrintStamps() {
+	for _, URL := range q.URLs {
+		stamp, err := drivers.NewStampFromURL(URL)
+		if err != nil {
+			logger.Errorf("%s: %s", URL, err.Error())
+			continue
+		}
+		fmt.Printf("%s\t%s\n", URL, stamp.String())
+	}
+	return
+}
+
 func (q *Query) CreateClient() (cli drivers.Client) {
 	var header *drivers.DriverHeader
 
+	if q.Trace {
+		cli = drivers.NewRecursiveClient("", nil)
+		return
+	}
+
 	if len(q.URLs) == 0 {
 		return
 	}
 
 	switch {
-	case q.Trace:
-		cli = drivers.NewRecursiveClient()
-
-	case q.Tries <= 1:
+	case q.Tries <= 1 && len(q.URLs) == 1:
 		header = &drivers.DriverHeader{
 			Driver: q.Driver,
 			URL:    q.URLs[0],
@@ -135,7 +159,10 @@ func (q *Query) CreateClient() (cli drivers.Client) {
 		cli = header.CreateClient(nil)
 
 	default:
-		reties := &drivers.RetiesClient{Tries: q.Tries}
+		// like resolv.conf, each server is tried tries times, and each try has its own timeout.
+		reties := drivers.NewRetiesClient("", nil)
+		reties.Tries = max(q.Tries, 1)
+		reties.Timeout = drivers.Timeout * reties.Tries * len(q.URLs)
 		for _, URL := range q.URLs {
 			header = &drivers.DriverHeader{
 				Driver: q.Driver,
@@ -185,6 +212,11 @@ func (q *Query) NewQuiz(dn string) (quiz *dns.Msg) {
 
 func (q *Query) QueryDN(cli drivers.Client, quiz *dns.Msg) (err error) {
 	ctx := context.Background()
+	var trace *drivers.Trace
+	if q.Trace {
+		trace = &drivers.Trace{}
+		ctx = drivers.WithTrace(ctx, trace)
+	}
 	start := time.Now()
 
 	ans, err := cli.Exchange(ctx, quiz)
@@ -195,6 +227,13 @@ func (q *Query) QueryDN(cli drivers.Client, quiz *dns.Msg) (err error) {
 	elapsed := time.Since(start)
 
 	switch {
+	case trace != nil && q.FmtJson:
+		q.PrintTraceJson(trace, quiz, ans)
+
+	case trace != nil:
+		q.PrintTrace(trace)
+		fmt.Println(ans.String())
+
 	case q.FmtShort:
 		q.PrintShort(ans)
 
@@ -249,6 +288,36 @@ func (q *Query) PrintJson(quiz, ans *dns.Msg) {
 	return
 }
 
+func (q *Query) PrintTrace(trace *drivers.Trace) {
+	for _, step := range trace.Steps {
+		fmt.Println(step.Format(q.Microseconds))
+	}
+	return
+}
+
+func (q *Query) PrintTraceJson(trace *drivers.Trace, quiz, ans *dns.Msg) {
+	report := struct {
+		Steps  []*drivers.TraceStep
+		Answer *drivers.DNSMsg
+	}{
+		Steps:  trace.Steps,
+		Answer: &drivers.DNSMsg{},
+	}
+	err := report.Answer.FromAnswer(quiz, ans)
+	if err != nil {
+		panic(err.Error())
+	}
+
+	var bresp []byte
+	bresp, err = json.Marshal(report)
+	if err != nil {
+		panic(err.Error())
+	}
+
+	fmt.Printf("%s", string(bresp))
+	return
+}
+
 func (q *Query) QueryAll(cli drivers.Client) {
 	for _, dn := range q.DNlist {
 		quiz := q.NewQuiz(dn)
@@ -0,0 +1,173 @@
+package domainlist
+
+import (
+	"bufio"
+	"compress/gzip"
+	"io"
+	"os"
+	"strings"
+
+	logging "github.com/op/go-logging"
+)
+
+var (
+	logger = logging.MustGetLogger("domainlist")
+)
+
+type node struct {
+	children map[string]*node
+	end      bool
+}
+
+// DomainList is a trie of labels from the top level, so a name is matched in O(labels).
+type DomainList struct {
+	root  *node
+	count int
+}
+
+func NewDomainList() (list *DomainList) {
+	return &DomainList{root: &node{}}
+}
+
+func splitLabels(name string) []string {
+	name = strings.ToLower(strings.Trim(name, ". \t"))
+	if name == "" {
+		return nil
+	}
+	return strings.Split(name, ".")
+}
+
+// Add puts the domain in the list, the subdomains of it are matched too.
+func (list *DomainList) Add(domain string) {
+	labels := splitLabels(domain)
+	if len(labels) == 0 {
+		return
+	}
+	n := list.root
+	for i := len(labels) - 1; i >= 0; i-- {
+		if n.children == nil {
+			n.children = make(map[string]*node)
+		}
+		child, ok := n.children[labels[i]]
+		if !ok {
+			child = &node{}
+			n.children[labels[i]] = child
+		}
+		n = child
+	}
+	if !n.end {
+		n.end = true
+		list.count++
+	}
+}
+
+// Contain means name is one of the domains or their subdomains.
+func (list *DomainList) Contain(name string) bool {
+	labels := splitLabels(name)
+	n := list.root
+	for i := len(labels) - 1; i >= 0; i-- {
+		n = n.children[labels[i]]
+		if n == nil {
+			return false
+		}
+		if n.end {
+			logger.Debugf("%s matched %s.", name, strings.Join(labels[i:], "."))
+			return true
+		}
+	}
+	return false
+}
+
+func (list *DomainList) Len() int {
+	return list.count
+}
+
+// ParseLine returns the domains in a line, a domain per line, or dnsmasq format like server=/a.com/b.com/114.114.114.114.
+// The server in dnsmasq format is ignored.
+func ParseLine(line string) (domains []string) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return
+	}
+
+	key, value, ok := strings.Cut(line, "=")
+	if !ok {
+		return []string{line}
+	}
+	if key != "server" && key != "local" {
+		logger.Debugf("unknown line: %s", line)
+		return
+	}
+
+	parts := strings.Split(value, "/")
+	if len(parts) < 3 || parts[0] != "" {
+		logger.Infof("wrong line: %s", line)
+		return
+	}
+	for _, domain := range parts[1 : len(parts)-1] {
+		if domain != "" {
+			domains = append(domains, domain)
+		}
+	}
+	return
+}
+
+func (list *DomainList) Read(f io.Reader) (err error) {
+	reader := bufio.NewReader(f)
+	for {
+		line, err := reader.ReadString('\n')
+		switch err {
+		case io.EOF:
+			if len(line) == 0 {
+				return nil
+			}
+		case nil:
+		default:
+			logger.Error(err.Error())
+			return err
+		}
+		for _, domain := range ParseLine(line) {
+			list.Add(domain)
+		}
+	}
+}
+
+// ReadFile adds the domains in file to the list, the file is gunzipped if it ends with .gz.
+func (list *DomainList) ReadFile(filename string) (err error) {
+	logger.Infof("load domain list from file %s.", filename)
+
+	var f io.ReadCloser
+	f, err = os.Open(filename)
+	if err != nil {
+		logger.Error(err.Error())
+		return
+	}
+	defer f.Close()
+
+	if strings.HasSuffix(filename, ".gz") {
+		f, err = gzip.NewReader(f)
+		if err != nil {
+			logger.Error(err.Error())
+			return
+		}
+	}
+
+	count := list.count
+	err = list.Read(f)
+	if err != nil {
+		return
+	}
+	logger.Infof("domain list loaded %d domain(s).", list.count-count)
+	return
+}
+
+func ReadDomainListFile(filenames ...string) (list *DomainList, err error) {
+	list = NewDomainList()
+	for _, filename := range filenames {
+		err = list.ReadFile(filename)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return
+}
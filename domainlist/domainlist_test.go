@@ -0,0 +1,112 @@
+package domainlist
+
+import (
+	"compress/gzip"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	logging "github.com/op/go-logging"
+)
+
+const (
+	DOMAINLIST = `# comment
+server=/baidu.com/114.114.114.114
+server=/qq.com/Weixin.QQ.com/114.114.114.114#53
+ipset=/taobao.com/china
+cn
+
+example.org.
+`
+)
+
+func init() {
+	logging.SetLevel(logging.ERROR, "")
+}
+
+func TestDomainList(t *testing.T) {
+	list := NewDomainList()
+	err := list.Read(strings.NewReader(DOMAINLIST))
+	if err != nil {
+		t.Fatalf("read failed: %s", err)
+	}
+	if list.Len() != 5 {
+		t.Fatalf("wrong length: %d", list.Len())
+	}
+
+	for _, c := range []struct {
+		name  string
+		match bool
+	}{
+		{"baidu.com.", true},
+		{"WWW.Baidu.com", true},
+		{"notbaidu.com.", false},
+		{"baidu.com.hk.", false},
+		{"weixin.qq.com.", true},
+		{"taobao.com.", false},
+		{"www.gov.cn.", true},
+		{"example.org", true},
+		{"org.", false},
+		{".", false},
+	} {
+		if list.Contain(c.name) != c.match {
+			t.Fatalf("wrong match of %s", c.name)
+		}
+	}
+}
+
+func TestParseLine(t *testing.T) {
+	for _, c := range []struct {
+		line    string
+		domains string
+	}{
+		{"server=/a.com/b.com/1.1.1.1\n", "a.com,b.com"},
+		{"server=/a.com/", "a.com"},
+		{"local=/lan/", "lan"},
+		{"server=a.com", ""},
+		{"address=/a.com/127.0.0.1", ""},
+		{"  # a.com", ""},
+		{" a.com \r\n", "a.com"},
+	} {
+		if domains := strings.Join(ParseLine(c.line), ","); domains != c.domains {
+			t.Fatalf("wrong domains of %q: %s", c.line, domains)
+		}
+	}
+}
+
+func TestReadDomainListFile(t *testing.T) {
+	dir := t.TempDir()
+	plain := filepath.Join(dir, "list.conf")
+	os.WriteFile(plain, []byte("baidu.com\n"), 0600)
+
+	gz := filepath.Join(dir, "list.conf.gz")
+	f, err := os.Create(gz)
+	if err != nil {
+		t.Fatalf("create failed: %s", err)
+	}
+	w := gzip.NewWriter(f)
+	w.Write([]byte("server=/qq.com/114.114.114.114\n"))
+	w.Close()
+	f.Close()
+
+	list, err := ReadDomainListFile(plain, gz)
+	if err != nil {
+		t.Fatalf("read failed: %s", err)
+	}
+	if !list.Contain("www.baidu.com.") || !list.Contain("www.qq.com.") {
+		t.Fatalf("domains should be loaded from both files")
+	}
+}
+
+func BenchmarkContain(b *testing.B) {
+	list := NewDomainList()
+	for i := 0; i < 100000; i++ {
+		list.Add(fmt.Sprintf("domain%d.com", i))
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		list.Contain(fmt.Sprintf("www.domain%d.com.", i%200000))
+	}
+}
@@ -0,0 +1,266 @@
+package drivers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"math/rand"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	BALANCE_LATENCY  = "latency"
+	BALANCE_RANDOM   = "random"
+	BALANCE_PRIORITY = "priority"
+
+	BALANCE_PROBE_TIMEOUT = 5 * time.Second
+	BALANCE_EWMA_WEIGHT   = 8
+
+	DEFAULT_BALANCE_TRIES        = 2
+	DEFAULT_BALANCE_MAXFAILS     = 3
+	DEFAULT_BALANCE_MAXERRORRATE = 0.5
+	DEFAULT_BALANCE_BACKOFF      = 1000
+	DEFAULT_BALANCE_MAXBACKOFF   = 60000
+	DEFAULT_BALANCE_PROBE        = "."
+	DEFAULT_BALANCE_WEIGHT       = 1
+)
+
+var (
+	BalanceStats = expvar.NewMap("balance")
+)
+
+// Upstream keeps the health of a client in balance.
+type Upstream struct {
+	cli     Client
+	weight  int
+	mu      sync.Mutex
+	rtt     time.Duration
+	errrate float64
+	fails   int
+	down    bool
+	backoff time.Duration
+}
+
+func (u *Upstream) Down() bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.down
+}
+
+func (u *Upstream) RTT() time.Duration {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.rtt
+}
+
+type BalanceClient struct {
+	Clients      []json.RawMessage
+	Policy       string  `json:"policy"`
+	Tries        int     `json:"tries"`
+	MaxFails     int     `json:"max-fails"`
+	MaxErrorRate float64 `json:"max-error-rate"`
+	Backoff      int     `json:"backoff"`
+	MaxBackoff   int     `json:"max-backoff"`
+	Probe        string  `json:"probe"`
+	ups          []*Upstream
+}
+
+func NewBalanceClient(URL string, body json.RawMessage) (cli *BalanceClient) {
+	var err error
+	cli = &BalanceClient{
+		Policy:       BALANCE_LATENCY,
+		Tries:        DEFAULT_BALANCE_TRIES,
+		MaxFails:     DEFAULT_BALANCE_MAXFAILS,
+		MaxErrorRate: DEFAULT_BALANCE_MAXERRORRATE,
+		Backoff:      DEFAULT_BALANCE_BACKOFF,
+		MaxBackoff:   DEFAULT_BALANCE_MAXBACKOFF,
+		Probe:        DEFAULT_BALANCE_PROBE,
+	}
+	if body != nil {
+		err = json.Unmarshal(body, &cli)
+		if err != nil {
+			panic(err.Error())
+		}
+	}
+
+	switch cli.Policy {
+	case BALANCE_LATENCY, BALANCE_RANDOM, BALANCE_PRIORITY:
+	default:
+		panic(ErrConfigParse.Error())
+	}
+
+	for _, cfg := range cli.Clients {
+		// the weight is in the client config, ignored by the client itself.
+		var header struct {
+			DriverHeader
+			Weight int
+		}
+		err = json.Unmarshal(cfg, &header)
+		if err != nil {
+			panic(err.Error())
+		}
+		if header.Weight <= 0 {
+			header.Weight = DEFAULT_BALANCE_WEIGHT
+		}
+		cli.ups = append(cli.ups, &Upstream{
+			cli:    header.CreateClient(cfg),
+			weight: header.Weight,
+		})
+	}
+	if len(cli.ups) == 0 {
+		panic(ErrEmptyClients.Error())
+	}
+
+	return
+}
+
+func (cli *BalanceClient) Url() (u string) {
+	return cli.ups[0].cli.Url()
+}
+
+// Pick returns the upstreams to try in order of policy, the down ones are skipped unless all of them are down.
+func (cli *BalanceClient) Pick() (ups []*Upstream) {
+	for _, u := range cli.ups {
+		if !u.Down() {
+			ups = append(ups, u)
+		}
+	}
+	if len(ups) == 0 {
+		ups = append(ups, cli.ups...)
+	}
+
+	switch cli.Policy {
+	case BALANCE_LATENCY:
+		rtts := make(map[*Upstream]time.Duration)
+		for _, u := range ups {
+			rtts[u] = u.RTT()
+		}
+		sort.SliceStable(ups, func(i, j int) bool {
+			return rtts[ups[i]] < rtts[ups[j]]
+		})
+	case BALANCE_RANDOM:
+		ups = WeightedShuffle(ups)
+	}
+	return
+}
+
+// WeightedShuffle picks the upstreams one by one, by the chance in proportion to weight.
+func WeightedShuffle(ups []*Upstream) (shuffled []*Upstream) {
+	ups = append([]*Upstream{}, ups...)
+	for len(ups) > 0 {
+		total := 0
+		for _, u := range ups {
+			total += u.weight
+		}
+		n := rand.Intn(total)
+		for i, u := range ups {
+			n -= u.weight
+			if n < 0 {
+				shuffled = append(shuffled, u)
+				ups = append(ups[:i], ups[i+1:]...)
+				break
+			}
+		}
+	}
+	return
+}
+
+// record updates the health of upstream, and marks it down if it failed too much.
+// The rtt of a failure is not counted unless it's a timeout, or a fast failing upstream looks the fastest.
+func (cli *BalanceClient) record(u *Upstream, rtt time.Duration, failed, timeout bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	e := 0.0
+	if failed {
+		e = 1.0
+	}
+	u.errrate += (e - u.errrate) / BALANCE_EWMA_WEIGHT
+	switch {
+	case failed && !timeout:
+	case u.rtt == 0:
+		u.rtt = rtt
+	default:
+		u.rtt += (rtt - u.rtt) / BALANCE_EWMA_WEIGHT
+	}
+
+	if !failed {
+		u.fails = 0
+		return
+	}
+	u.fails++
+	if !u.down && (u.fails >= cli.MaxFails || u.errrate >= cli.MaxErrorRate) {
+		cli.markDown(u)
+	}
+}
+
+// markDown doubles the backoff each time, and probes the upstream after it. must be called with lock.
+func (cli *BalanceClient) markDown(u *Upstream) {
+	u.down = true
+	u.backoff = min(max(2*u.backoff, time.Duration(cli.Backoff)*time.Millisecond), time.Duration(cli.MaxBackoff)*time.Millisecond)
+	time.AfterFunc(u.backoff, func() { cli.probe(u) })
+	BalanceStats.Add(u.cli.Url()+" downs", 1)
+	logger.Infof("upstream %s is down for %s", u.cli.Url(), u.backoff)
+}
+
+// probe sends a query to the down upstream, it's up again if the answer is valid, or down for another backoff.
+func (cli *BalanceClient) probe(u *Upstream) {
+	ctx, cancel := context.WithTimeout(context.Background(), BALANCE_PROBE_TIMEOUT)
+	defer cancel()
+
+	quiz := &dns.Msg{}
+	quiz.SetQuestion(dns.Fqdn(cli.Probe), dns.TypeNS)
+	ans, err := u.cli.Exchange(ctx, quiz)
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if err != nil || !ValidAnswer(ans) {
+		cli.markDown(u)
+		return
+	}
+	u.down, u.fails, u.errrate, u.backoff = false, 0, 0, 0
+	logger.Infof("upstream %s is up", u.cli.Url())
+}
+
+// IsTimeout means the client didn't answer in time.
+func IsTimeout(err error) bool {
+	var nerr net.Error
+	return errors.Is(err, context.DeadlineExceeded) || errors.As(err, &nerr) && nerr.Timeout()
+}
+
+func (cli *BalanceClient) Exchange(ctx context.Context, quiz *dns.Msg) (ans *dns.Msg, err error) {
+	ups := cli.Pick()
+	for i, u := range ups {
+		if i >= cli.Tries {
+			break
+		}
+		begin := time.Now()
+		ans, err = u.cli.Exchange(ctx, quiz)
+		// the caller gave up, not the fault of upstream.
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		valid, timeout := err == nil && ValidAnswer(ans), IsTimeout(err)
+		cli.record(u, time.Since(begin), !valid, timeout)
+		BalanceStats.Add(u.cli.Url()+" queries", 1)
+		if valid {
+			return
+		}
+		if timeout {
+			BalanceStats.Add(u.cli.Url()+" timeouts", 1)
+		} else {
+			BalanceStats.Add(u.cli.Url()+" errors", 1)
+		}
+		if err != nil {
+			logger.Info(err.Error())
+		}
+	}
+	return
+}
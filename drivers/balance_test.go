@@ -0,0 +1,141 @@
+package drivers
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// SwitchClient answers by upstream, or fails if fail is set.
+type SwitchClient struct {
+	upstream Client
+	fail     atomic.Bool
+	Count    atomic.Int32
+}
+
+func (cli *SwitchClient) Url() (u string) {
+	return "switch://"
+}
+
+func (cli *SwitchClient) Exchange(ctx context.Context, quiz *dns.Msg) (ans *dns.Msg, err error) {
+	cli.Count.Add(1)
+	if cli.fail.Load() {
+		return nil, errors.New("failed")
+	}
+	return cli.upstream.Exchange(ctx, quiz)
+}
+
+func NewTestBalance(body string, clis ...Client) (cli *BalanceClient) {
+	cli = NewBalanceClient("", []byte(body))
+	cli.ups = nil
+	for _, c := range clis {
+		cli.ups = append(cli.ups, &Upstream{cli: c, weight: DEFAULT_BALANCE_WEIGHT})
+	}
+	return
+}
+
+func TestBalanceDown(t *testing.T) {
+	answer := &StaticClient{Records: []string{"www.example.com. 300 IN A 192.0.2.1"}}
+	first := &SwitchClient{upstream: answer}
+	first.fail.Store(true)
+	cli := NewTestBalance(`{"clients": [{"url": "udp://127.0.0.1"}], "policy": "priority", "backoff": 200}`, first, answer)
+
+	quiz := &dns.Msg{}
+	quiz.SetQuestion("www.example.com.", dns.TypeA)
+	for i := 0; i < DEFAULT_BALANCE_MAXFAILS+2; i++ {
+		_, err := cli.Exchange(context.Background(), quiz)
+		if err != nil {
+			t.Fatalf("exchange failed: %s", err)
+		}
+	}
+	if first.Count.Load() != DEFAULT_BALANCE_MAXFAILS || !cli.ups[0].Down() {
+		t.Fatalf("the failed upstream should be down: %d", first.Count.Load())
+	}
+
+	// the probe after backoff failed without any query, so it's down again.
+	time.Sleep(300 * time.Millisecond)
+	if first.Count.Load() != DEFAULT_BALANCE_MAXFAILS+1 || !cli.ups[0].Down() {
+		t.Fatalf("the upstream should be probed: %d", first.Count.Load())
+	}
+
+	// the backoff is doubled, and the upstream is up after a good probe.
+	first.fail.Store(false)
+	time.Sleep(200 * time.Millisecond)
+	if first.Count.Load() != DEFAULT_BALANCE_MAXFAILS+1 {
+		t.Fatalf("the upstream should not be probed before backoff: %d", first.Count.Load())
+	}
+	time.Sleep(200 * time.Millisecond)
+	if cli.ups[0].Down() {
+		t.Fatalf("the upstream should be up")
+	}
+}
+
+func TestBalanceRecord(t *testing.T) {
+	cli := NewTestBalance(`{"clients": [{"url": "udp://127.0.0.1"}]}`, &StaticClient{})
+	u := cli.ups[0]
+	cli.record(u, 100*time.Millisecond, false, false)
+	cli.record(u, time.Millisecond, true, false)
+	if u.RTT() != 100*time.Millisecond {
+		t.Fatalf("the rtt of a fast failure should not be counted: %s", u.RTT())
+	}
+	cli.record(u, 900*time.Millisecond, true, true)
+	if u.RTT() != 200*time.Millisecond {
+		t.Fatalf("the rtt of a timeout should be counted: %s", u.RTT())
+	}
+}
+
+func TestBalanceLatency(t *testing.T) {
+	answer := &StaticClient{Records: []string{"www.example.com. 300 IN A 192.0.2.1"}}
+	slow := &DelayClient{upstream: answer, Delay: 20 * time.Millisecond}
+	fast := &StaticClient{Records: []string{"www.example.com. 300 IN A 192.0.2.1"}}
+	cli := NewTestBalance(`{"clients": [{"url": "udp://127.0.0.1"}]}`, slow, fast)
+
+	quiz := &dns.Msg{}
+	quiz.SetQuestion("www.example.com.", dns.TypeA)
+	for i := 0; i < 10; i++ {
+		cli.Exchange(context.Background(), quiz)
+	}
+	// the first query goes to the slow one, the second to the untried fast one.
+	if fast.Count.Load() != 9 {
+		t.Fatalf("the fast one should be preferred: %d", fast.Count.Load())
+	}
+
+	// the caller gave up, it's not the fault of upstream.
+	slow.Delay = time.Second
+	cli.ups[0].rtt, cli.ups[1].rtt = 0, time.Second
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := cli.Exchange(ctx, quiz)
+	if err == nil || cli.ups[0].fails != 0 {
+		t.Fatalf("the upstream should not be blamed: %v", err)
+	}
+}
+
+func TestWeightedShuffle(t *testing.T) {
+	light := &Upstream{weight: 1}
+	heavy := &Upstream{weight: 9}
+	n := 0
+	for i := 0; i < 1000; i++ {
+		ups := WeightedShuffle([]*Upstream{light, heavy})
+		if len(ups) != 2 {
+			t.Fatalf("wrong shuffle: %v", ups)
+		}
+		if ups[0] == heavy {
+			n++
+		}
+	}
+	if n < 800 || n > 970 {
+		t.Fatalf("wrong weight: %d", n)
+	}
+}
+
+func TestBalanceConfig(t *testing.T) {
+	cli := NewBalanceClient("", []byte(`{"policy": "random", "clients": [{"url": "udp://127.0.0.1", "weight": 5}, {"url": "udp://127.0.0.2"}]}`))
+	if len(cli.ups) != 2 || cli.ups[0].weight != 5 || cli.ups[1].weight != DEFAULT_BALANCE_WEIGHT {
+		t.Fatalf("wrong weights: %+v", cli.ups)
+	}
+}
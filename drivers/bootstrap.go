@@ -0,0 +1,238 @@
+package drivers
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	BOOTSTRAP_MIN_TTL = 60 * time.Second
+	BOOTSTRAP_MAX_TTL = time.Hour
+)
+
+var (
+	ErrBootstrap = errors.New("bootstrap failed to resolve host")
+)
+
+type bootstrapEntry struct {
+	ips    []string
+	ech    []byte
+	expire time.Time
+}
+
+// Bootstrap resolves the hostname of upstream without the system resolver.
+// The entries are static IPs, or urls of resolvers like udp://1.1.1.1, which should not need bootstrap themselves.
+type Bootstrap struct {
+	ips       []string
+	resolvers []Client
+	mu        sync.Mutex
+	cache     map[string]*bootstrapEntry
+}
+
+// NewBootstrap returns nil if there is no entry, which means the system resolver.
+func NewBootstrap(entries []string) (b *Bootstrap) {
+	if len(entries) == 0 {
+		return nil
+	}
+	b = &Bootstrap{cache: make(map[string]*bootstrapEntry)}
+	for _, entry := range entries {
+		if strings.Contains(entry, "://") {
+			header := &DriverHeader{URL: entry}
+			b.resolvers = append(b.resolvers, header.CreateClient(nil))
+			continue
+		}
+		ip := net.ParseIP(strings.Trim(entry, "[]"))
+		if ip == nil {
+			panic(ErrConfigParse.Error())
+		}
+		b.ips = append(b.ips, ip.String())
+	}
+	return
+}
+
+// Lookup returns the IPs of host, the static IPs first, then the cached or resolved ones.
+func (b *Bootstrap) Lookup(ctx context.Context, host string) (ips []string, err error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []string{host}, nil
+	}
+	ips = append(ips, b.ips...)
+	if len(b.resolvers) == 0 {
+		return
+	}
+
+	entry, err := b.cached(ctx, host, func(rrs []dns.RR) (entry *bootstrapEntry, err error) {
+		entry = &bootstrapEntry{}
+		for _, rr := range rrs {
+			switch v := rr.(type) {
+			case *dns.A:
+				entry.ips = append(entry.ips, v.A.String())
+			case *dns.AAAA:
+				entry.ips = append(entry.ips, v.AAAA.String())
+			}
+		}
+		if len(entry.ips) == 0 {
+			return nil, ErrBootstrap
+		}
+		return
+	}, dns.TypeA, dns.TypeAAAA)
+	if err != nil {
+		if len(ips) > 0 {
+			return ips, nil
+		}
+		return
+	}
+	return append(ips, entry.ips...), nil
+}
+
+// ECHConfigList returns the ECH configs in the HTTPS record of addr, nil if there is none, RFC 9460 9.
+func (b *Bootstrap) ECHConfigList(ctx context.Context, addr string) (list []byte, err error) {
+	if b == nil || len(b.resolvers) == 0 {
+		return nil, ErrBootstrap
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return
+	}
+	name := host
+	if port != "443" {
+		name = "_" + port + "._https." + host
+	}
+
+	entry, err := b.cached(ctx, name, func(rrs []dns.RR) (entry *bootstrapEntry, err error) {
+		entry = &bootstrapEntry{}
+		for _, rr := range rrs {
+			// the alias mode is not followed.
+			if v, ok := rr.(*dns.HTTPS); ok && v.Priority != 0 {
+				for _, kv := range v.Value {
+					if ech, ok := kv.(*dns.SVCBECHConfig); ok {
+						entry.ech = ech.ECH
+						return
+					}
+				}
+			}
+		}
+		return
+	}, dns.TypeHTTPS)
+	if err != nil {
+		return
+	}
+	return entry.ech, nil
+}
+
+// cached returns the entry of name in cache, or makes it from the records of qtypes.
+// The stale entry is used if the resolvers failed.
+func (b *Bootstrap) cached(ctx context.Context, name string, parse func(rrs []dns.RR) (*bootstrapEntry, error), qtypes ...uint16) (entry *bootstrapEntry, err error) {
+	key := name
+	for _, qtype := range qtypes {
+		key += " " + dns.TypeToString[qtype]
+	}
+
+	b.mu.Lock()
+	stale, ok := b.cache[key]
+	b.mu.Unlock()
+	if ok && time.Now().Before(stale.expire) {
+		return stale, nil
+	}
+
+	rrs, ttl, err := b.resolve(ctx, name, qtypes...)
+	if err == nil {
+		entry, err = parse(rrs)
+	}
+	if err != nil {
+		// the stale result is better than nothing.
+		if ok {
+			logger.Infof("bootstrap %s failed, use stale result: %s", key, err.Error())
+			return stale, nil
+		}
+		return nil, err
+	}
+
+	entry.expire = time.Now().Add(ttl)
+	b.mu.Lock()
+	b.cache[key] = entry
+	b.mu.Unlock()
+	logger.Debugf("bootstrap %s: %v", key, rrs)
+	return
+}
+
+// resolve queries the records of name in the resolvers, until one of them answers.
+func (b *Bootstrap) resolve(ctx context.Context, name string, qtypes ...uint16) (rrs []dns.RR, ttl time.Duration, err error) {
+	err = ErrBootstrap
+	for _, cli := range b.resolvers {
+		rrs, ttl = nil, BOOTSTRAP_MAX_TTL
+		for _, qtype := range qtypes {
+			quiz := &dns.Msg{}
+			quiz.SetQuestion(dns.Fqdn(name), qtype)
+			quiz.RecursionDesired = true
+
+			var ans *dns.Msg
+			ans, err = cli.Exchange(ctx, quiz)
+			if err != nil {
+				logger.Infof("bootstrap %s in %s failed: %s", name, cli.Url(), err.Error())
+				break
+			}
+			if ans.Rcode != dns.RcodeSuccess && ans.Rcode != dns.RcodeNameError {
+				err = ErrBootstrap
+				break
+			}
+			for _, rr := range ans.Answer {
+				if rr.Header().Rrtype == qtype {
+					rrs = append(rrs, rr)
+					ttl = min(ttl, time.Duration(rr.Header().Ttl)*time.Second)
+				}
+			}
+		}
+		if err == nil {
+			return rrs, max(ttl, BOOTSTRAP_MIN_TTL), nil
+		}
+	}
+	return
+}
+
+// Addrs replaces the host in addr by its IPs, to be tried in order.
+func (b *Bootstrap) Addrs(ctx context.Context, addr string) (addrs []string, err error) {
+	if b == nil {
+		return []string{addr}, nil
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return
+	}
+	ips, err := b.Lookup(ctx, host)
+	if err != nil {
+		return
+	}
+	if len(ips) == 0 {
+		return nil, ErrBootstrap
+	}
+	for _, ip := range ips {
+		addrs = append(addrs, net.JoinHostPort(ip, port))
+	}
+	return
+}
+
+// DialContext dials the IPs of host in order, or the addr directly if b is nil.
+func (b *Bootstrap) DialContext(ctx context.Context, network, addr string) (conn net.Conn, err error) {
+	var d net.Dialer
+	if b == nil {
+		return d.DialContext(ctx, network, addr)
+	}
+	addrs, err := b.Addrs(ctx, addr)
+	if err != nil {
+		return
+	}
+	for _, addr := range addrs {
+		conn, err = d.DialContext(ctx, network, addr)
+		if err == nil {
+			return
+		}
+		logger.Info(err.Error())
+	}
+	return
+}
@@ -0,0 +1,129 @@
+package drivers
+
+import (
+	"context"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// StartTestBootstrap serves upstream in udp, and fails all queries when fail is set.
+func StartTestBootstrap(t *testing.T, upstream Client) (addr string, fail *atomic.Bool) {
+	fail = &atomic.Bool{}
+	addr = StartTestDnsServer(t, dns.HandlerFunc(func(w dns.ResponseWriter, quiz *dns.Msg) {
+		ans, err := upstream.Exchange(context.Background(), quiz)
+		if err != nil || fail.Load() {
+			ans = &dns.Msg{}
+			ans.SetRcode(quiz, dns.RcodeServerFailure)
+		}
+		w.WriteMsg(ans)
+	}))
+	return
+}
+
+func TestBootstrapLookup(t *testing.T) {
+	upstream := &StaticClient{Records: []string{
+		"doh.example.test. 300 IN A 192.0.2.1",
+		"doh.example.test. 300 IN AAAA 2001:db8::1",
+	}}
+	addr, fail := StartTestBootstrap(t, upstream)
+	b := NewBootstrap([]string{"udp://" + addr})
+
+	for i := 0; i < 2; i++ {
+		ips, err := b.Lookup(context.Background(), "doh.example.test")
+		if err != nil {
+			t.Fatalf("lookup failed: %s", err)
+		}
+		if len(ips) != 2 || ips[0] != "192.0.2.1" || ips[1] != "2001:db8::1" {
+			t.Fatalf("wrong ips: %v", ips)
+		}
+	}
+	if upstream.Count.Load() != 2 {
+		t.Fatalf("result should be cached: %d queries", upstream.Count.Load())
+	}
+
+	// resolvers failed, the stale result is used.
+	fail.Store(true)
+	b.mu.Lock()
+	b.cache["doh.example.test A AAAA"].expire = time.Now()
+	b.mu.Unlock()
+	ips, err := b.Lookup(context.Background(), "doh.example.test")
+	if err != nil || len(ips) != 2 {
+		t.Fatalf("stale result should be used: %v %v", ips, err)
+	}
+	_, err = b.Lookup(context.Background(), "other.example.test")
+	if err == nil {
+		t.Fatalf("lookup should fail")
+	}
+
+	ips, _ = b.Lookup(context.Background(), "192.0.2.2")
+	if len(ips) != 1 || ips[0] != "192.0.2.2" {
+		t.Fatalf("ip should not be resolved: %v", ips)
+	}
+}
+
+func TestBootstrapStatic(t *testing.T) {
+	b := NewBootstrap([]string{"192.0.2.1", "[2001:db8::1]"})
+	addrs, err := b.Addrs(context.Background(), "dns.example.test:853")
+	if err != nil || len(addrs) != 2 || addrs[0] != "192.0.2.1:853" || addrs[1] != "[2001:db8::1]:853" {
+		t.Fatalf("wrong addresses: %v %v", addrs, err)
+	}
+
+	if NewBootstrap(nil) != nil {
+		t.Fatalf("empty bootstrap should be nil")
+	}
+	defer func() {
+		if recover() == nil {
+			t.Fatalf("hostname should not be accepted")
+		}
+	}()
+	NewBootstrap([]string{"dns.example.test"})
+}
+
+func TestBootstrapFailover(t *testing.T) {
+	upstream := &StaticClient{Records: []string{"www.example.com. 300 IN A 192.0.2.1"}}
+	addr := StartTestDnsServer(t, dns.HandlerFunc(func(w dns.ResponseWriter, quiz *dns.Msg) {
+		ans, _ := upstream.Exchange(context.Background(), quiz)
+		w.WriteMsg(ans)
+	}))
+	port := addr[strings.LastIndex(addr, ":")+1:]
+
+	// nothing listens on the first address, the second one should be tried.
+	for _, nopipe := range []string{"false", "true"} {
+		cli := NewDnsClient("tcp://dns.example.test:"+port, []byte(`{"bootstrap": ["127.0.0.2", "127.0.0.1"], "timeout": 2000, "no-pipeline": `+nopipe+`}`))
+		quiz := &dns.Msg{}
+		quiz.SetQuestion("www.example.com.", dns.TypeA)
+		ans, err := cli.Exchange(context.Background(), quiz)
+		if err != nil {
+			t.Fatalf("exchange failed, no-pipeline %s: %s", nopipe, err)
+		}
+		if len(ans.Answer) != 1 {
+			t.Fatalf("wrong answer: %s", ans)
+		}
+	}
+}
+
+func TestBootstrapDoQ(t *testing.T) {
+	upstream := &StaticClient{Records: []string{"www.example.com. 300 IN A 192.0.2.1"}}
+	URL := StartTestDoQ(t, upstream)
+	port := URL[strings.LastIndex(URL, ":")+1:]
+
+	resolver := &StaticClient{Records: []string{"doq.example.test. 300 IN A 127.0.0.1"}}
+	addr, _ := StartTestBootstrap(t, resolver)
+
+	header := &DriverHeader{URL: "quic://doq.example.test:" + port}
+	cli := header.CreateClient([]byte(`{"insecure": true, "bootstrap": ["udp://` + addr + `"]}`)).(*DoQClient)
+
+	quiz := &dns.Msg{}
+	quiz.SetQuestion("www.example.com.", dns.TypeA)
+	ans, err := cli.Exchange(context.Background(), quiz)
+	if err != nil {
+		t.Fatalf("exchange failed: %s", err)
+	}
+	if len(ans.Answer) != 1 || cli.tlsconf.ServerName != "doq.example.test" {
+		t.Fatalf("wrong answer: %s", ans)
+	}
+}
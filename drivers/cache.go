@@ -0,0 +1,460 @@
+package drivers
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	DEFAULT_CACHE_ENTRIES     = 4096
+	DEFAULT_CACHE_MAXTTL      = 86400
+	DEFAULT_CACHE_NEGATIVETTL = 3600
+	DEFAULT_CACHE_STALETTL    = 30
+	DEFAULT_CACHE_PREFETCHHIT = 2
+)
+
+var (
+	CacheStats = expvar.NewMap("cache")
+)
+
+type CacheEntry struct {
+	key         string
+	base        string
+	scoped      bool
+	scope       uint8
+	ans         *dns.Msg
+	negative    bool
+	hits        int
+	prefetching bool
+	stored      time.Time
+	expire      time.Time
+}
+
+type CacheClient struct {
+	Client         json.RawMessage
+	MaxEntries     int `json:"max-entries"`
+	MinTTL         int `json:"min-ttl"`
+	MaxTTL         int `json:"max-ttl"`
+	MaxNegativeTTL int `json:"max-negative-ttl"`
+	ServeStale     int `json:"serve-stale"`
+	StaleTTL       int `json:"stale-ttl"`
+	StaleTimeout   int `json:"stale-timeout"`
+	Prefetch       int
+	PrefetchHits   int `json:"prefetch-hits"`
+	cli            Client
+	mu             sync.Mutex
+	lru            *list.List
+	entries        map[string]*list.Element
+	scopes         map[string]map[uint8]int
+}
+
+func NewCacheClient(URL string, body json.RawMessage) (cli *CacheClient) {
+	var err error
+	cli = &CacheClient{
+		MaxEntries:     DEFAULT_CACHE_ENTRIES,
+		MaxTTL:         DEFAULT_CACHE_MAXTTL,
+		MaxNegativeTTL: DEFAULT_CACHE_NEGATIVETTL,
+		StaleTTL:       DEFAULT_CACHE_STALETTL,
+		PrefetchHits:   DEFAULT_CACHE_PREFETCHHIT,
+		lru:            list.New(),
+		entries:        make(map[string]*list.Element),
+		scopes:         make(map[string]map[uint8]int),
+	}
+	if body != nil {
+		err = json.Unmarshal(body, &cli)
+		if err != nil {
+			panic(err.Error())
+		}
+	}
+
+	var header DriverHeader
+	err = json.Unmarshal(cli.Client, &header)
+	if err != nil {
+		panic(err.Error())
+	}
+	cli.cli = header.CreateClient(cli.Client)
+	logger.Debugf("cache upstream: %+v", cli.cli)
+
+	return
+}
+
+func (cli *CacheClient) Url() (u string) {
+	return cli.cli.Url()
+}
+
+func (cli *CacheClient) Exchange(ctx context.Context, quiz *dns.Msg) (ans *dns.Msg, err error) {
+	if len(quiz.Question) != 1 {
+		return cli.cli.Exchange(ctx, quiz)
+	}
+
+	key := CacheKey(quiz)
+	ans, stale, prefetch := cli.Get(key, quiz)
+	if ans != nil && !stale {
+		if prefetch {
+			logger.Debugf("cache prefetch: %s", key)
+			CacheStats.Add("prefetches", 1)
+			go cli.Refresh(key, quiz.Copy())
+		}
+		return
+	}
+	logger.Debugf("cache miss: %s", key)
+	CacheStats.Add("misses", 1)
+
+	if ans == nil {
+		return cli.Update(ctx, key, quiz)
+	}
+
+	fresh, err := cli.UpdateStale(ctx, key, quiz)
+	if err == nil {
+		return fresh, nil
+	}
+	logger.Infof("serve stale answer for %s: %s", key, err.Error())
+	CacheStats.Add("stale-hits", 1)
+	return ans, nil
+}
+
+func (cli *CacheClient) Update(ctx context.Context, key string, quiz *dns.Msg) (ans *dns.Msg, err error) {
+	ans, err = cli.cli.Exchange(ctx, quiz)
+	if err != nil {
+		return
+	}
+	cli.Set(key, quiz, ans)
+	return
+}
+
+func (cli *CacheClient) UpdateStale(ctx context.Context, key string, quiz *dns.Msg) (ans *dns.Msg, err error) {
+	type result struct {
+		ans *dns.Msg
+		err error
+	}
+	ch := make(chan result, 1)
+
+	// the update goes on in background even if the stale answer has been returned.
+	go func() {
+		ans, err := cli.Update(context.WithoutCancel(ctx), key, quiz)
+		ch <- result{ans, err}
+	}()
+
+	var timeout <-chan time.Time
+	if cli.StaleTimeout > 0 {
+		timer := time.NewTimer(time.Duration(cli.StaleTimeout) * time.Millisecond)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case r := <-ch:
+		ans, err = r.ans, r.err
+		if err == nil && ans.Rcode == dns.RcodeServerFailure {
+			err = ErrRequest
+		}
+	case <-timeout:
+		err = context.DeadlineExceeded
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	return
+}
+
+func (cli *CacheClient) Refresh(key string, quiz *dns.Msg) {
+	_, err := cli.Update(context.Background(), key, quiz)
+	if err == nil {
+		return
+	}
+	logger.Infof("cache prefetch %s failed: %s", key, err.Error())
+
+	cli.mu.Lock()
+	defer cli.mu.Unlock()
+	if elem := cli.lookup(key, quiz); elem != nil {
+		elem.Value.(*CacheEntry).prefetching = false
+	}
+	return
+}
+
+// lookup finds the entry of quiz, the longest scope covers the client subnet wins. must be called with lock.
+func (cli *CacheClient) lookup(key string, quiz *dns.Msg) (elem *list.Element) {
+	e := ClientSubnet(quiz)
+	if e == nil {
+		return cli.entries[key]
+	}
+	var best uint8
+	for scope := range cli.scopes[key] {
+		if scope > e.SourceNetmask || elem != nil && scope <= best {
+			continue
+		}
+		if cur, ok := cli.entries[ScopedKey(key, e, scope)]; ok {
+			elem, best = cur, scope
+		}
+	}
+	return
+}
+
+func (cli *CacheClient) Get(key string, quiz *dns.Msg) (ans *dns.Msg, stale, prefetch bool) {
+	now := time.Now()
+
+	cli.mu.Lock()
+	defer cli.mu.Unlock()
+
+	elem := cli.lookup(key, quiz)
+	if elem == nil {
+		return
+	}
+	entry := elem.Value.(*CacheEntry)
+	if !now.Before(entry.expire.Add(time.Duration(cli.ServeStale) * time.Second)) {
+		cli.remove(elem)
+		return
+	}
+	cli.lru.MoveToFront(elem)
+
+	ans = entry.ans.Copy()
+	ans.Id = quiz.Id
+
+	// RFC 8767: stale answer will be returned only if the upstream failed.
+	if !now.Before(entry.expire) {
+		stale = true
+		SetTTL(ans, uint32(cli.StaleTTL))
+		if opt := ans.IsEdns0(); opt != nil {
+			opt.Option = append(opt.Option, &dns.EDNS0_EDE{
+				InfoCode: dns.ExtendedErrorCodeStaleAnswer,
+			})
+		}
+		return
+	}
+
+	if entry.negative {
+		logger.Debugf("cache negative hit: %s", key)
+		CacheStats.Add("negative-hits", 1)
+	} else {
+		logger.Debugf("cache hit: %s", key)
+		CacheStats.Add("hits", 1)
+	}
+	DecreaseTTL(ans, uint32(now.Sub(entry.stored)/time.Second))
+
+	entry.hits++
+	if cli.Prefetch > 0 && !entry.prefetching && entry.hits >= cli.PrefetchHits {
+		remain := entry.expire.Sub(now)
+		total := entry.expire.Sub(entry.stored)
+		if remain*100 < total*time.Duration(cli.Prefetch) {
+			entry.prefetching = true
+			prefetch = true
+		}
+	}
+	return
+}
+
+func (cli *CacheClient) Set(key string, quiz *dns.Msg, ans *dns.Msg) {
+	ttl, negative, ok := cli.CacheTTL(ans)
+	if !ok {
+		return
+	}
+	if negative {
+		CacheStats.Add("negative-stores", 1)
+	} else {
+		CacheStats.Add("stores", 1)
+	}
+
+	// RFC 7871: the answer is shared by the clients in its scope. No option in answer means scope 0, and scope longer than source is cut.
+	e := ClientSubnet(quiz)
+	var scope uint8
+	if e != nil {
+		if s := ClientSubnet(ans); s != nil {
+			scope = min(s.SourceScope, e.SourceNetmask)
+		}
+	}
+
+	now := time.Now()
+	entry := &CacheEntry{
+		key:      ScopedKey(key, e, scope),
+		base:     key,
+		scoped:   e != nil,
+		scope:    scope,
+		ans:      ans.Copy(),
+		negative: negative,
+		stored:   now,
+		expire:   now.Add(time.Duration(ttl) * time.Second),
+	}
+
+	cli.mu.Lock()
+	defer cli.mu.Unlock()
+
+	if elem, ok := cli.entries[entry.key]; ok {
+		elem.Value = entry
+		cli.lru.MoveToFront(elem)
+		return
+	}
+
+	cli.entries[entry.key] = cli.lru.PushFront(entry)
+	if entry.scoped {
+		if cli.scopes[key] == nil {
+			cli.scopes[key] = make(map[uint8]int)
+		}
+		cli.scopes[key][scope]++
+	}
+	for cli.MaxEntries > 0 && cli.lru.Len() > cli.MaxEntries {
+		cli.remove(cli.lru.Back())
+		CacheStats.Add("evictions", 1)
+	}
+	return
+}
+
+func (cli *CacheClient) remove(elem *list.Element) {
+	entry := cli.lru.Remove(elem).(*CacheEntry)
+	delete(cli.entries, entry.key)
+	if entry.scoped {
+		scopes := cli.scopes[entry.base]
+		scopes[entry.scope]--
+		if scopes[entry.scope] == 0 {
+			delete(scopes, entry.scope)
+		}
+		if len(scopes) == 0 {
+			delete(cli.scopes, entry.base)
+		}
+	}
+	return
+}
+
+func (cli *CacheClient) CacheTTL(ans *dns.Msg) (ttl uint32, negative, ok bool) {
+	switch {
+	case ans.Truncated:
+		return
+
+	case ans.Rcode == dns.RcodeSuccess && len(ans.Answer) != 0:
+		ttl, ok = MinTTL(ans)
+		if !ok {
+			return
+		}
+		if cli.MaxTTL > 0 && ttl > uint32(cli.MaxTTL) {
+			ttl = uint32(cli.MaxTTL)
+		}
+
+	case ans.Rcode == dns.RcodeSuccess || ans.Rcode == dns.RcodeNameError:
+		// RFC 2308: NXDOMAIN and NODATA
+		if cli.MaxNegativeTTL <= 0 {
+			return
+		}
+		negative = true
+		ttl, ok = NegativeTTL(ans)
+		if !ok {
+			return
+		}
+		if ttl > uint32(cli.MaxNegativeTTL) {
+			ttl = uint32(cli.MaxNegativeTTL)
+		}
+
+	default:
+		return
+	}
+
+	if ttl < uint32(cli.MinTTL) {
+		ttl = uint32(cli.MinTTL)
+	}
+	ok = (ttl != 0)
+	return
+}
+
+// CacheKey is the key of quiz without client subnet.
+func CacheKey(quiz *dns.Msg) (key string) {
+	question := quiz.Question[0]
+
+	var do bool
+	if opt := quiz.IsEdns0(); opt != nil {
+		do = opt.Do()
+	}
+
+	key = fmt.Sprintf("%s/%d/%d/%t/%t", strings.ToLower(question.Name),
+		question.Qtype, question.Qclass, do, quiz.CheckingDisabled)
+	return
+}
+
+// ScopedKey appends the client subnet masked by scope to the key. All the families share scope 0.
+func ScopedKey(key string, e *dns.EDNS0_SUBNET, scope uint8) string {
+	switch {
+	case e == nil:
+		return key
+	case scope == 0:
+		return key + "/0"
+	}
+	bits := net.IPv4len * 8
+	if e.Family == 2 {
+		bits = net.IPv6len * 8
+	}
+	mask := net.CIDRMask(int(scope), bits)
+	return fmt.Sprintf("%s/%s/%d", key, e.Address.Mask(mask).String(), scope)
+}
+
+func ClientSubnet(m *dns.Msg) *dns.EDNS0_SUBNET {
+	if opt := m.IsEdns0(); opt != nil {
+		for _, o := range opt.Option {
+			if e, ok := o.(*dns.EDNS0_SUBNET); ok {
+				return e
+			}
+		}
+	}
+	return nil
+}
+
+func MinTTL(ans *dns.Msg) (ttl uint32, ok bool) {
+	for _, section := range [][]dns.RR{ans.Answer, ans.Ns, ans.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+			if !ok || rr.Header().Ttl < ttl {
+				ttl = rr.Header().Ttl
+				ok = true
+			}
+		}
+	}
+	return
+}
+
+func NegativeTTL(ans *dns.Msg) (ttl uint32, ok bool) {
+	for _, rr := range ans.Ns {
+		if soa, isSOA := rr.(*dns.SOA); isSOA {
+			ttl = soa.Hdr.Ttl
+			if soa.Minttl < ttl {
+				ttl = soa.Minttl
+			}
+			ok = true
+			return
+		}
+	}
+	return
+}
+
+func SetTTL(ans *dns.Msg, ttl uint32) {
+	for _, section := range [][]dns.RR{ans.Answer, ans.Ns, ans.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype != dns.TypeOPT {
+				rr.Header().Ttl = ttl
+			}
+		}
+	}
+	return
+}
+
+func DecreaseTTL(ans *dns.Msg, elapsed uint32) {
+	for _, section := range [][]dns.RR{ans.Answer, ans.Ns, ans.Extra} {
+		for _, rr := range section {
+			hdr := rr.Header()
+			if hdr.Rrtype == dns.TypeOPT {
+				continue
+			}
+			if hdr.Ttl > elapsed {
+				hdr.Ttl -= elapsed
+			} else {
+				hdr.Ttl = 0
+			}
+		}
+	}
+	return
+}
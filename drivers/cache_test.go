@@ -0,0 +1,353 @@
+package drivers
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+type StaticClient struct {
+	Records []string
+	Rcode   int
+	Err     error
+	Count   atomic.Int32
+}
+
+func (cli *StaticClient) Url() (u string) {
+	return "static://"
+}
+
+func (cli *StaticClient) Exchange(ctx context.Context, quiz *dns.Msg) (ans *dns.Msg, err error) {
+	cli.Count.Add(1)
+	if cli.Err != nil {
+		return nil, cli.Err
+	}
+
+	ans = &dns.Msg{}
+	ans.SetRcode(quiz, cli.Rcode)
+	if opt := quiz.IsEdns0(); opt != nil {
+		ans.SetEdns0(opt.UDPSize(), opt.Do())
+	}
+	for _, s := range cli.Records {
+		var rr dns.RR
+		rr, err = dns.NewRR(s)
+		if err != nil {
+			return nil, err
+		}
+		if rr.Header().Rrtype == dns.TypeSOA {
+			ans.Ns = append(ans.Ns, rr)
+		} else {
+			ans.Answer = append(ans.Answer, rr)
+		}
+	}
+	return
+}
+
+func TestMain(m *testing.M) {
+	SetLogging("", "ERROR")
+	os.Exit(m.Run())
+}
+
+func NewTestCache(upstream Client) (cli *CacheClient) {
+	cli = NewCacheClient("", []byte(`{"client": {"url": "udp://127.0.0.1:1"}}`))
+	cli.cli = upstream
+	return
+}
+
+func TestCacheHit(t *testing.T) {
+	upstream := &StaticClient{Records: []string{"www.example.com. 300 IN A 192.0.2.1"}}
+	cli := NewTestCache(upstream)
+
+	quiz := &dns.Msg{}
+	quiz.SetQuestion("www.example.com.", dns.TypeA)
+	for i := 0; i < 3; i++ {
+		ans, err := cli.Exchange(context.Background(), quiz)
+		if err != nil {
+			t.Fatalf("exchange failed: %s", err)
+		}
+		if ans.Id != quiz.Id || len(ans.Answer) != 1 {
+			t.Fatalf("wrong answer: %s", ans)
+		}
+	}
+	if upstream.Count.Load() != 1 {
+		t.Fatalf("upstream queried %d times.", upstream.Count.Load())
+	}
+
+	quiz.SetQuestion("WWW.Example.COM.", dns.TypeA)
+	cli.Exchange(context.Background(), quiz)
+	if upstream.Count.Load() != 1 {
+		t.Fatalf("cache key should be case insensitive.")
+	}
+
+	quiz.SetQuestion("www.example.com.", dns.TypeAAAA)
+	cli.Exchange(context.Background(), quiz)
+	if upstream.Count.Load() != 2 {
+		t.Fatalf("qtype should be part of cache key.")
+	}
+}
+
+func TestCacheKey(t *testing.T) {
+	quiz := &dns.Msg{}
+	quiz.SetQuestion("www.example.com.", dns.TypeA)
+	plain := CacheKey(quiz)
+
+	quiz.SetEdns0(4096, true)
+	do := CacheKey(quiz)
+	if do == plain {
+		t.Fatalf("DO bit should be part of cache key.")
+	}
+
+	AppendEdns0Subnet(quiz, []byte{192, 0, 2, 1}, 24)
+	ecs1 := ScopedKey(do, ClientSubnet(quiz), 24)
+	quiz.IsEdns0().Option = nil
+	AppendEdns0Subnet(quiz, []byte{192, 0, 2, 200}, 24)
+	ecs2 := ScopedKey(do, ClientSubnet(quiz), 24)
+	if ecs1 == do || ecs1 != ecs2 {
+		t.Fatalf("wrong ecs key: %s, %s.", ecs1, ecs2)
+	}
+	if ScopedKey(do, ClientSubnet(quiz), 25) == ecs1 {
+		t.Fatalf("scope should be part of ecs key.")
+	}
+}
+
+// ScopeClient answers with the client subnet of quiz in scope.
+type ScopeClient struct {
+	StaticClient
+	Scope uint8
+}
+
+func (cli *ScopeClient) Exchange(ctx context.Context, quiz *dns.Msg) (ans *dns.Msg, err error) {
+	ans, err = cli.StaticClient.Exchange(ctx, quiz)
+	if err != nil {
+		return
+	}
+	if e := ClientSubnet(quiz); e != nil {
+		AppendEdns0Subnet(ans, e.Address, e.SourceNetmask)
+		ClientSubnet(ans).SourceScope = cli.Scope
+	}
+	return
+}
+
+func TestCacheScope(t *testing.T) {
+	for _, c := range []struct {
+		scope uint8
+		count int32
+	}{
+		{0, 1},
+		{16, 2},
+		{24, 3},
+		{32, 3},
+	} {
+		upstream := &ScopeClient{
+			StaticClient: StaticClient{Records: []string{"www.example.com. 300 IN A 192.0.2.1"}},
+			Scope:        c.scope,
+		}
+		cli := NewTestCache(upstream)
+
+		for _, addr := range [][]byte{{192, 0, 2, 1}, {192, 0, 3, 1}, {192, 1, 2, 1}, {192, 0, 2, 200}} {
+			quiz := &dns.Msg{}
+			quiz.SetQuestion("www.example.com.", dns.TypeA)
+			AppendEdns0Subnet(quiz, addr, 24)
+			_, err := cli.Exchange(context.Background(), quiz)
+			if err != nil {
+				t.Fatalf("exchange failed: %s", err)
+			}
+		}
+		if upstream.Count.Load() != c.count {
+			t.Fatalf("scope %d: upstream queried %d times.", c.scope, upstream.Count.Load())
+		}
+	}
+}
+
+func TestCacheExpire(t *testing.T) {
+	upstream := &StaticClient{Records: []string{"www.example.com. 0 IN A 192.0.2.1"}}
+	cli := NewTestCache(upstream)
+
+	quiz := &dns.Msg{}
+	quiz.SetQuestion("www.example.com.", dns.TypeA)
+	cli.Exchange(context.Background(), quiz)
+	cli.Exchange(context.Background(), quiz)
+	if upstream.Count.Load() != 2 {
+		t.Fatalf("zero ttl answer should not be cached.")
+	}
+}
+
+func TestCacheLRU(t *testing.T) {
+	upstream := &StaticClient{Records: []string{"www.example.com. 300 IN A 192.0.2.1"}}
+	cli := NewTestCache(upstream)
+	cli.MaxEntries = 2
+
+	quiz := &dns.Msg{}
+	for _, name := range []string{"a.example.com.", "b.example.com.", "a.example.com.", "c.example.com."} {
+		quiz.SetQuestion(name, dns.TypeA)
+		cli.Exchange(context.Background(), quiz)
+	}
+	if cli.lru.Len() != 2 || upstream.Count.Load() != 3 {
+		t.Fatalf("wrong lru size %d, count %d.", cli.lru.Len(), upstream.Count.Load())
+	}
+
+	quiz.SetQuestion("a.example.com.", dns.TypeA)
+	cli.Exchange(context.Background(), quiz)
+	if upstream.Count.Load() != 3 {
+		t.Fatalf("recently used entry evicted.")
+	}
+	quiz.SetQuestion("b.example.com.", dns.TypeA)
+	cli.Exchange(context.Background(), quiz)
+	if upstream.Count.Load() != 4 {
+		t.Fatalf("least recently used entry not evicted.")
+	}
+}
+
+func TestDecreaseTTL(t *testing.T) {
+	rr, _ := dns.NewRR("www.example.com. 300 IN A 192.0.2.1")
+	ans := &dns.Msg{Answer: []dns.RR{rr}}
+	ans.SetEdns0(4096, false)
+
+	DecreaseTTL(ans, 100)
+	if rr.Header().Ttl != 200 {
+		t.Fatalf("wrong ttl %d.", rr.Header().Ttl)
+	}
+	DecreaseTTL(ans, 1000)
+	if rr.Header().Ttl != 0 {
+		t.Fatalf("wrong ttl %d.", rr.Header().Ttl)
+	}
+	if ans.IsEdns0() == nil || ans.IsEdns0().UDPSize() != 4096 {
+		t.Fatalf("opt record should not be touched.")
+	}
+}
+
+func TestCacheNegative(t *testing.T) {
+	upstream := &StaticClient{
+		Rcode:   dns.RcodeNameError,
+		Records: []string{"example.com. 3600 IN SOA ns.example.com. admin.example.com. 1 7200 3600 86400 60"},
+	}
+	cli := NewTestCache(upstream)
+
+	quiz := &dns.Msg{}
+	quiz.SetQuestion("nx.example.com.", dns.TypeA)
+	cli.Exchange(context.Background(), quiz)
+	ans, err := cli.Exchange(context.Background(), quiz)
+	if err != nil {
+		t.Fatalf("exchange failed: %s", err)
+	}
+	if upstream.Count.Load() != 1 || ans.Rcode != dns.RcodeNameError {
+		t.Fatalf("nxdomain not cached: %d.", upstream.Count.Load())
+	}
+
+	key := CacheKey(quiz)
+	entry := cli.entries[key].Value.(*CacheEntry)
+	if !entry.negative || entry.expire.Sub(entry.stored) != 60*time.Second {
+		t.Fatalf("negative ttl should be soa minimum, %s.", entry.expire.Sub(entry.stored))
+	}
+
+	cli.MaxNegativeTTL = 0
+	quiz.SetQuestion("nx2.example.com.", dns.TypeA)
+	cli.Exchange(context.Background(), quiz)
+	cli.Exchange(context.Background(), quiz)
+	if upstream.Count.Load() != 3 {
+		t.Fatalf("negative cache should be disabled.")
+	}
+}
+
+func TestCacheNoData(t *testing.T) {
+	jsonresp := &DNSMsg{
+		Status:    0,
+		Question:  []DNSQuestion{{Name: "www.example.com.", Type: int32(dns.TypeAAAA)}},
+		Authority: []DNSRR{{Name: "example.com.", Type: int32(dns.TypeSOA), TTL: 30, Data: "ns.example.com. admin.example.com. 1 7200 3600 86400 300"}},
+	}
+	quiz := &dns.Msg{}
+	quiz.SetQuestion("www.example.com.", dns.TypeAAAA)
+	ans, err := jsonresp.TranslateAnswer(quiz)
+	if err != nil {
+		t.Fatalf("translate failed: %s", err)
+	}
+
+	cli := NewTestCache(&StaticClient{})
+	ttl, negative, ok := cli.CacheTTL(ans)
+	if !ok || !negative || ttl != 30 {
+		t.Fatalf("wrong nodata ttl %d, %t, %t.", ttl, negative, ok)
+	}
+
+	ans.Ns = nil
+	_, _, ok = cli.CacheTTL(ans)
+	if ok {
+		t.Fatalf("negative answer without soa should not be cached.")
+	}
+}
+
+func TestCacheServeStale(t *testing.T) {
+	upstream := &StaticClient{Records: []string{"www.example.com. 300 IN A 192.0.2.1"}}
+	cli := NewTestCache(upstream)
+	cli.ServeStale = 3600
+
+	quiz := &dns.Msg{}
+	quiz.SetQuestion("www.example.com.", dns.TypeA)
+	quiz.SetEdns0(4096, false)
+	cli.Exchange(context.Background(), quiz)
+
+	entry := cli.entries[CacheKey(quiz)].Value.(*CacheEntry)
+	entry.stored = entry.stored.Add(-time.Hour)
+	entry.expire = entry.expire.Add(-time.Hour)
+
+	upstream.Err = errors.New("upstream down")
+	ans, err := cli.Exchange(context.Background(), quiz)
+	if err != nil {
+		t.Fatalf("stale answer should be returned: %s", err)
+	}
+	if ans.Answer[0].Header().Ttl != DEFAULT_CACHE_STALETTL {
+		t.Fatalf("wrong stale ttl %d.", ans.Answer[0].Header().Ttl)
+	}
+	ede, ok := ans.IsEdns0().Option[0].(*dns.EDNS0_EDE)
+	if !ok || ede.InfoCode != dns.ExtendedErrorCodeStaleAnswer {
+		t.Fatalf("stale answer should have ede option.")
+	}
+
+	upstream.Err = nil
+	ans, err = cli.Exchange(context.Background(), quiz)
+	if err != nil || ans.Answer[0].Header().Ttl != 300 {
+		t.Fatalf("fresh answer should be returned when upstream recovered.")
+	}
+
+	entry = cli.entries[CacheKey(quiz)].Value.(*CacheEntry)
+	entry.expire = entry.expire.Add(-2 * time.Hour)
+	upstream.Err = errors.New("upstream down")
+	_, err = cli.Exchange(context.Background(), quiz)
+	if err == nil {
+		t.Fatalf("answer expired longer than serve-stale should not be returned.")
+	}
+}
+
+func TestCachePrefetch(t *testing.T) {
+	upstream := &StaticClient{Records: []string{"www.example.com. 300 IN A 192.0.2.1"}}
+	cli := NewTestCache(upstream)
+	cli.Prefetch = 10
+	cli.PrefetchHits = 2
+
+	quiz := &dns.Msg{}
+	quiz.SetQuestion("www.example.com.", dns.TypeA)
+	cli.Exchange(context.Background(), quiz)
+
+	cli.mu.Lock()
+	entry := cli.entries[CacheKey(quiz)].Value.(*CacheEntry)
+	entry.stored = entry.stored.Add(-280 * time.Second)
+	entry.expire = entry.expire.Add(-280 * time.Second)
+	cli.mu.Unlock()
+
+	cli.Exchange(context.Background(), quiz)
+	if upstream.Count.Load() != 1 {
+		t.Fatalf("entry should not be prefetched before enough hits.")
+	}
+	cli.Exchange(context.Background(), quiz)
+
+	for i := 0; i < 100 && upstream.Count.Load() != 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if upstream.Count.Load() != 2 {
+		t.Fatalf("popular entry not prefetched.")
+	}
+}
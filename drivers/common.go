@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"math/rand"
 	"net"
 	"net/http"
@@ -103,6 +104,20 @@ func GuessDriver(URL string) (driver string, err error) {
 	case "udp", "tcp", "tcp-tls":
 		driver = "dns"
 
+	case "quic":
+		driver = "doq"
+
+	case "sdns":
+		var stamp *Stamp
+		stamp, err = ParseStamp(URL)
+		if err != nil {
+			return
+		}
+		driver = stamp.Driver()
+
+	case "odoh":
+		driver = "odoh"
+
 	case "http", "https":
 		switch u.Path {
 		case "/resolve":
@@ -122,6 +137,26 @@ func GuessDriver(URL string) (driver string, err error) {
 	return
 }
 
+// ParseCIDRs parses a list of CIDRs, a single IP is a CIDR of itself.
+func ParseCIDRs(list []string) (ipnets []*net.IPNet, err error) {
+	for _, s := range list {
+		if !strings.Contains(s, "/") {
+			if strings.Contains(s, ":") {
+				s += "/128"
+			} else {
+				s += "/32"
+			}
+		}
+		var ipnet *net.IPNet
+		_, ipnet, err = net.ParseCIDR(s)
+		if err != nil {
+			return
+		}
+		ipnets = append(ipnets, ipnet)
+	}
+	return
+}
+
 func GuessPort(u *url.URL) {
 	if strings.Contains(u.Host, ":") {
 		return
@@ -130,7 +165,7 @@ func GuessPort(u *url.URL) {
 	switch u.Scheme {
 	case "udp", "tcp":
 		u.Host = net.JoinHostPort(u.Host, "53")
-	case "tcp-tls":
+	case "tcp-tls", "quic":
 		u.Host = net.JoinHostPort(u.Host, "853")
 	default:
 	}
@@ -161,6 +196,51 @@ func AppendEdns0Subnet(m *dns.Msg, addr net.IP, mask uint8) {
 	opt.Option = append(opt.Option, e)
 }
 
+// SetClientSubnet appends the edns client subnet by the setting of server, "client" means the address of client.
+func SetClientSubnet(quiz *dns.Msg, subnet string, raddr net.Addr) {
+	var addr net.IP
+	var mask uint8
+	var err error
+	switch subnet {
+	case "":
+	case "client":
+		switch taddr := raddr.(type) {
+		case *net.TCPAddr:
+			addr = taddr.IP
+		case *net.UDPAddr:
+			addr = taddr.IP
+		default:
+			panic(fmt.Sprintf("unknown addr %s", raddr.Network()))
+		}
+		mask = 32
+		AppendEdns0Subnet(quiz, addr, mask)
+
+	default:
+		addr, mask, err = ParseSubnet(subnet)
+		if err != nil {
+			panic(err.Error())
+		}
+		AppendEdns0Subnet(quiz, addr, mask)
+	}
+	return
+}
+
+func ServFail(quiz *dns.Msg, code uint16, reason string) (ans *dns.Msg) {
+	ans = &dns.Msg{}
+	ans.SetRcode(quiz, dns.RcodeServerFailure)
+	ans.RecursionAvailable = true
+
+	opt := quiz.IsEdns0()
+	if opt != nil {
+		ans.SetEdns0(opt.UDPSize(), opt.Do())
+		ans.IsEdns0().Option = append(ans.IsEdns0().Option, &dns.EDNS0_EDE{
+			InfoCode:  code,
+			ExtraText: reason,
+		})
+	}
+	return
+}
+
 func ParseSubnet(subnet string) (ip net.IP, mask uint8, err error) {
 	ip, ipnet, err := net.ParseCIDR(subnet)
 	if err != nil {
@@ -0,0 +1,154 @@
+package drivers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ameshkov/dnscrypt/v2"
+	"github.com/ameshkov/dnsstamps"
+	"github.com/miekg/dns"
+)
+
+const (
+	DNSCRYPT_TIMEOUT = 5 * time.Second
+)
+
+var (
+	ErrNotDNSCrypt = errors.New("stamp is not dnscrypt")
+)
+
+type DNSCryptClient struct {
+	URL     string
+	Timeout int
+	Net     string `json:"net"`
+	stamp   dnsstamps.ServerStamp
+	mu      sync.Mutex
+	info    *dnscrypt.ResolverInfo
+}
+
+func NewDNSCryptClient(URL string, body json.RawMessage) (cli *DNSCryptClient) {
+	cli = &DNSCryptClient{}
+	if body != nil {
+		err := json.Unmarshal(body, &cli)
+		if err != nil {
+			panic(err.Error())
+		}
+	}
+	cli.URL = URL
+
+	if Timeout != 0 {
+		cli.Timeout = Timeout
+	}
+
+	switch cli.Net {
+	case "":
+		cli.Net = "udp"
+	case "udp", "tcp":
+	default:
+		panic(ErrConfigParse.Error())
+	}
+
+	stamp, err := ParseStamp(URL)
+	if err != nil {
+		panic(err.Error())
+	}
+	if stamp.Proto != STAMP_DNSCRYPT {
+		panic(ErrNotDNSCrypt.Error())
+	}
+	addr := stamp.Addr
+	if _, _, err = net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(strings.Trim(addr, "[]"), "443")
+	}
+	cli.stamp = dnsstamps.ServerStamp{
+		Proto:         dnsstamps.StampProtoTypeDNSCrypt,
+		Props:         dnsstamps.ServerInformalProperties(stamp.Props),
+		ServerAddrStr: addr,
+		ServerPk:      stamp.PublicKey,
+		ProviderName:  stamp.Host,
+	}
+	return
+}
+
+func (cli *DNSCryptClient) Url() (u string) {
+	return cli.URL
+}
+
+// client sets the timeout by the deadline of ctx, the library resets deadlines of the connection by it.
+func (cli *DNSCryptClient) client(ctx context.Context, network string) *dnscrypt.Client {
+	timeout := DNSCRYPT_TIMEOUT
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = time.Until(deadline)
+	}
+	return &dnscrypt.Client{Net: network, Timeout: timeout}
+}
+
+// Resolver returns the verified resolver info, fetches the certificate again if it's expired.
+// The certificate is fetched without lock, so the other queries are not blocked by a slow server.
+func (cli *DNSCryptClient) Resolver(ctx context.Context) (info *dnscrypt.ResolverInfo, err error) {
+	cli.mu.Lock()
+	info = cli.info
+	cli.mu.Unlock()
+	if info != nil && time.Now().Unix() <= int64(info.ResolverCert.NotAfter) {
+		return
+	}
+
+	logger.Debugf("dnscrypt fetch certificate from %s", cli.stamp.ServerAddrStr)
+	info, err = cli.client(ctx, cli.Net).DialStamp(cli.stamp)
+	if err != nil {
+		return
+	}
+	cli.mu.Lock()
+	cli.info = info
+	cli.mu.Unlock()
+	return
+}
+
+func (cli *DNSCryptClient) reset(info *dnscrypt.ResolverInfo) {
+	cli.mu.Lock()
+	defer cli.mu.Unlock()
+	if cli.info == info {
+		cli.info = nil
+	}
+}
+
+func (cli *DNSCryptClient) Exchange(ctx context.Context, quiz *dns.Msg) (ans *dns.Msg, err error) {
+	if cli.Timeout != 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(cli.Timeout)*time.Millisecond)
+		defer cancel()
+	}
+
+	info, err := cli.Resolver(ctx)
+	if err != nil {
+		logger.Error(err.Error())
+		return
+	}
+
+	ans, err = cli.exchange(ctx, cli.Net, quiz, info)
+	if err == nil && ans.Truncated && cli.Net == "udp" {
+		logger.Debugf("dnscrypt answer truncated, retry in tcp")
+		ans, err = cli.exchange(ctx, "tcp", quiz, info)
+	}
+	if err != nil {
+		// the certificate may be rotated by the server, fetch it again next time.
+		logger.Info(err.Error())
+		cli.reset(info)
+		return
+	}
+	return
+}
+
+func (cli *DNSCryptClient) exchange(ctx context.Context, network string, quiz *dns.Msg, info *dnscrypt.ResolverInfo) (ans *dns.Msg, err error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, network, info.ServerAddress)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	return cli.client(ctx, network).ExchangeConn(conn, quiz, info)
+}
@@ -0,0 +1,159 @@
+package drivers
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ameshkov/dnscrypt/v2"
+	"github.com/ameshkov/dnsstamps"
+	"github.com/miekg/dns"
+)
+
+// TestDNSCryptHandler answers by upstream, and truncates all answers in udp if truncate is set.
+type TestDNSCryptHandler struct {
+	upstream Client
+	truncate atomic.Bool
+}
+
+func (h *TestDNSCryptHandler) ServeDNS(rw dnscrypt.ResponseWriter, r *dns.Msg) error {
+	ans, err := h.upstream.Exchange(context.Background(), r)
+	if err != nil {
+		return err
+	}
+	if _, ok := rw.RemoteAddr().(*net.UDPAddr); ok && h.truncate.Load() {
+		ans.Answer = nil
+		ans.Truncated = true
+	}
+	return rw.WriteMsg(ans)
+}
+
+func StartTestDNSCrypt(t *testing.T, handler dnscrypt.Handler) (URL string) {
+	rc, err := dnscrypt.GenerateResolverConfig("example.org", nil)
+	if err != nil {
+		t.Fatalf("generate resolver config failed: %s", err)
+	}
+	cert, err := rc.CreateCert()
+	if err != nil {
+		t.Fatalf("create cert failed: %s", err)
+	}
+	srv := &dnscrypt.Server{
+		ProviderName: rc.ProviderName,
+		ResolverCert: cert,
+		Handler:      handler,
+	}
+
+	pc, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("listen failed: %s", err)
+	}
+	port := pc.LocalAddr().(*net.UDPAddr).Port
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port})
+	if err != nil {
+		t.Fatalf("listen failed: %s", err)
+	}
+	go srv.ServeUDP(pc)
+	go srv.ServeTCP(ln)
+	t.Cleanup(func() { srv.Shutdown(context.Background()) })
+
+	stamp, err := rc.CreateStamp(pc.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("create stamp failed: %s", err)
+	}
+	return stamp.String()
+}
+
+func TestDNSCrypt(t *testing.T) {
+	handler := &TestDNSCryptHandler{
+		upstream: &StaticClient{Records: []string{"www.example.com. 300 IN A 192.0.2.1"}},
+	}
+	URL := StartTestDNSCrypt(t, handler)
+
+	header := &DriverHeader{URL: URL}
+	cli := header.CreateClient(nil).(*DNSCryptClient)
+
+	quiz := &dns.Msg{}
+	quiz.SetQuestion("www.example.com.", dns.TypeA)
+	for i := 0; i < 2; i++ {
+		ans, err := cli.Exchange(context.Background(), quiz)
+		if err != nil {
+			t.Fatalf("exchange failed: %s", err)
+		}
+		if ans.Id != quiz.Id || len(ans.Answer) != 1 {
+			t.Fatalf("wrong answer: %s", ans)
+		}
+	}
+
+	handler.truncate.Store(true)
+	ans, err := cli.Exchange(context.Background(), quiz)
+	if err != nil {
+		t.Fatalf("exchange failed: %s", err)
+	}
+	if ans.Truncated || len(ans.Answer) != 1 {
+		t.Fatalf("truncated answer should be retried in tcp: %s", ans)
+	}
+}
+
+func TestDNSCryptSlowCertificate(t *testing.T) {
+	URL := StartTestDNSCrypt(t, &TestDNSCryptHandler{upstream: &StaticClient{}})
+	header := &DriverHeader{URL: URL}
+	cli := header.CreateClient(nil).(*DNSCryptClient)
+
+	// the server never answers the certificate query.
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %s", err)
+	}
+	defer pc.Close()
+	cli.stamp.ServerAddrStr = pc.LocalAddr().String()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	go cli.Resolver(ctx)
+	time.Sleep(50 * time.Millisecond)
+
+	// the other query gives up by its own timeout, not blocked by the fetching one.
+	ctx2, cancel2 := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel2()
+	begin := time.Now()
+	_, err = cli.Resolver(ctx2)
+	if err == nil || time.Since(begin) > time.Second {
+		t.Fatalf("query should not wait for the other fetch: %s %v", time.Since(begin), err)
+	}
+}
+
+func TestDNSCryptBadStamp(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatalf("doh stamp should not be accepted")
+		}
+	}()
+	// a doh stamp for dns.google.
+	NewDNSCryptClient("sdns://AgUAAAAAAAAAAAAKZG5zLmdvb2dsZQovZG5zLXF1ZXJ5", nil)
+}
+
+func TestDNSCryptStamp(t *testing.T) {
+	for _, c := range []struct {
+		addr string
+		full string
+	}{
+		{"192.0.2.1", "192.0.2.1:443"},
+		{"192.0.2.1:8443", "192.0.2.1:8443"},
+		{"[2001:db8::1]", "[2001:db8::1]:443"},
+	} {
+		stamp := dnsstamps.ServerStamp{
+			Proto:         dnsstamps.StampProtoTypeDNSCrypt,
+			Props:         dnsstamps.ServerInformalPropertyDNSSEC,
+			ServerAddrStr: c.addr,
+			ServerPk:      make([]byte, 32),
+			ProviderName:  "2.dnscrypt-cert.example.com",
+		}
+		cli := NewDNSCryptClient(stamp.String(), nil)
+		if cli.stamp.ServerAddrStr != c.full || cli.stamp.ProviderName != stamp.ProviderName ||
+			len(cli.stamp.ServerPk) != 32 || cli.stamp.Props != stamp.Props {
+			t.Fatalf("wrong stamp of %s: %+v", c.addr, cli.stamp)
+		}
+	}
+}
@@ -0,0 +1,864 @@
+package drivers
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/shell909090/doh/rrtree"
+)
+
+const (
+	MAX_DNSSEC_TTL = 3600
+)
+
+var (
+	ErrNoTrustAnchor = errors.New("no usable trust anchor")
+	ErrNoDNSKEY      = errors.New("no dnskey matches ds")
+	ErrNoSignature   = errors.New("missing signature")
+	ErrBadSignature  = errors.New("no valid signature")
+	ErrNoDenial      = errors.New("nonexistence not proven")
+
+	// https://data.iana.org/root-anchors/root-anchors.xml
+	ROOT_ANCHORS = []string{
+		". 172800 IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D",
+		". 172800 IN DS 38696 8 2 683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16",
+	}
+)
+
+type Exchanger func(ctx context.Context, quiz *dns.Msg) (ans *dns.Msg, err error)
+
+// ZoneKeys is the closest secure zone of a name, the zone is empty if the name is insecure.
+type ZoneKeys struct {
+	Zone   string
+	Keys   []*dns.DNSKEY
+	expire time.Time
+}
+
+type Validator struct {
+	exchange Exchanger
+	anchors  map[string][]*dns.DS
+	mu       sync.Mutex
+	zones    map[string]*ZoneKeys
+}
+
+func NewValidator(exchange Exchanger, anchors map[string][]*dns.DS) (v *Validator) {
+	v = &Validator{
+		exchange: exchange,
+		anchors:  anchors,
+		zones:    make(map[string]*ZoneKeys),
+	}
+	return
+}
+
+func DefaultTrustAnchors() (anchors map[string][]*dns.DS) {
+	anchors = make(map[string][]*dns.DS)
+	for _, s := range ROOT_ANCHORS {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			panic(err.Error())
+		}
+		anchors["."] = append(anchors["."], rr.(*dns.DS))
+	}
+	return
+}
+
+// ReadTrustAnchorFile reads DS or DNSKEY records in zone file format, like root.key of unbound.
+func ReadTrustAnchorFile(filename string) (anchors map[string][]*dns.DS, err error) {
+	logger.Infof("load trust anchors from file %s.", filename)
+
+	file, err := os.Open(filename)
+	if err != nil {
+		logger.Error(err.Error())
+		return
+	}
+	defer file.Close()
+
+	anchors = make(map[string][]*dns.DS)
+	count := 0
+	zp := dns.NewZoneParser(file, ".", filename)
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		var ds *dns.DS
+		switch v := rr.(type) {
+		case *dns.DS:
+			ds = v
+		case *dns.DNSKEY:
+			ds = v.ToDS(dns.SHA256)
+		}
+		if ds == nil {
+			continue
+		}
+		zone := dns.CanonicalName(ds.Hdr.Name)
+		anchors[zone] = append(anchors[zone], ds)
+		count++
+	}
+	err = zp.Err()
+	if err != nil {
+		logger.Error(err.Error())
+		return
+	}
+
+	if count == 0 {
+		err = ErrConfigParse
+		return
+	}
+	logger.Infof("trust anchors loaded %d record(s).", count)
+	return
+}
+
+func IsBogus(err error) bool {
+	return errors.Is(err, ErrNoTrustAnchor) || errors.Is(err, ErrNoDNSKEY) ||
+		errors.Is(err, ErrNoSignature) || errors.Is(err, ErrBadSignature) ||
+		errors.Is(err, ErrNoDenial)
+}
+
+func ValidateErrorCode(err error) (code uint16) {
+	switch {
+	case errors.Is(err, ErrNoDNSKEY), errors.Is(err, ErrNoTrustAnchor):
+		code = dns.ExtendedErrorCodeDNSKEYMissing
+	case errors.Is(err, ErrNoSignature):
+		code = dns.ExtendedErrorCodeRRSIGsMissing
+	case errors.Is(err, ErrNoDenial):
+		code = dns.ExtendedErrorCodeNSECMissing
+	case errors.Is(err, ErrBadSignature):
+		code = dns.ExtendedErrorCodeDNSBogus
+	default:
+		code = dns.ExtendedErrorCodeNoReachableAuthority
+	}
+	return
+}
+
+func (v *Validator) Query(ctx context.Context, name string, qtype uint16) (ans *dns.Msg, err error) {
+	quiz := &dns.Msg{}
+	quiz.SetQuestion(name, qtype)
+	quiz.SetEdns0(4096, true)
+	quiz.CheckingDisabled = true
+	ans, err = v.exchange(ctx, quiz)
+	if err != nil {
+		return
+	}
+	if ans.Rcode != dns.RcodeSuccess && ans.Rcode != dns.RcodeNameError {
+		err = ErrRequest
+		return
+	}
+	return
+}
+
+func (v *Validator) cached(name string) (zk *ZoneKeys, ok bool) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	zk, ok = v.zones[name]
+	if ok && !time.Now().Before(zk.expire) {
+		delete(v.zones, name)
+		return nil, false
+	}
+	return
+}
+
+func (v *Validator) store(name string, zk *ZoneKeys) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.zones[name] = zk
+	return
+}
+
+// Keys walks down from the closest trust anchor, and returns the closest secure zone of name.
+func (v *Validator) Keys(ctx context.Context, name string) (zk *ZoneKeys, err error) {
+	name = dns.CanonicalName(name)
+	anchor := ""
+	found := false
+	for zone := range v.anchors {
+		if dns.IsSubDomain(zone, name) && (!found || dns.CountLabel(zone) > dns.CountLabel(anchor)) {
+			anchor = zone
+			found = true
+		}
+	}
+	if !found {
+		zk = &ZoneKeys{}
+		return
+	}
+
+	zk, ok := v.cached(anchor)
+	if !ok {
+		zk, err = v.ZoneKeysByDS(ctx, anchor, v.anchors[anchor])
+		if err != nil {
+			return
+		}
+		if zk.Zone == "" {
+			err = ErrNoTrustAnchor
+			return
+		}
+		v.store(anchor, zk)
+	}
+
+	labels := dns.SplitDomainName(name)
+	for i := dns.CountLabel(anchor) + 1; i <= len(labels); i++ {
+		if zk.Zone == "" {
+			return
+		}
+		sub := dns.Fqdn(strings.Join(labels[len(labels)-i:], "."))
+		next, ok := v.cached(sub)
+		if !ok {
+			next, err = v.Delegation(ctx, zk, sub)
+			if err != nil {
+				return
+			}
+			v.store(sub, next)
+		}
+		zk = next
+	}
+	return
+}
+
+// Delegation checks if name is a zone cut under the secure zone parent.
+func (v *Validator) Delegation(ctx context.Context, parent *ZoneKeys, name string) (zk *ZoneKeys, err error) {
+	ans, err := v.Query(ctx, name, dns.TypeDS)
+	if err != nil {
+		return
+	}
+
+	var dsset []dns.RR
+	for _, rr := range ans.Answer {
+		if rr.Header().Rrtype == dns.TypeDS && EqualName(rr.Header().Name, name) {
+			dsset = append(dsset, rr)
+		}
+	}
+
+	if len(dsset) != 0 {
+		err = VerifyRRset(parent, dsset, Signatures(ans.Answer, name, dns.TypeDS))
+		if err != nil {
+			return
+		}
+		var anchors []*dns.DS
+		for _, rr := range dsset {
+			anchors = append(anchors, rr.(*dns.DS))
+		}
+		return v.ZoneKeysByDS(ctx, name, anchors)
+	}
+
+	for _, rrset := range SplitRRsets(ans.Ns) {
+		hdr := rrset[0].Header()
+		switch hdr.Rrtype {
+		case dns.TypeNSEC, dns.TypeNSEC3:
+			err = VerifyRRset(parent, rrset, Signatures(ans.Ns, hdr.Name, hdr.Rrtype))
+			if err != nil {
+				return
+			}
+		}
+	}
+
+	insecure, err := DenyDS(name, ans.Ns)
+	if err != nil {
+		return
+	}
+	if insecure {
+		logger.Infof("insecure delegation %s.", name)
+		zk = &ZoneKeys{expire: time.Now().Add(time.Duration(KeysTTL(ans.Ns)) * time.Second)}
+		return
+	}
+	zk = parent
+	return
+}
+
+// ZoneKeysByDS reads DNSKEY of the zone, and checks them by the DS.
+func (v *Validator) ZoneKeysByDS(ctx context.Context, zone string, anchors []*dns.DS) (zk *ZoneKeys, err error) {
+	supported := false
+	for _, ds := range anchors {
+		if SupportedDS(ds) {
+			supported = true
+		}
+	}
+	if !supported {
+		// RFC 4035 5.2: treat the zone as insecure if no algorithm is supported.
+		logger.Infof("no supported algorithm in ds of %s.", zone)
+		zk = &ZoneKeys{expire: time.Now().Add(MAX_DNSSEC_TTL * time.Second)}
+		return
+	}
+
+	ans, err := v.Query(ctx, zone, dns.TypeDNSKEY)
+	if err != nil {
+		return
+	}
+
+	var keyset []dns.RR
+	zk = &ZoneKeys{Zone: dns.CanonicalName(zone)}
+	trusted := &ZoneKeys{Zone: zk.Zone}
+	for _, rr := range ans.Answer {
+		key, ok := rr.(*dns.DNSKEY)
+		if !ok || !EqualName(key.Hdr.Name, zone) {
+			continue
+		}
+		keyset = append(keyset, key)
+		if key.Flags&dns.ZONE == 0 || key.Protocol != 3 {
+			continue
+		}
+		zk.Keys = append(zk.Keys, key)
+		if MatchDS(key, anchors) {
+			trusted.Keys = append(trusted.Keys, key)
+		}
+	}
+	if len(trusted.Keys) == 0 {
+		err = ErrNoDNSKEY
+		return
+	}
+
+	err = VerifyRRset(trusted, keyset, Signatures(ans.Answer, zone, dns.TypeDNSKEY))
+	if err != nil {
+		return
+	}
+	zk.expire = time.Now().Add(time.Duration(KeysTTL(keyset)) * time.Second)
+	return
+}
+
+// Validate checks the answer, returns true if it's secure, and error if it's bogus.
+func (v *Validator) Validate(ctx context.Context, ans *dns.Msg) (secure bool, err error) {
+	if ans.Rcode != dns.RcodeSuccess && ans.Rcode != dns.RcodeNameError {
+		return
+	}
+	if len(ans.Question) != 1 {
+		return false, ErrRequest
+	}
+	question := ans.Question[0]
+
+	secure = true
+	wildcard := ""
+	for _, rrset := range SplitRRsets(ans.Answer) {
+		var ok bool
+		var closest string
+		ok, closest, err = v.VerifyAnswer(ctx, ans.Answer, rrset)
+		if err != nil {
+			return false, err
+		}
+		secure = secure && ok
+		if closest != "" {
+			wildcard = closest
+		}
+	}
+
+	name := FinalName(ans.Answer, question.Name, question.Qtype)
+	negative := ans.Rcode == dns.RcodeNameError || !HasRecord(ans.Answer, name, question.Qtype)
+	if !negative && wildcard == "" {
+		return
+	}
+
+	// the zone of denial comes from the chain of trust of name, the signer in answer can't be trusted.
+	zone := name
+	if question.Qtype == dns.TypeDS {
+		zone = ParentName(name)
+	}
+	zk, err := v.Keys(ctx, zone)
+	if err != nil {
+		return false, err
+	}
+	if zk.Zone == "" {
+		return false, nil
+	}
+
+	var proof []dns.RR
+	for _, rrset := range SplitRRsets(ans.Ns) {
+		hdr := rrset[0].Header()
+		switch hdr.Rrtype {
+		case dns.TypeSOA, dns.TypeNSEC, dns.TypeNSEC3:
+		default:
+			continue
+		}
+		sigs := Signatures(ans.Ns, hdr.Name, hdr.Rrtype)
+		if len(sigs) == 0 {
+			continue
+		}
+		for _, sig := range sigs {
+			if !EqualName(sig.SignerName, zk.Zone) || !dns.IsSubDomain(zk.Zone, hdr.Name) {
+				return false, ErrBadSignature
+			}
+		}
+		err = VerifyRRset(zk, rrset, sigs)
+		if err != nil {
+			return false, err
+		}
+		if hdr.Rrtype != dns.TypeSOA {
+			proof = append(proof, rrset...)
+		}
+	}
+	if len(proof) == 0 {
+		return false, ErrNoDenial
+	}
+
+	switch {
+	case ans.Rcode == dns.RcodeNameError:
+		err = DenyName(name, proof)
+	case negative:
+		err = DenyType(name, question.Qtype, proof)
+	default:
+		err = DenyWildcard(name, wildcard, proof)
+	}
+	if err != nil {
+		return false, err
+	}
+	return
+}
+
+// VerifyAnswer checks a rrset in answer, and returns the closest encloser if it's expanded from a wildcard.
+func (v *Validator) VerifyAnswer(ctx context.Context, section []dns.RR, rrset []dns.RR) (secure bool, closest string, err error) {
+	hdr := rrset[0].Header()
+	sigs := Signatures(section, hdr.Name, hdr.Rrtype)
+	if len(sigs) == 0 {
+		if cname, ok := rrset[0].(*dns.CNAME); ok && Synthesized(section, cname) {
+			// the cname synthesized from dname is as secure as the dname.
+			secure = true
+			return
+		}
+		name := hdr.Name
+		if hdr.Rrtype == dns.TypeDS {
+			name = ParentName(name)
+		}
+		var zk *ZoneKeys
+		zk, err = v.Keys(ctx, name)
+		if err != nil || zk.Zone == "" {
+			return
+		}
+		err = ErrNoSignature
+		return
+	}
+
+	signer := sigs[0].SignerName
+	if !dns.IsSubDomain(signer, hdr.Name) {
+		err = ErrBadSignature
+		return
+	}
+	zk, err := v.Keys(ctx, signer)
+	if err != nil || zk.Zone == "" {
+		return
+	}
+	err = VerifyRRset(zk, rrset, sigs)
+	if err != nil {
+		return
+	}
+	secure = true
+
+	// RFC 4035 5.3.4: the labels field is less than the owner, the answer is expanded from a wildcard.
+	labels := dns.SplitDomainName(hdr.Name)
+	if int(sigs[0].Labels) < len(labels) && labels[0] != "*" {
+		closest = dns.Fqdn(strings.Join(labels[len(labels)-int(sigs[0].Labels):], "."))
+	}
+	return
+}
+
+func VerifyRRset(zk *ZoneKeys, rrset []dns.RR, sigs []*dns.RRSIG) (err error) {
+	if len(sigs) == 0 {
+		return ErrNoSignature
+	}
+	now := time.Now()
+	for _, sig := range sigs {
+		if !EqualName(sig.SignerName, zk.Zone) || !sig.ValidityPeriod(now) {
+			continue
+		}
+		for _, key := range zk.Keys {
+			if key.KeyTag() != sig.KeyTag || key.Algorithm != sig.Algorithm {
+				continue
+			}
+			if sig.Verify(key, rrset) == nil {
+				return nil
+			}
+		}
+	}
+	return ErrBadSignature
+}
+
+func SupportedDS(ds *dns.DS) bool {
+	switch ds.DigestType {
+	case dns.SHA1, dns.SHA256, dns.SHA384:
+	default:
+		return false
+	}
+	switch ds.Algorithm {
+	case dns.RSASHA1, dns.RSASHA1NSEC3SHA1, dns.RSASHA256, dns.RSASHA512,
+		dns.ECDSAP256SHA256, dns.ECDSAP384SHA384, dns.ED25519:
+		return true
+	}
+	return false
+}
+
+func MatchDS(key *dns.DNSKEY, anchors []*dns.DS) bool {
+	for _, ds := range anchors {
+		if key.KeyTag() != ds.KeyTag || key.Algorithm != ds.Algorithm {
+			continue
+		}
+		kds := key.ToDS(ds.DigestType)
+		if kds != nil && strings.EqualFold(kds.Digest, ds.Digest) {
+			return true
+		}
+	}
+	return false
+}
+
+func Signatures(section []dns.RR, name string, rrtype uint16) (sigs []*dns.RRSIG) {
+	for _, rr := range section {
+		sig, ok := rr.(*dns.RRSIG)
+		if ok && sig.TypeCovered == rrtype && EqualName(sig.Hdr.Name, name) {
+			sigs = append(sigs, sig)
+		}
+	}
+	return
+}
+
+// AppendSignatures appends signatures in section for rrs[start:] to rrs.
+func AppendSignatures(rrs []dns.RR, start int, section []dns.RR) []dns.RR {
+	added := rrs[start:]
+	for _, rr := range section {
+		sig, ok := rr.(*dns.RRSIG)
+		if !ok {
+			continue
+		}
+		for _, a := range added {
+			if a.Header().Rrtype == sig.TypeCovered && EqualName(a.Header().Name, sig.Hdr.Name) {
+				rrs = append(rrs, sig)
+				break
+			}
+		}
+	}
+	return rrs
+}
+
+// StripDNSSEC removes the records the client didn't ask for, RFC 4035 3.2.1.
+func StripDNSSEC(ans *dns.Msg, qtype uint16) {
+	strip := func(section []dns.RR) (rrs []dns.RR) {
+		for _, rr := range section {
+			switch rr.Header().Rrtype {
+			case dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3:
+				if rr.Header().Rrtype != qtype {
+					continue
+				}
+			}
+			rrs = append(rrs, rr)
+		}
+		return
+	}
+	ans.Answer = strip(ans.Answer)
+	ans.Ns = strip(ans.Ns)
+	ans.Extra = strip(ans.Extra)
+	return
+}
+
+func StripOPT(ans *dns.Msg) {
+	var extra []dns.RR
+	for _, rr := range ans.Extra {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			extra = append(extra, rr)
+		}
+	}
+	ans.Extra = extra
+	return
+}
+
+func SplitRRsets(section []dns.RR) (rrsets [][]dns.RR) {
+	index := make(map[string]int)
+	for _, rr := range section {
+		hdr := rr.Header()
+		if hdr.Rrtype == dns.TypeRRSIG || hdr.Rrtype == dns.TypeOPT {
+			continue
+		}
+		key := dns.CanonicalName(hdr.Name) + "/" + dns.TypeToString[hdr.Rrtype]
+		i, ok := index[key]
+		if !ok {
+			i = len(rrsets)
+			index[key] = i
+			rrsets = append(rrsets, nil)
+		}
+		rrsets[i] = append(rrsets[i], rr)
+	}
+	return
+}
+
+func KeysTTL(rrs []dns.RR) (ttl uint32) {
+	ttl = MAX_DNSSEC_TTL
+	for _, rr := range rrs {
+		if rr.Header().Rrtype != dns.TypeOPT && rr.Header().Ttl < ttl {
+			ttl = rr.Header().Ttl
+		}
+	}
+	return
+}
+
+func ParentName(name string) string {
+	labels := dns.SplitDomainName(name)
+	if len(labels) == 0 {
+		return "."
+	}
+	return dns.Fqdn(strings.Join(labels[1:], "."))
+}
+
+func Synthesized(section []dns.RR, cname *dns.CNAME) bool {
+	for _, rr := range section {
+		v, ok := rr.(*dns.DNAME)
+		if !ok || EqualName(v.Hdr.Name, cname.Hdr.Name) || !dns.IsSubDomain(v.Hdr.Name, cname.Hdr.Name) {
+			continue
+		}
+		if EqualName(DNAMETarget(cname.Hdr.Name, v), cname.Target) {
+			return true
+		}
+	}
+	return false
+}
+
+func FinalName(section []dns.RR, name string, qtype uint16) string {
+	if qtype == dns.TypeCNAME {
+		return name
+	}
+	for i := 0; i < len(section); i++ {
+		changed := false
+		for _, rr := range section {
+			if v, ok := rr.(*dns.CNAME); ok && EqualName(v.Hdr.Name, name) {
+				name = v.Target
+				changed = true
+				break
+			}
+		}
+		if !changed {
+			break
+		}
+	}
+	return name
+}
+
+func HasRecord(section []dns.RR, name string, qtype uint16) bool {
+	for _, rr := range section {
+		if EqualName(rr.Header().Name, name) && (qtype == dns.TypeANY || rr.Header().Rrtype == qtype) {
+			return true
+		}
+	}
+	return false
+}
+
+func HasType(bitmap []uint16, qtype uint16) bool {
+	for _, t := range bitmap {
+		if t == qtype {
+			return true
+		}
+	}
+	return false
+}
+
+// CompareName compares domain names in the canonical order of RFC 4034 6.1.
+func CompareName(a, b string) int {
+	la, lb := WireLabels(a), WireLabels(b)
+	for i := 1; i <= len(la) && i <= len(lb); i++ {
+		if c := bytes.Compare(la[len(la)-i], lb[len(lb)-i]); c != 0 {
+			return c
+		}
+	}
+	return len(la) - len(lb)
+}
+
+// WireLabels returns the lowercased labels in wire format.
+func WireLabels(name string) (labels [][]byte) {
+	buf := make([]byte, 256)
+	n, err := dns.PackDomainName(dns.Fqdn(name), buf, 0, nil, false)
+	if err != nil {
+		return
+	}
+	for i := 0; i < n && buf[i] != 0; i += int(buf[i]) + 1 {
+		label := buf[i+1 : i+1+int(buf[i])]
+		for j, c := range label {
+			if c >= 'A' && c <= 'Z' {
+				label[j] = c + 'a' - 'A'
+			}
+		}
+		labels = append(labels, label)
+	}
+	return
+}
+
+// NSECCovers tells if name is between the owner and the next name of nsec.
+func NSECCovers(nsec *dns.NSEC, name string) bool {
+	if CompareName(nsec.Hdr.Name, name) >= 0 {
+		return false
+	}
+	// the last nsec in the zone points back to the apex.
+	if CompareName(nsec.NextDomain, nsec.Hdr.Name) <= 0 {
+		return dns.IsSubDomain(nsec.NextDomain, name)
+	}
+	return CompareName(name, nsec.NextDomain) < 0
+}
+
+func CommonAncestor(a, b string) string {
+	n := dns.CompareDomainName(a, b)
+	labels := dns.SplitDomainName(a)
+	return dns.Fqdn(strings.Join(labels[len(labels)-n:], "."))
+}
+
+// NSECClosestEncloser returns the closest encloser of name proven by a covering nsec.
+func NSECClosestEncloser(name string, section []dns.RR) (closest string, ok bool) {
+	for _, rr := range section {
+		nsec, is := rr.(*dns.NSEC)
+		if !is || !NSECCovers(nsec, name) {
+			continue
+		}
+		closest = CommonAncestor(name, nsec.Hdr.Name)
+		if next := CommonAncestor(name, nsec.NextDomain); dns.CountLabel(next) > dns.CountLabel(closest) {
+			closest = next
+		}
+		return closest, true
+	}
+	return
+}
+
+// NSEC3ClosestEncloser returns the closest encloser and the nsec3 covering the next closer name, RFC 5155 8.3.
+func NSEC3ClosestEncloser(name string, section []dns.RR) (closest string, cover *dns.NSEC3) {
+	labels := dns.SplitDomainName(name)
+	for i := 1; i < len(labels)+1; i++ {
+		candidate := dns.Fqdn(strings.Join(labels[i:], "."))
+		if NSEC3Match(candidate, section) == nil {
+			continue
+		}
+		next := dns.Fqdn(strings.Join(labels[i-1:], "."))
+		for _, rr := range section {
+			if v, ok := rr.(*dns.NSEC3); ok && v.Cover(next) {
+				return candidate, v
+			}
+		}
+		return
+	}
+	return
+}
+
+func NSEC3Match(name string, section []dns.RR) *dns.NSEC3 {
+	for _, rr := range section {
+		if v, ok := rr.(*dns.NSEC3); ok && v.Match(name) {
+			return v
+		}
+	}
+	return nil
+}
+
+func NSEC3Covered(name string, section []dns.RR) bool {
+	for _, rr := range section {
+		if v, ok := rr.(*dns.NSEC3); ok && v.Cover(name) {
+			return true
+		}
+	}
+	return false
+}
+
+func NSECCovered(name string, section []dns.RR) bool {
+	for _, rr := range section {
+		if v, ok := rr.(*dns.NSEC); ok && NSECCovers(v, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func WildcardName(closest string) string {
+	return rrtree.JoinName("*", closest)
+}
+
+// DenyName checks the proof of NXDOMAIN.
+func DenyName(name string, section []dns.RR) (err error) {
+	if closest, ok := NSECClosestEncloser(name, section); ok {
+		if NSECCovered(WildcardName(closest), section) {
+			return nil
+		}
+		return ErrNoDenial
+	}
+	if closest, cover := NSEC3ClosestEncloser(name, section); cover != nil {
+		if NSEC3Covered(WildcardName(closest), section) {
+			return nil
+		}
+	}
+	return ErrNoDenial
+}
+
+// DenyType checks the proof of NODATA.
+func DenyType(name string, qtype uint16, section []dns.RR) (err error) {
+	for _, rr := range section {
+		nsec, ok := rr.(*dns.NSEC)
+		if !ok || !EqualName(nsec.Hdr.Name, name) {
+			continue
+		}
+		if HasType(nsec.TypeBitMap, qtype) || HasType(nsec.TypeBitMap, dns.TypeCNAME) {
+			return ErrNoDenial
+		}
+		return nil
+	}
+
+	if nsec3 := NSEC3Match(name, section); nsec3 != nil {
+		if HasType(nsec3.TypeBitMap, qtype) || HasType(nsec3.TypeBitMap, dns.TypeCNAME) {
+			return ErrNoDenial
+		}
+		return nil
+	}
+
+	// wildcard nodata, RFC 4035 3.1.3.4 and RFC 5155 7.2.5.
+	if closest, ok := NSECClosestEncloser(name, section); ok {
+		wildcard := WildcardName(closest)
+		for _, rr := range section {
+			nsec, ok := rr.(*dns.NSEC)
+			if ok && EqualName(nsec.Hdr.Name, wildcard) && !HasType(nsec.TypeBitMap, qtype) {
+				return nil
+			}
+		}
+		return ErrNoDenial
+	}
+
+	closest, cover := NSEC3ClosestEncloser(name, section)
+	if cover == nil {
+		return ErrNoDenial
+	}
+	if qtype == dns.TypeDS && cover.Flags&1 == 1 {
+		// RFC 5155 8.6: opt-out covers the insecure delegations.
+		return nil
+	}
+	if nsec3 := NSEC3Match(WildcardName(closest), section); nsec3 != nil && !HasType(nsec3.TypeBitMap, qtype) {
+		return nil
+	}
+	return ErrNoDenial
+}
+
+// DenyWildcard checks that name doesn't exist, so the wildcard under closest can be used.
+func DenyWildcard(name, closest string, section []dns.RR) (err error) {
+	if NSECCovered(name, section) {
+		return nil
+	}
+	labels := dns.SplitDomainName(name)
+	next := dns.Fqdn(strings.Join(labels[len(labels)-dns.CountLabel(closest)-1:], "."))
+	if NSEC3Covered(next, section) {
+		return nil
+	}
+	return ErrNoDenial
+}
+
+// DenyDS checks there is no DS for name, and returns true if it's an insecure delegation.
+func DenyDS(name string, section []dns.RR) (insecure bool, err error) {
+	for _, rr := range section {
+		nsec, ok := rr.(*dns.NSEC)
+		if !ok || !EqualName(nsec.Hdr.Name, name) {
+			continue
+		}
+		if HasType(nsec.TypeBitMap, dns.TypeDS) {
+			return false, ErrNoDenial
+		}
+		insecure = HasType(nsec.TypeBitMap, dns.TypeNS) && !HasType(nsec.TypeBitMap, dns.TypeSOA)
+		return
+	}
+	if NSECCovered(name, section) {
+		return
+	}
+
+	if nsec3 := NSEC3Match(name, section); nsec3 != nil {
+		if HasType(nsec3.TypeBitMap, dns.TypeDS) {
+			return false, ErrNoDenial
+		}
+		insecure = HasType(nsec3.TypeBitMap, dns.TypeNS) && !HasType(nsec3.TypeBitMap, dns.TypeSOA)
+		return
+	}
+	if _, cover := NSEC3ClosestEncloser(name, section); cover != nil {
+		insecure = cover.Flags&1 == 1
+		return
+	}
+	return false, ErrNoDenial
+}
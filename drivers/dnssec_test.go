@@ -0,0 +1,331 @@
+package drivers
+
+import (
+	"context"
+	"crypto"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/shell909090/doh/rrtree"
+)
+
+func ZoneApex(records []dns.RR) string {
+	for _, rr := range records {
+		if rr.Header().Rrtype == dns.TypeSOA {
+			return rr.Header().Name
+		}
+	}
+	return ""
+}
+
+// SignTestZones signs the zones from bottom to top, and returns the DS of the root as trust anchor.
+func SignTestZones(t *testing.T, zones map[string][]dns.RR, nsec3 []string, unsigned []string) (anchor *dns.DS) {
+	var addrs []string
+	for addr := range zones {
+		if !HasName(unsigned, ZoneApex(zones[addr])) {
+			addrs = append(addrs, addr)
+		}
+	}
+	sort.Slice(addrs, func(i, j int) bool {
+		return dns.CountLabel(ZoneApex(zones[addrs[i]])) > dns.CountLabel(ZoneApex(zones[addrs[j]]))
+	})
+
+	keys := make(map[string]*dns.DNSKEY)
+	for _, addr := range addrs {
+		apex := ZoneApex(zones[addr])
+		key := &dns.DNSKEY{
+			Hdr:       dns.RR_Header{Name: apex, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+			Flags:     dns.ZONE | dns.SEP,
+			Protocol:  3,
+			Algorithm: dns.ECDSAP256SHA256,
+		}
+		priv, err := key.Generate(256)
+		if err != nil {
+			t.Fatalf("generate key failed: %s", err)
+		}
+		keys[apex] = key
+		zones[addr] = SignTestZone(t, apex, zones[addr], key, priv.(crypto.Signer), keys, HasName(nsec3, apex))
+	}
+
+	anchor = keys["."].ToDS(dns.SHA256)
+	return
+}
+
+func HasName(names []string, name string) bool {
+	for _, n := range names {
+		if EqualName(n, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func SignTestZone(t *testing.T, apex string, records []dns.RR, key *dns.DNSKEY, priv crypto.Signer, keys map[string]*dns.DNSKEY, nsec3 bool) (signed []dns.RR) {
+	var cuts []string
+	for _, rr := range records {
+		name := rr.Header().Name
+		if rr.Header().Rrtype == dns.TypeNS && !EqualName(name, apex) && !HasName(cuts, name) {
+			cuts = append(cuts, name)
+			if child, ok := keys[dns.CanonicalName(name)]; ok {
+				ds := child.ToDS(dns.SHA256)
+				ds.Hdr.Ttl = 3600
+				records = append(records, ds)
+			}
+		}
+	}
+	records = append(records, key)
+
+	// only the authoritative data is in the chain, no glue, no delegation but ns and ds.
+	types := make(map[string][]uint16)
+	var names []string
+	for _, rr := range records {
+		hdr := rr.Header()
+		signed = append(signed, rr)
+		if !dns.IsSubDomain(apex, hdr.Name) {
+			continue
+		}
+		below, atCut := false, false
+		for _, cut := range cuts {
+			if EqualName(cut, hdr.Name) {
+				atCut = true
+			} else if dns.IsSubDomain(cut, hdr.Name) {
+				below = true
+			}
+		}
+		if below || atCut && hdr.Rrtype != dns.TypeNS && hdr.Rrtype != dns.TypeDS {
+			continue
+		}
+		name := dns.CanonicalName(hdr.Name)
+		if _, ok := types[name]; !ok {
+			names = append(names, name)
+		}
+		if !HasType(types[name], hdr.Rrtype) {
+			types[name] = append(types[name], hdr.Rrtype)
+		}
+	}
+
+	var denial []dns.RR
+	if nsec3 {
+		hashes := make(map[string]string)
+		var hashed []string
+		for _, name := range names {
+			h := dns.HashName(name, dns.SHA1, 0, "")
+			hashes[h] = name
+			hashed = append(hashed, h)
+		}
+		sort.Strings(hashed)
+		for i, h := range hashed {
+			bitmap := append(types[hashes[h]], dns.TypeRRSIG)
+			sort.Slice(bitmap, func(i, j int) bool { return bitmap[i] < bitmap[j] })
+			denial = append(denial, &dns.NSEC3{
+				Hdr:        dns.RR_Header{Name: rrtree.JoinName(h, apex), Rrtype: dns.TypeNSEC3, Class: dns.ClassINET, Ttl: 300},
+				Hash:       dns.SHA1,
+				Flags:      0,
+				Iterations: 0,
+				SaltLength: 0,
+				Salt:       "",
+				HashLength: 20,
+				NextDomain: hashed[(i+1)%len(hashed)],
+				TypeBitMap: bitmap,
+			})
+		}
+	} else {
+		sort.Slice(names, func(i, j int) bool { return CompareName(names[i], names[j]) < 0 })
+		for i, name := range names {
+			bitmap := append(types[name], dns.TypeRRSIG, dns.TypeNSEC)
+			sort.Slice(bitmap, func(i, j int) bool { return bitmap[i] < bitmap[j] })
+			denial = append(denial, &dns.NSEC{
+				Hdr:        dns.RR_Header{Name: name, Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: 300},
+				NextDomain: names[(i+1)%len(names)],
+				TypeBitMap: bitmap,
+			})
+		}
+	}
+	signed = append(signed, denial...)
+
+	now := time.Now()
+	for _, rrset := range SplitRRsets(signed) {
+		hdr := rrset[0].Header()
+		if !dns.IsSubDomain(apex, hdr.Name) {
+			continue
+		}
+		if hdr.Rrtype != dns.TypeDS && hdr.Rrtype != dns.TypeNSEC && hdr.Rrtype != dns.TypeNSEC3 {
+			skip := false
+			for _, cut := range cuts {
+				skip = skip || dns.IsSubDomain(cut, hdr.Name)
+			}
+			if skip {
+				continue
+			}
+		}
+		sig := &dns.RRSIG{
+			Hdr:        dns.RR_Header{Ttl: hdr.Ttl},
+			Algorithm:  key.Algorithm,
+			Expiration: uint32(now.Add(24 * time.Hour).Unix()),
+			Inception:  uint32(now.Add(-time.Hour).Unix()),
+			KeyTag:     key.KeyTag(),
+			SignerName: apex,
+		}
+		if err := sig.Sign(priv, rrset); err != nil {
+			t.Fatalf("sign failed: %s", err)
+		}
+		signed = append(signed, sig)
+	}
+	return
+}
+
+func StartSignedTestAuth(t *testing.T) (auth *TestAuth, anchors string) {
+	zones := ParseTestZones(t, TestZones)
+	anchor := SignTestZones(t, zones, []string{"com."}, []string{"ample.com."})
+
+	// break the signature after signing.
+	for _, rr := range zones["127.0.0.3"] {
+		if v, ok := rr.(*dns.A); ok && v.Hdr.Name == "bogus.example.com." {
+			v.A = net.ParseIP("192.0.2.67")
+		}
+	}
+
+	auth = ServeTestZones(t, zones)
+	anchors = filepath.Join(t.TempDir(), "root.key")
+	err := os.WriteFile(anchors, []byte(anchor.String()+"\n"), 0600)
+	if err != nil {
+		t.Fatalf("write trust anchor failed: %s", err)
+	}
+	return
+}
+
+func TestRecursiveDNSSEC(t *testing.T) {
+	auth, anchors := StartSignedTestAuth(t)
+	cli := NewTestRecursiveClient(t, auth, `, "dnssec": true, "trust-anchor": "`+anchors+`"`)
+
+	for _, c := range []struct {
+		name   string
+		qtype  uint16
+		rcode  int
+		secure bool
+	}{
+		{"www.example.com.", dns.TypeA, dns.RcodeSuccess, true},
+		{"www.example.com.", dns.TypeAAAA, dns.RcodeSuccess, true},
+		{"nx.example.com.", dns.TypeA, dns.RcodeNameError, true},
+		{"alias.example.com.", dns.TypeA, dns.RcodeSuccess, true},
+		{"nx.com.", dns.TypeA, dns.RcodeNameError, true},
+		{"ns.com.", dns.TypeAAAA, dns.RcodeSuccess, true},
+		{"example.com.", dns.TypeDS, dns.RcodeSuccess, true},
+		{"www.ample.com.", dns.TypeA, dns.RcodeSuccess, false},
+		{"www.old.example.com.", dns.TypeA, dns.RcodeSuccess, false},
+		{"bogus.example.com.", dns.TypeA, dns.RcodeServerFailure, false},
+	} {
+		quiz := &dns.Msg{}
+		quiz.SetQuestion(c.name, c.qtype)
+		quiz.SetEdns0(4096, true)
+		ans, err := cli.Exchange(context.Background(), quiz)
+		if err != nil {
+			t.Fatalf("exchange failed: %s", err)
+		}
+		if ans.Rcode != c.rcode || ans.AuthenticatedData != c.secure {
+			t.Fatalf("wrong answer for %s %s: %s", c.name, dns.TypeToString[c.qtype], ans)
+		}
+	}
+
+	quiz := &dns.Msg{}
+	quiz.SetQuestion("bogus.example.com.", dns.TypeA)
+	quiz.SetEdns0(4096, true)
+	ans, _ := cli.Exchange(context.Background(), quiz)
+	ede, ok := ans.IsEdns0().Option[0].(*dns.EDNS0_EDE)
+	if !ok || ede.InfoCode != dns.ExtendedErrorCodeDNSBogus {
+		t.Fatalf("bogus answer should have ede: %s", ans)
+	}
+
+	quiz.CheckingDisabled = true
+	ans, _ = cli.Exchange(context.Background(), quiz)
+	if ans.Rcode != dns.RcodeSuccess || ans.AuthenticatedData {
+		t.Fatalf("checking disabled answer should not be validated: %s", ans)
+	}
+}
+
+func TestRecursiveDNSSECNoEdns(t *testing.T) {
+	auth, anchors := StartSignedTestAuth(t)
+	cli := NewTestRecursiveClient(t, auth, `, "dnssec": true, "trust-anchor": "`+anchors+`"`)
+
+	// the signatures are queried for validation even if the client didn't ask.
+	quiz := &dns.Msg{}
+	quiz.SetQuestion("www.example.com.", dns.TypeA)
+	ans, err := cli.Exchange(context.Background(), quiz)
+	if err != nil {
+		t.Fatalf("exchange failed: %s", err)
+	}
+	if ans.Rcode != dns.RcodeSuccess || !ans.AuthenticatedData {
+		t.Fatalf("answer should be validated: %s", ans)
+	}
+}
+
+func TestRecursiveDNSSECAnchor(t *testing.T) {
+	auth, _ := StartSignedTestAuth(t)
+	anchors := filepath.Join(t.TempDir(), "root.key")
+	os.WriteFile(anchors, []byte(ROOT_ANCHORS[0]+"\n"), 0600)
+	cli := NewTestRecursiveClient(t, auth, `, "dnssec": true, "trust-anchor": "`+anchors+`"`)
+
+	quiz := &dns.Msg{}
+	quiz.SetQuestion("www.example.com.", dns.TypeA)
+	quiz.SetEdns0(4096, true)
+	ans, err := cli.Exchange(context.Background(), quiz)
+	if err != nil {
+		t.Fatalf("exchange failed: %s", err)
+	}
+	if ans.Rcode != dns.RcodeServerFailure {
+		t.Fatalf("wrong trust anchor should fail: %s", ans)
+	}
+}
+
+// ForgeDenial answers quiz with the soa of example.com, signed by the insecure zone ample.com.
+func ForgeDenial(quiz *dns.Msg, rcode int) (ans *dns.Msg) {
+	ans = &dns.Msg{}
+	ans.SetRcode(quiz, rcode)
+	ans.SetEdns0(4096, true)
+	soa, _ := dns.NewRR("example.com. 3600 IN SOA ns1.example.com. admin.example.com. 1 1800 900 604800 300")
+	now := time.Now()
+	sig := &dns.RRSIG{
+		Hdr:         dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: 3600},
+		TypeCovered: dns.TypeSOA,
+		Algorithm:   dns.ECDSAP256SHA256,
+		Labels:      2,
+		OrigTtl:     3600,
+		Expiration:  uint32(now.Add(24 * time.Hour).Unix()),
+		Inception:   uint32(now.Add(-time.Hour).Unix()),
+		KeyTag:      1,
+		SignerName:  "ample.com.",
+		Signature:   "AAAA",
+	}
+	ans.Ns = []dns.RR{soa, sig}
+	return
+}
+
+func TestValidatorForgedDenial(t *testing.T) {
+	auth, anchors := StartSignedTestAuth(t)
+	cli := NewTestRecursiveClient(t, auth, `, "dnssec": true, "trust-anchor": "`+anchors+`"`)
+
+	for _, rcode := range []int{dns.RcodeNameError, dns.RcodeSuccess} {
+		quiz := &dns.Msg{}
+		quiz.SetQuestion("www.example.com.", dns.TypeA)
+		secure, err := cli.validator.Validate(context.Background(), ForgeDenial(quiz, rcode))
+		if secure || !IsBogus(err) {
+			t.Fatalf("forged %s should be bogus: %v", dns.RcodeToString[rcode], err)
+		}
+	}
+}
+
+func TestCompareName(t *testing.T) {
+	// the example in RFC 4034 6.1.
+	names := []string{"example.", "a.example.", "yljkjljk.a.example.", "Z.a.example.",
+		"zABC.a.EXAMPLE.", "z.example.", "\\001.z.example.", "*.z.example.", "\\200.z.example."}
+	for i := 1; i < len(names); i++ {
+		if CompareName(names[i-1], names[i]) >= 0 {
+			t.Fatalf("wrong order: %s, %s", names[i-1], names[i])
+		}
+	}
+}
@@ -1,15 +1,24 @@
 package drivers
 
 import (
+	"crypto/tls"
 	"encoding/json"
+	"net"
 	"net/http"
 	"net/url"
+
+	"github.com/quic-go/quic-go/http3"
 )
 
 type DoHServer struct {
 	CertFile         string
 	KeyFile          string
 	EdnsClientSubnet string
+	HTTP3            bool     `json:"http3"`
+	ODoHTarget       bool     `json:"odoh-target"`
+	ODoHSeed         string   `json:"odoh-seed"`
+	ODoHProxy        bool     `json:"odoh-proxy"`
+	ODoHTargets      []string `json:"odoh-targets"`
 	scheme           string
 	addr             string
 	cli              Client
@@ -36,7 +45,16 @@ func NewDoHServer(cli Client, URL string, body json.RawMessage) (srv *DoHServer)
 		}
 	}
 
-	srv.mux.Handle("/dns-query", NewRfc8484Handler(cli, srv.EdnsClientSubnet))
+	var handler http.Handler = NewRfc8484Handler(cli, srv.EdnsClientSubnet)
+	if srv.ODoHTarget {
+		target := NewODoHTarget(cli, srv.ODoHSeed)
+		handler = &ODoHHandler{target: target, next: handler}
+		srv.mux.HandleFunc(ODOH_CONFIGS_PATH, target.ServeConfigs)
+	}
+	if srv.ODoHProxy {
+		srv.mux.Handle("/proxy", NewODoHProxy(srv.ODoHTargets))
+	}
+	srv.mux.Handle("/dns-query", handler)
 	srv.mux.Handle("/resolve", NewGoogleHandler(cli, srv.EdnsClientSubnet))
 	srv.mux.Handle("/d", NewDnsPodHandler(cli, srv.EdnsClientSubnet))
 	return
@@ -52,7 +70,53 @@ func (srv *DoHServer) Serve() (err error) {
 	case "http":
 		err = server.ListenAndServe()
 	case "https", "":
+		if srv.HTTP3 {
+			err = srv.ListenAndServeHTTP3()
+			return
+		}
 		err = server.ListenAndServeTLS(srv.CertFile, srv.KeyFile)
 	}
 	return
 }
+
+// ListenAndServeHTTP3 listens in both tcp and udp on the same address.
+func (srv *DoHServer) ListenAndServeHTTP3() (err error) {
+	cert, err := tls.LoadX509KeyPair(srv.CertFile, srv.KeyFile)
+	if err != nil {
+		return
+	}
+	ln, err := net.Listen("tcp", srv.addr)
+	if err != nil {
+		return
+	}
+	defer ln.Close()
+	pc, err := net.ListenPacket("udp", srv.addr)
+	if err != nil {
+		return
+	}
+	defer pc.Close()
+	return srv.ServeHTTP3(ln, pc, cert)
+}
+
+// ServeHTTP3 serves http3 in pc, and h1/h2 in ln with Alt-Svc header to advertise the http3.
+func (srv *DoHServer) ServeHTTP3(ln net.Listener, pc net.PacketConn, cert tls.Certificate) (err error) {
+	h3server := &http3.Server{
+		Handler:   srv.mux,
+		TLSConfig: http3.ConfigureTLSConfig(&tls.Config{Certificates: []tls.Certificate{cert}}),
+	}
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			h3server.SetQUICHeaders(w.Header())
+			srv.mux.ServeHTTP(w, req)
+		}),
+		TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}},
+	}
+	defer h3server.Close()
+	defer server.Close()
+
+	errc := make(chan error, 2)
+	go func() { errc <- h3server.Serve(pc) }()
+	go func() { errc <- server.ServeTLS(ln, "", "") }()
+	err = <-errc
+	return
+}
@@ -0,0 +1,127 @@
+package drivers
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+type ProtoRecorder struct {
+	mu     sync.Mutex
+	protos []string
+}
+
+func (r *ProtoRecorder) Last() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.protos) == 0 {
+		return ""
+	}
+	return r.protos[len(r.protos)-1]
+}
+
+// StartTestHTTP3 serves doh in tcp and udp with different ports, returns the tcp one.
+func StartTestHTTP3(t *testing.T, upstream Client) (tcpaddr, udpaddr string, recorder *ProtoRecorder) {
+	certfile, keyfile := NewTestCert(t)
+	srv := NewDoHServer(upstream, "https://127.0.0.1:0",
+		[]byte(`{"CertFile": "`+certfile+`", "KeyFile": "`+keyfile+`", "http3": true}`))
+
+	recorder = &ProtoRecorder{}
+	mux := srv.mux
+	srv.mux = http.NewServeMux()
+	srv.mux.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
+		recorder.mu.Lock()
+		recorder.protos = append(recorder.protos, req.Proto)
+		recorder.mu.Unlock()
+		mux.ServeHTTP(w, req)
+	})
+
+	cert, err := tls.LoadX509KeyPair(certfile, keyfile)
+	if err != nil {
+		t.Fatalf("load cert failed: %s", err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %s", err)
+	}
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %s", err)
+	}
+	t.Cleanup(func() {
+		ln.Close()
+		pc.Close()
+	})
+	go srv.ServeHTTP3(ln, pc, cert)
+	return ln.Addr().String(), pc.LocalAddr().String(), recorder
+}
+
+func TestHTTP3Always(t *testing.T) {
+	upstream := &StaticClient{Records: []string{"www.example.com. 300 IN A 192.0.2.1"}}
+	_, udpaddr, recorder := StartTestHTTP3(t, upstream)
+
+	cli := NewRfc8484Client("https://"+udpaddr+"/dns-query", []byte(`{"insecure": true, "http3": "always"}`))
+	defer cli.h3transport.Close()
+
+	quiz := &dns.Msg{}
+	quiz.SetQuestion("www.example.com.", dns.TypeA)
+	ans, err := cli.Exchange(context.Background(), quiz)
+	if err != nil {
+		t.Fatalf("exchange failed: %s", err)
+	}
+	if len(ans.Answer) != 1 || recorder.Last() != "HTTP/3.0" {
+		t.Fatalf("wrong answer in %s: %s", recorder.Last(), ans)
+	}
+}
+
+func TestHTTP3Upgrade(t *testing.T) {
+	upstream := &StaticClient{Records: []string{"www.example.com. 300 IN A 192.0.2.1"}}
+	tcpaddr, udpaddr, recorder := StartTestHTTP3(t, upstream)
+
+	cli := NewRfc8484Client("https://"+tcpaddr+"/dns-query", []byte(`{"insecure": true, "http3": "upgrade"}`))
+	defer cli.h3transport.Close()
+
+	quiz := &dns.Msg{}
+	quiz.SetQuestion("www.example.com.", dns.TypeA)
+	_, err := cli.Exchange(context.Background(), quiz)
+	if err != nil {
+		t.Fatalf("exchange failed: %s", err)
+	}
+	if strings.HasPrefix(recorder.Last(), "HTTP/3") {
+		t.Fatalf("first query should not be http3: %s", recorder.Last())
+	}
+	if alt := cli.altsvc.Load(); alt == nil || *alt != udpaddr {
+		t.Fatalf("should upgrade to %s", udpaddr)
+	}
+
+	ans, err := cli.Exchange(context.Background(), quiz)
+	if err != nil {
+		t.Fatalf("exchange failed: %s", err)
+	}
+	if len(ans.Answer) != 1 || recorder.Last() != "HTTP/3.0" {
+		t.Fatalf("wrong answer in %s: %s", recorder.Last(), ans)
+	}
+}
+
+func TestParseAltSvcH3(t *testing.T) {
+	for _, c := range []struct {
+		values []string
+		addr   string
+	}{
+		{[]string{`h3=":443"; ma=2592000`}, "dns.example.com:443"},
+		{[]string{`h2=":443", h3="alt.example.com:8443"`}, "alt.example.com:8443"},
+		{[]string{`h3-29=":443"`, `h3=":8443"`}, "dns.example.com:8443"},
+		{[]string{`clear`}, ""},
+	} {
+		addr, _ := ParseAltSvcH3(c.values, "dns.example.com")
+		if addr != c.addr {
+			t.Fatalf("wrong alt-svc for %v: %s", c.values, addr)
+		}
+	}
+}
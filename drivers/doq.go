@@ -0,0 +1,329 @@
+package drivers
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+)
+
+const (
+	DOQ_NO_ERROR       = 0x0
+	DOQ_INTERNAL_ERROR = 0x1
+	DOQ_IDLE_TIMEOUT   = 30 * time.Second
+)
+
+var (
+	DoQALPN = []string{"doq"}
+)
+
+func ReadDoQMsg(r io.Reader) (msg *dns.Msg, err error) {
+	var length uint16
+	err = binary.Read(r, binary.BigEndian, &length)
+	if err != nil {
+		return
+	}
+	buf := make([]byte, length)
+	_, err = io.ReadFull(r, buf)
+	if err != nil {
+		return
+	}
+	msg = &dns.Msg{}
+	err = msg.Unpack(buf)
+	return
+}
+
+// WriteDoQMsg writes the message with a 2 bytes length prefix, RFC 9250 4.2.
+func WriteDoQMsg(w io.Writer, msg *dns.Msg) (err error) {
+	b, err := msg.Pack()
+	if err != nil {
+		return
+	}
+	buf := make([]byte, 2+len(b))
+	binary.BigEndian.PutUint16(buf, uint16(len(b)))
+	copy(buf[2:], b)
+	return WriteFull(w, buf)
+}
+
+type DoQClient struct {
+	URL     string
+	Timeout int
+	TLSOptions
+	ZeroRTT   bool     `json:"zero-rtt"`
+	Bootstrap []string `json:"bootstrap"`
+	addr      string
+	bootstrap *Bootstrap
+	tlsconf   *tls.Config
+	conf      *quic.Config
+	mu        sync.Mutex
+	conn      *quic.Conn
+}
+
+func NewDoQClient(URL string, body json.RawMessage) (cli *DoQClient) {
+	cli = &DoQClient{}
+	if body != nil {
+		err := json.Unmarshal(body, &cli)
+		if err != nil {
+			panic(err.Error())
+		}
+	}
+	cli.URL = URL
+
+	if Insecure {
+		cli.Insecure = Insecure
+	}
+	if Timeout != 0 {
+		cli.Timeout = Timeout
+	}
+
+	u, err := url.Parse(URL)
+	if err != nil {
+		panic(err.Error())
+	}
+	GuessPort(u)
+	cli.addr = u.Host
+	cli.bootstrap = NewBootstrap(cli.Bootstrap)
+
+	cli.tlsconf, err = cli.NewTLSConfig(u.Hostname())
+	if err != nil {
+		panic(err.Error())
+	}
+	cli.tlsconf.NextProtos = DoQALPN
+	if cli.ZeroRTT {
+		cli.tlsconf.ClientSessionCache = tls.NewLRUClientSessionCache(0)
+	}
+	cli.conf = &quic.Config{
+		MaxIdleTimeout: DOQ_IDLE_TIMEOUT,
+	}
+	return
+}
+
+func (cli *DoQClient) Url() (u string) {
+	return cli.URL
+}
+
+// Connect returns the connection for reuse, or dials a new one if it's closed.
+func (cli *DoQClient) Connect(ctx context.Context) (conn *quic.Conn, err error) {
+	cli.mu.Lock()
+	defer cli.mu.Unlock()
+
+	if cli.conn != nil && cli.conn.Context().Err() == nil {
+		return cli.conn, nil
+	}
+
+	addrs, err := cli.bootstrap.Addrs(ctx, cli.addr)
+	if err != nil {
+		return
+	}
+	for _, addr := range addrs {
+		logger.Debugf("doq connect to %s", addr)
+		if cli.ZeroRTT {
+			conn, err = quic.DialAddrEarly(ctx, addr, cli.tlsconf, cli.conf)
+		} else {
+			conn, err = quic.DialAddr(ctx, addr, cli.tlsconf, cli.conf)
+		}
+		if err == nil {
+			cli.conn = conn
+			return
+		}
+		logger.Info(err.Error())
+	}
+	return
+}
+
+func (cli *DoQClient) reset(conn *quic.Conn) {
+	cli.mu.Lock()
+	defer cli.mu.Unlock()
+	if cli.conn == conn {
+		cli.conn = nil
+	}
+	conn.CloseWithError(DOQ_NO_ERROR, "")
+	return
+}
+
+func (cli *DoQClient) Exchange(ctx context.Context, quiz *dns.Msg) (ans *dns.Msg, err error) {
+	if cli.Timeout != 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(cli.Timeout)*time.Millisecond)
+		defer cancel()
+	}
+
+	// the connection may be closed by the server for idle, try again with a new one.
+	for i := 0; i < 2; i++ {
+		var conn *quic.Conn
+		conn, err = cli.Connect(ctx)
+		if err != nil {
+			logger.Error(err.Error())
+			return
+		}
+
+		ans, err = cli.exchange(ctx, conn, quiz)
+		if err == nil {
+			return
+		}
+		logger.Info(err.Error())
+		cli.reset(conn)
+		if ctx.Err() != nil {
+			return
+		}
+	}
+	return
+}
+
+func (cli *DoQClient) exchange(ctx context.Context, conn *quic.Conn, quiz *dns.Msg) (ans *dns.Msg, err error) {
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		return
+	}
+	defer stream.CancelRead(DOQ_NO_ERROR)
+	if deadline, ok := ctx.Deadline(); ok {
+		stream.SetDeadline(deadline)
+	}
+
+	// RFC 9250 4.2.1: the message id must be 0.
+	req := quiz.Copy()
+	req.Id = 0
+	err = WriteDoQMsg(stream, req)
+	if err != nil {
+		return
+	}
+	// the client must close the stream after sending the query.
+	stream.Close()
+
+	ans, err = ReadDoQMsg(stream)
+	if err != nil {
+		return
+	}
+	ans.Id = quiz.Id
+	return
+}
+
+type DoQServer struct {
+	EdnsClientSubnet string `json:"edns-client-subnet"`
+	CertFile         string
+	CertKeyFile      string
+	ZeroRTT          bool `json:"zero-rtt"`
+	addr             string
+	cert             *tls.Certificate
+	cli              Client
+}
+
+func NewDoQServer(cli Client, URL string, body json.RawMessage) (srv *DoQServer) {
+	u, err := url.Parse(URL)
+	if err != nil {
+		panic(err.Error())
+	}
+	GuessPort(u)
+
+	srv = &DoQServer{
+		addr: u.Host,
+		cli:  cli,
+	}
+
+	if body != nil {
+		err = json.Unmarshal(body, &srv)
+		if err != nil {
+			panic(err.Error())
+		}
+	}
+
+	cert, err := tls.LoadX509KeyPair(srv.CertFile, srv.CertKeyFile)
+	if err != nil {
+		panic(err.Error())
+	}
+	srv.cert = &cert
+	return
+}
+
+func (srv *DoQServer) Serve() (err error) {
+	pc, err := net.ListenPacket("udp", srv.addr)
+	if err != nil {
+		return
+	}
+	logger.Infof("doq server start. listen in quic://%s", srv.addr)
+	return srv.ServePacketConn(pc)
+}
+
+func (srv *DoQServer) ServePacketConn(pc net.PacketConn) (err error) {
+	tlsconf := &tls.Config{
+		Certificates: []tls.Certificate{*srv.cert},
+		NextProtos:   DoQALPN,
+	}
+	conf := &quic.Config{
+		MaxIdleTimeout: DOQ_IDLE_TIMEOUT,
+		Allow0RTT:      srv.ZeroRTT,
+	}
+
+	ln, err := quic.ListenEarly(pc, tlsconf, conf)
+	if err != nil {
+		return
+	}
+	defer ln.Close()
+
+	for {
+		var conn *quic.Conn
+		conn, err = ln.Accept(context.Background())
+		if err != nil {
+			return
+		}
+		go srv.ServeConn(conn)
+	}
+}
+
+func (srv *DoQServer) ServeConn(conn *quic.Conn) {
+	for {
+		stream, err := conn.AcceptStream(context.Background())
+		if err != nil {
+			logger.Debugf("doq connection closed: %s", err.Error())
+			return
+		}
+		go srv.ServeStream(conn, stream)
+	}
+}
+
+func (srv *DoQServer) ServeStream(conn *quic.Conn, stream *quic.Stream) {
+	defer stream.Close()
+	stream.SetDeadline(time.Now().Add(DOQ_IDLE_TIMEOUT))
+
+	quiz, err := ReadDoQMsg(stream)
+	if err != nil {
+		logger.Error(err.Error())
+		conn.CloseWithError(DOQ_INTERNAL_ERROR, "bad query")
+		return
+	}
+	if len(quiz.Question) == 0 {
+		logger.Error("empty question")
+		ans := &dns.Msg{}
+		ans.SetRcodeFormatError(quiz)
+		err = WriteDoQMsg(stream, ans)
+		if err != nil {
+			logger.Error(err.Error())
+		}
+		return
+	}
+	logger.Infof("doq server query: %s", quiz.Question[0].Name)
+
+	SetClientSubnet(quiz, srv.EdnsClientSubnet, conn.RemoteAddr())
+
+	ans, err := srv.cli.Exchange(stream.Context(), quiz)
+	if err != nil {
+		logger.Error(err.Error())
+		ans = ServFail(quiz, dns.ExtendedErrorCodeOther, err.Error())
+	}
+	ans.Id = 0
+
+	err = WriteDoQMsg(stream, ans)
+	if err != nil {
+		logger.Error(err.Error())
+		return
+	}
+	return
+}
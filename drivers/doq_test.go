@@ -0,0 +1,137 @@
+package drivers
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// NewTestCert writes a self signed certificate for localhost and 127.0.0.1.
+func NewTestCert(t *testing.T) (certfile, keyfile string) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key failed: %s", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "localhost"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatalf("create cert failed: %s", err)
+	}
+	bkey, err := x509.MarshalECPrivateKey(priv)
+	if err != nil {
+		t.Fatalf("marshal key failed: %s", err)
+	}
+
+	dir := t.TempDir()
+	certfile = filepath.Join(dir, "cert.pem")
+	keyfile = filepath.Join(dir, "key.pem")
+	os.WriteFile(certfile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	os.WriteFile(keyfile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: bkey}), 0600)
+	return
+}
+
+func StartTestDoQ(t *testing.T, upstream Client) (URL string) {
+	certfile, keyfile := NewTestCert(t)
+	srv := NewDoQServer(upstream, "quic://127.0.0.1:0",
+		[]byte(`{"CertFile": "`+certfile+`", "CertKeyFile": "`+keyfile+`"}`))
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %s", err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	go srv.ServePacketConn(pc)
+	return "quic://" + pc.LocalAddr().String()
+}
+
+func TestDoQ(t *testing.T) {
+	upstream := &StaticClient{Records: []string{"www.example.com. 300 IN A 192.0.2.1"}}
+	URL := StartTestDoQ(t, upstream)
+
+	header := &DriverHeader{URL: URL}
+	cli := header.CreateClient([]byte(`{"insecure": true}`)).(*DoQClient)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			quiz := &dns.Msg{}
+			quiz.SetQuestion("www.example.com.", dns.TypeA)
+			ans, err := cli.Exchange(context.Background(), quiz)
+			if err != nil {
+				t.Errorf("exchange failed: %s", err)
+				return
+			}
+			if ans.Id != quiz.Id || len(ans.Answer) != 1 {
+				t.Errorf("wrong answer: %s", ans)
+			}
+		}()
+	}
+	wg.Wait()
+
+	conn := cli.conn
+	quiz := &dns.Msg{}
+	quiz.SetQuestion("www.example.com.", dns.TypeA)
+	cli.Exchange(context.Background(), quiz)
+	if cli.conn != conn {
+		t.Fatalf("connection should be reused.")
+	}
+
+	conn.CloseWithError(DOQ_NO_ERROR, "")
+	_, err := cli.Exchange(context.Background(), quiz)
+	if err != nil || cli.conn == conn {
+		t.Fatalf("closed connection should be replaced: %s", err)
+	}
+}
+
+func TestDoQFormatError(t *testing.T) {
+	upstream := &StaticClient{Records: []string{"www.example.com. 300 IN A 192.0.2.1"}}
+	URL := StartTestDoQ(t, upstream)
+
+	header := &DriverHeader{URL: URL}
+	cli := header.CreateClient([]byte(`{"insecure": true, "timeout": 2000}`)).(*DoQClient)
+
+	ans, err := cli.Exchange(context.Background(), &dns.Msg{})
+	if err != nil {
+		t.Fatalf("exchange failed: %s", err)
+	}
+	if ans.Rcode != dns.RcodeFormatError {
+		t.Fatalf("empty question should be formerr: %s", ans)
+	}
+}
+
+func TestGuessDoQ(t *testing.T) {
+	driver, err := GuessDriver("quic://dns.adguard.com")
+	if err != nil || driver != "doq" {
+		t.Fatalf("wrong driver: %s", driver)
+	}
+	cli := NewDoQClient("quic://dns.adguard.com", nil)
+	if cli.addr != "dns.adguard.com:853" {
+		t.Fatalf("wrong default port: %s", cli.addr)
+	}
+}
@@ -0,0 +1,137 @@
+package drivers
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"net"
+	"sync"
+)
+
+const (
+	ECH_OFF     = ""
+	ECH_PREFER  = "prefer"
+	ECH_REQUIRE = "require"
+)
+
+var (
+	ErrNoECH = errors.New("no ech config for host")
+)
+
+// ECHDialer dials https with Encrypted Client Hello, the configs are from ech-config or the HTTPS records in bootstrap.
+// In prefer, it connects without ECH if there is no config or ECH is rejected. In require, it fails.
+type ECHDialer struct {
+	policy    string
+	static    []byte
+	bootstrap *Bootstrap
+	tlsconf   *tls.Config
+	mu        sync.Mutex
+	retry     map[string][]byte
+}
+
+func NewECHDialer(policy, config string, bootstrap *Bootstrap, tlsconf *tls.Config) (d *ECHDialer, err error) {
+	switch policy {
+	case ECH_PREFER, ECH_REQUIRE:
+	default:
+		return nil, ErrConfigParse
+	}
+
+	d = &ECHDialer{
+		policy:    policy,
+		bootstrap: bootstrap,
+		tlsconf:   tlsconf.Clone(),
+		retry:     make(map[string][]byte),
+	}
+	d.tlsconf.NextProtos = []string{"h2", "http/1.1"}
+
+	if config != "" {
+		d.static, err = base64.StdEncoding.DecodeString(config)
+		if err != nil {
+			return
+		}
+	}
+	if d.static == nil && (bootstrap == nil || len(bootstrap.resolvers) == 0) {
+		return nil, ErrConfigParse
+	}
+	return
+}
+
+// ConfigList returns the retry configs from the server first, then the static or the one in HTTPS record.
+func (d *ECHDialer) ConfigList(ctx context.Context, addr string) (list []byte, err error) {
+	d.mu.Lock()
+	list = d.retry[addr]
+	d.mu.Unlock()
+	if list != nil {
+		return
+	}
+	if d.static != nil {
+		return d.static, nil
+	}
+	list, err = d.bootstrap.ECHConfigList(ctx, addr)
+	if err == nil && list == nil {
+		err = ErrNoECH
+	}
+	return
+}
+
+func (d *ECHDialer) DialTLSContext(ctx context.Context, network, addr string) (conn net.Conn, err error) {
+	list, err := d.ConfigList(ctx, addr)
+	if err != nil {
+		if d.policy == ECH_REQUIRE {
+			return
+		}
+		logger.Infof("connect %s without ech: %s", addr, err.Error())
+	}
+
+	retried := false
+	for {
+		conn, err = d.handshake(ctx, network, addr, list)
+		var rejection *tls.ECHRejectionError
+		if list == nil || !errors.As(err, &rejection) {
+			return
+		}
+		if len(rejection.RetryConfigList) > 0 && !retried {
+			// the server gives the configs to retry.
+			logger.Infof("ech rejected by %s, retry with new configs", addr)
+			d.mu.Lock()
+			d.retry[addr] = rejection.RetryConfigList
+			d.mu.Unlock()
+			list = rejection.RetryConfigList
+			retried = true
+			continue
+		}
+		if retried {
+			// the retry configs don't work either, don't use them next time.
+			d.mu.Lock()
+			delete(d.retry, addr)
+			d.mu.Unlock()
+		}
+		if d.policy == ECH_REQUIRE {
+			return
+		}
+		logger.Infof("ech rejected by %s, connect without it", addr)
+		list = nil
+	}
+}
+
+func (d *ECHDialer) handshake(ctx context.Context, network, addr string, list []byte) (conn net.Conn, err error) {
+	raw, err := d.bootstrap.DialContext(ctx, network, addr)
+	if err != nil {
+		return
+	}
+
+	tlsconf := d.tlsconf.Clone()
+	if tlsconf.ServerName == "" {
+		tlsconf.ServerName, _, _ = net.SplitHostPort(addr)
+	}
+	tlsconf.EncryptedClientHelloConfigList = list
+
+	tlsconn := tls.Client(raw, tlsconf)
+	err = tlsconn.HandshakeContext(ctx)
+	if err != nil {
+		raw.Close()
+		return nil, err
+	}
+	return tlsconn, nil
+}
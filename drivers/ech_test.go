@@ -0,0 +1,135 @@
+package drivers
+
+import (
+	"context"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// NewTestECHKey makes an ECH key with X25519, HKDF-SHA256 and AES-128-GCM, and the config list of it.
+func NewTestECHKey(t *testing.T, id byte, publicName string) (key tls.EncryptedClientHelloKey, list []byte) {
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key failed: %s", err)
+	}
+	vec16 := func(b []byte, v []byte) []byte {
+		b = binary.BigEndian.AppendUint16(b, uint16(len(v)))
+		return append(b, v...)
+	}
+
+	contents := []byte{id, 0x00, 0x20}
+	contents = vec16(contents, priv.PublicKey().Bytes())
+	contents = vec16(contents, []byte{0x00, 0x01, 0x00, 0x01})
+	contents = append(contents, 0, byte(len(publicName)))
+	contents = append(contents, publicName...)
+	contents = vec16(contents, nil)
+	config := vec16([]byte{0xfe, 0x0d}, contents)
+
+	key = tls.EncryptedClientHelloKey{Config: config, PrivateKey: priv.Bytes(), SendAsRetry: true}
+	return key, vec16(nil, config)
+}
+
+// StartTestECH serves doh with the ECH keys, accepted records if ECH is accepted in the last request.
+// The certificate of httptest is for example.com and *.example.com.
+func StartTestECH(t *testing.T, upstream Client, keys ...tls.EncryptedClientHelloKey) (port, cafile string, accepted *atomic.Bool) {
+	accepted = &atomic.Bool{}
+	srv := NewDoHServer(upstream, "https://127.0.0.1:0", nil)
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		accepted.Store(r.TLS.ECHAccepted)
+		srv.mux.ServeHTTP(w, r)
+	}))
+	ts.TLS = &tls.Config{EncryptedClientHelloKeys: keys}
+	ts.StartTLS()
+	t.Cleanup(ts.Close)
+
+	cafile = filepath.Join(t.TempDir(), "ca.pem")
+	os.WriteFile(cafile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw}), 0600)
+	return ts.URL[strings.LastIndex(ts.URL, ":")+1:], cafile, accepted
+}
+
+func TestECH(t *testing.T) {
+	upstream := &StaticClient{Records: []string{"www.example.com. 300 IN A 192.0.2.1"}}
+	key, list := NewTestECHKey(t, 1, "public.example.com")
+	port, cafile, accepted := StartTestECH(t, upstream, key)
+	_, stale := NewTestECHKey(t, 2, "public.example.com")
+
+	resolver := &StaticClient{Records: []string{
+		"doh.example.com. 300 IN A 127.0.0.1",
+		"_" + port + "._https.doh.example.com. 300 IN HTTPS 1 . ech=" + base64.StdEncoding.EncodeToString(list),
+	}}
+	addr, _ := StartTestBootstrap(t, resolver)
+	noech := &StaticClient{Records: []string{"doh.example.com. 300 IN A 127.0.0.1"}}
+	addrNoECH, _ := StartTestBootstrap(t, noech)
+
+	quiz := &dns.Msg{}
+	quiz.SetQuestion("www.example.com.", dns.TypeA)
+	for _, c := range []struct {
+		driver   string
+		body     string
+		ok       bool
+		accepted bool
+	}{
+		{"rfc8484", `"ech": "require", "bootstrap": ["udp://` + addr + `"]`, true, true},
+		{"google", `"ech": "require", "bootstrap": ["udp://` + addr + `"]`, true, true},
+		// the stale config is rejected, and the server gives the new one to retry.
+		{"rfc8484", `"ech": "require", "ech-config": "` + base64.StdEncoding.EncodeToString(stale) + `", "bootstrap": ["127.0.0.1"]`, true, true},
+		{"rfc8484", `"ech": "prefer", "bootstrap": ["udp://` + addrNoECH + `"]`, true, false},
+		{"rfc8484", `"ech": "require", "bootstrap": ["udp://` + addrNoECH + `"]`, false, false},
+	} {
+		accepted.Store(false)
+		URL := "https://doh.example.com:" + port + "/dns-query"
+		if c.driver == "google" {
+			URL = "https://doh.example.com:" + port + "/resolve"
+		}
+		header := &DriverHeader{Driver: c.driver, URL: URL}
+		cli := header.CreateClient([]byte(`{"ca-file": "` + cafile + `", "timeout": 1000, ` + c.body + `}`))
+		_, err := cli.Exchange(context.Background(), quiz)
+		if (err == nil) != c.ok || accepted.Load() != c.accepted {
+			t.Fatalf("wrong result of %s %s: %v %v", c.driver, c.body, err, accepted.Load())
+		}
+	}
+}
+
+func TestECHRetryRejected(t *testing.T) {
+	upstream := &StaticClient{Records: []string{"www.example.com. 300 IN A 192.0.2.1"}}
+	// the private key doesn't match the config, so the retry configs are rejected again.
+	key, _ := NewTestECHKey(t, 3, "public.example.com")
+	other, _ := NewTestECHKey(t, 3, "public.example.com")
+	key.PrivateKey = other.PrivateKey
+	port, cafile, accepted := StartTestECH(t, upstream, key)
+	_, stale := NewTestECHKey(t, 2, "public.example.com")
+
+	quiz := &dns.Msg{}
+	quiz.SetQuestion("www.example.com.", dns.TypeA)
+	for _, policy := range []string{"prefer", "require"} {
+		header := &DriverHeader{URL: "https://doh.example.com:" + port + "/dns-query"}
+		cli := header.CreateClient([]byte(`{"ca-file": "` + cafile + `", "timeout": 1000, "ech": "` + policy +
+			`", "ech-config": "` + base64.StdEncoding.EncodeToString(stale) + `", "bootstrap": ["127.0.0.1"]}`))
+		_, err := cli.Exchange(context.Background(), quiz)
+		if (err == nil) != (policy == "prefer") || accepted.Load() {
+			t.Fatalf("wrong result of %s: %v %v", policy, err, accepted.Load())
+		}
+	}
+}
+
+func TestECHConfigParse(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatalf("ech without configs or resolvers should not be accepted")
+		}
+	}()
+	NewRfc8484Client("https://doh.example.com/dns-query", []byte(`{"ech": "require"}`))
+}
@@ -4,7 +4,6 @@ import (
 	"context"
 	"crypto/tls"
 	"encoding/json"
-	"fmt"
 	"net"
 	"net/url"
 	"time"
@@ -15,8 +14,16 @@ import (
 type DnsClient struct {
 	URL     string
 	Timeout int
-	host    string
-	cli     *dns.Client
+	TLSOptions
+	Bootstrap   []string `json:"bootstrap"`
+	NoPipeline  bool     `json:"no-pipeline"`
+	IdleTimeout int      `json:"idle-timeout"`
+	MaxConns    int      `json:"max-conns"`
+	host        string
+	bootstrap   *Bootstrap
+	cli         *dns.Client
+	pool        *ConnPool
+	fallback    *DnsClient
 }
 
 func NewDnsClient(URL string, body json.RawMessage) (cli *DnsClient) {
@@ -29,6 +36,9 @@ func NewDnsClient(URL string, body json.RawMessage) (cli *DnsClient) {
 	}
 	cli.URL = URL
 
+	if Insecure {
+		cli.Insecure = Insecure
+	}
 	if Timeout != 0 {
 		cli.Timeout = Timeout
 	}
@@ -40,14 +50,44 @@ func NewDnsClient(URL string, body json.RawMessage) (cli *DnsClient) {
 	GuessPort(u)
 
 	cli.host = u.Host
+	cli.bootstrap = NewBootstrap(cli.Bootstrap)
 	cli.cli = &dns.Client{
 		Net: u.Scheme,
 	}
+	if u.Scheme == "tcp-tls" {
+		cli.cli.TLSConfig, err = cli.NewTLSConfig(u.Hostname())
+		if err != nil {
+			panic(err.Error())
+		}
+	}
 
 	if cli.Timeout != 0 {
 		cli.cli.Timeout = time.Duration(cli.Timeout) * time.Millisecond
 	}
 
+	// truncated answers in udp are retried in tcp.
+	if u.Scheme == "udp" {
+		cli.fallback = NewDnsClient("tcp://"+u.Host, body)
+		cli.fallback.bootstrap = cli.bootstrap
+	}
+
+	if (u.Scheme == "tcp" || u.Scheme == "tcp-tls") && !cli.NoPipeline {
+		cli.pool = NewConnPool(func(ctx context.Context) (conn *dns.Conn, err error) {
+			addrs, err := cli.bootstrap.Addrs(ctx, cli.host)
+			if err != nil {
+				return
+			}
+			for _, addr := range addrs {
+				conn, err = cli.cli.DialContext(ctx, addr)
+				if err == nil {
+					return
+				}
+				logger.Info(err.Error())
+			}
+			return
+		}, time.Duration(cli.IdleTimeout)*time.Millisecond, cli.MaxConns)
+	}
+
 	return
 }
 
@@ -56,7 +96,30 @@ func (cli *DnsClient) Url() (u string) {
 }
 
 func (cli *DnsClient) Exchange(ctx context.Context, quiz *dns.Msg) (ans *dns.Msg, err error) {
-	ans, _, err = cli.cli.ExchangeContext(ctx, quiz, cli.host)
+	if cli.pool != nil {
+		if cli.Timeout != 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, time.Duration(cli.Timeout)*time.Millisecond)
+			defer cancel()
+		}
+		return cli.pool.Exchange(ctx, quiz)
+	}
+	addrs, err := cli.bootstrap.Addrs(ctx, cli.host)
+	if err != nil {
+		return
+	}
+	var addr string
+	for _, addr = range addrs {
+		ans, _, err = cli.cli.ExchangeContext(ctx, quiz, addr)
+		if err == nil || ctx.Err() != nil {
+			break
+		}
+		logger.Info(err.Error())
+	}
+	if err == nil && ans.Truncated && cli.fallback != nil {
+		logger.Debugf("truncated answer from %s, retry in tcp", addr)
+		ans, err = cli.fallback.Exchange(ctx, quiz)
+	}
 	return
 }
 
@@ -107,32 +170,14 @@ func NewDnsServer(cli Client, URL string, body json.RawMessage) (srv *DnsServer)
 func (srv *DnsServer) ServeDNS(w dns.ResponseWriter, quiz *dns.Msg) {
 	logger.Infof("dns server query: %s", quiz.Question[0].Name)
 
-	var addr net.IP
-	var mask uint8
-	var err error
-	switch srv.EdnsClientSubnet {
-	case "":
-	case "client":
-		raddr := w.RemoteAddr()
-		switch taddr := raddr.(type) {
-		case *net.TCPAddr:
-			addr = taddr.IP
-		case *net.UDPAddr:
-			addr = taddr.IP
-		default:
-			panic(fmt.Sprintf("unknown addr %s", raddr.Network()))
-		}
-		mask = 32
-		AppendEdns0Subnet(quiz, addr, mask)
-
-	default:
-		addr, mask, err = ParseSubnet(srv.EdnsClientSubnet)
-		if err != nil {
-			panic(err.Error())
-		}
-		AppendEdns0Subnet(quiz, addr, mask)
+	// the size of udp answer is limited by the buffer size of client, RFC 6891 6.2.5.
+	size := dns.MinMsgSize
+	if opt := quiz.IsEdns0(); opt != nil {
+		size = max(int(opt.UDPSize()), dns.MinMsgSize)
 	}
 
+	SetClientSubnet(quiz, srv.EdnsClientSubnet, w.RemoteAddr())
+
 	ctx := context.Background()
 	ans, err := srv.cli.Exchange(ctx, quiz)
 	if err != nil {
@@ -145,6 +190,10 @@ func (srv *DnsServer) ServeDNS(w dns.ResponseWriter, quiz *dns.Msg) {
 		return
 	}
 
+	if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+		ans.Truncate(size)
+	}
+
 	err = w.WriteMsg(ans)
 	if err != nil {
 		logger.Error(err.Error())
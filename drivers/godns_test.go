@@ -0,0 +1,101 @@
+package drivers
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// StartTestDnsServer serves handler in both udp and tcp on the same port.
+func StartTestDnsServer(t *testing.T, handler dns.Handler) (addr string) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %s", err)
+	}
+	ln, err := net.Listen("tcp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("listen failed: %s", err)
+	}
+	udp := &dns.Server{PacketConn: pc, Handler: handler}
+	tcp := &dns.Server{Listener: ln, Handler: handler}
+	go udp.ActivateAndServe()
+	go tcp.ActivateAndServe()
+	t.Cleanup(func() {
+		udp.Shutdown()
+		tcp.Shutdown()
+	})
+	return pc.LocalAddr().String()
+}
+
+func LargeRecords(name string, n int) (records []string) {
+	for i := 0; i < n; i++ {
+		records = append(records, fmt.Sprintf("%s 300 IN A 192.0.2.%d", name, i+1))
+	}
+	return
+}
+
+func TestDnsTCPFallback(t *testing.T) {
+	var udpCount, tcpCount atomic.Int32
+	upstream := &StaticClient{Records: LargeRecords("www.example.com.", 40)}
+	addr := StartTestDnsServer(t, dns.HandlerFunc(func(w dns.ResponseWriter, quiz *dns.Msg) {
+		ans, _ := upstream.Exchange(context.Background(), quiz)
+		if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+			udpCount.Add(1)
+			ans.Answer = nil
+			ans.Truncated = true
+		} else {
+			tcpCount.Add(1)
+		}
+		w.WriteMsg(ans)
+	}))
+
+	cli := NewDnsClient("udp://"+addr, []byte(`{"timeout": 2000}`))
+	quiz := &dns.Msg{}
+	quiz.SetQuestion("www.example.com.", dns.TypeA)
+	ans, err := cli.Exchange(context.Background(), quiz)
+	if err != nil {
+		t.Fatalf("exchange failed: %s", err)
+	}
+	if ans.Truncated || len(ans.Answer) != 40 || udpCount.Load() != 1 || tcpCount.Load() != 1 {
+		t.Fatalf("truncated answer should be retried in tcp: %s", ans)
+	}
+}
+
+func TestDnsServerTruncate(t *testing.T) {
+	upstream := &StaticClient{Records: LargeRecords("www.example.com.", 40)}
+	srv := NewDnsServer(upstream, "udp://127.0.0.1:0", nil)
+	addr := StartTestDnsServer(t, srv)
+
+	udp := &dns.Client{Net: "udp"}
+	quiz := &dns.Msg{}
+	quiz.SetQuestion("www.example.com.", dns.TypeA)
+	ans, _, err := udp.Exchange(quiz, addr)
+	if err != nil {
+		t.Fatalf("exchange failed: %s", err)
+	}
+	ans.Compress = true
+	if !ans.Truncated || len(ans.Answer) == 40 || ans.Len() > dns.MinMsgSize {
+		t.Fatalf("answer should be truncated to 512: %d", ans.Len())
+	}
+
+	quiz.SetEdns0(4096, false)
+	ans, _, err = udp.Exchange(quiz, addr)
+	if err != nil {
+		t.Fatalf("exchange failed: %s", err)
+	}
+	if ans.Truncated || len(ans.Answer) != 40 {
+		t.Fatalf("answer should fit in edns buffer: %s", ans)
+	}
+
+	tcp := &dns.Client{Net: "tcp"}
+	quiz = &dns.Msg{}
+	quiz.SetQuestion("www.example.com.", dns.TypeA)
+	ans, _, err = tcp.Exchange(quiz, addr)
+	if err != nil || ans.Truncated || len(ans.Answer) != 40 {
+		t.Fatalf("answer in tcp should not be truncated: %v", err)
+	}
+}
@@ -2,7 +2,6 @@ package drivers
 
 import (
 	"context"
-	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"net"
@@ -24,9 +23,13 @@ func ParseUint(s string) (n uint64) {
 }
 
 type GoogleClient struct {
-	URL       string
-	Insecure  bool
-	Timeout   int
+	URL     string
+	Timeout int
+	TLSOptions
+	Bootstrap []string `json:"bootstrap"`
+	ECH       string   `json:"ech"`
+	ECHConfig string   `json:"ech-config"`
+	bootstrap *Bootstrap
 	transport *http.Transport
 }
 
@@ -47,11 +50,28 @@ func NewGoogleClient(URL string, body json.RawMessage) (cli *GoogleClient) {
 		cli.Timeout = Timeout
 	}
 
+	tlsconf, err := cli.NewTLSConfig("")
+	if err != nil {
+		panic(err.Error())
+	}
 	cli.transport = &http.Transport{
-		Proxy: http.ProxyFromEnvironment,
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: tlsconf,
+	}
+	// connect to the bootstrap IPs directly, not the proxy.
+	cli.bootstrap = NewBootstrap(cli.Bootstrap)
+	if cli.bootstrap != nil {
+		cli.transport.Proxy = nil
+		cli.transport.DialContext = cli.bootstrap.DialContext
 	}
-	if cli.Insecure {
-		cli.transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	if cli.ECH != ECH_OFF {
+		dialer, err := NewECHDialer(cli.ECH, cli.ECHConfig, cli.bootstrap, tlsconf)
+		if err != nil {
+			panic(err.Error())
+		}
+		cli.transport.Proxy = nil
+		cli.transport.DialTLSContext = dialer.DialTLSContext
+		cli.transport.ForceAttemptHTTP2 = true
 	}
 
 	return
@@ -63,7 +83,9 @@ func (cli *GoogleClient) Url() (u string) {
 
 func (cli *GoogleClient) Exchange(ctx context.Context, quiz *dns.Msg) (ans *dns.Msg, err error) {
 	if cli.Timeout != 0 {
-		ctx, _ = context.WithTimeout(ctx, time.Duration(cli.Timeout)*time.Millisecond)
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(cli.Timeout)*time.Millisecond)
+		defer cancel()
 	}
 
 	req, err := http.NewRequestWithContext(ctx, "GET", cli.URL, nil)
@@ -254,9 +276,9 @@ func (msg *DNSMsg) TranslateAnswer(quiz *dns.Msg) (ans *dns.Msg, err error) {
 	for idx, q := range msg.Question {
 		ans.Question = append(ans.Question,
 			dns.Question{
-				q.Name,
-				uint16(q.Type),
-				quiz.Question[idx].Qclass,
+				Name:   q.Name,
+				Qtype:  uint16(q.Type),
+				Qclass: quiz.Question[idx].Qclass,
 			})
 	}
 
@@ -615,7 +637,7 @@ func FromRR(rr dns.RR) (jr *DNSRR) {
 		jr.Data = fmt.Sprintf("%d %d %d %s", v.Flags, v.Protocol, v.Algorithm, v.PublicKey)
 	case *dns.NSEC3:
 		var datas []string = make([]string, 1)
-		datas[0] = fmt.Sprintf("%d %d %d %d %s %d %s", v.Hash, v.Flags, v.Iterations, v.SaltLength, v.SaltLength, v.HashLength, v.NextDomain)
+		datas[0] = fmt.Sprintf("%d %d %d %d %s %d %s", v.Hash, v.Flags, v.Iterations, v.SaltLength, v.Salt, v.HashLength, v.NextDomain)
 		for _, b := range v.TypeBitMap {
 			if s, ok := dns.TypeToString[b]; ok {
 				datas = append(datas, s)
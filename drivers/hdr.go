@@ -2,6 +2,7 @@ package drivers
 
 import (
 	"encoding/json"
+	"strings"
 )
 
 type DriverHeader struct {
@@ -11,6 +12,17 @@ type DriverHeader struct {
 
 func (header *DriverHeader) CreateClient(body json.RawMessage) (cli Client) {
 	var err error
+	if strings.HasPrefix(header.URL, STAMP_PREFIX) {
+		var driver string
+		driver, header.URL, body, err = ExpandStamp(header.URL, body)
+		if err != nil {
+			panic(err.Error())
+		}
+		if header.Driver == "" {
+			header.Driver = driver
+		}
+	}
+
 	if header.Driver == "" {
 		header.Driver, err = GuessDriver(header.URL)
 		if err != nil {
@@ -25,14 +37,32 @@ func (header *DriverHeader) CreateClient(body json.RawMessage) (cli Client) {
 		cli = NewGoogleClient(header.URL, body)
 	case "rfc8484":
 		cli = NewRfc8484Client(header.URL, body)
+	case "doq":
+		cli = NewDoQClient(header.URL, body)
+	case "dnscrypt":
+		cli = NewDNSCryptClient(header.URL, body)
+	case "odoh":
+		cli = NewODoHClient(header.URL, body)
 	case "dnspod":
 		cli = NewDnsPodClient(header.URL, body)
 	case "twin":
 		cli = NewTwinClient(header.URL, body)
+	case "router":
+		cli = NewRouterClient(header.URL, body)
+	case "split":
+		cli = NewSplitClient(header.URL, body)
 	case "reties":
 		cli = NewRetiesClient(header.URL, body)
+	case "race":
+		cli = NewRaceClient(header.URL, body)
+	case "balance":
+		cli = NewBalanceClient(header.URL, body)
+	case "cache":
+		cli = NewCacheClient(header.URL, body)
 	case "recursive":
-		cli = NewRecursiveClient()
+		cli = NewRecursiveClient(header.URL, body)
+	case "validate":
+		cli = NewValidateClient(header.URL, body)
 	default:
 		panic("unknown driver")
 	}
@@ -54,6 +84,8 @@ func (header *DriverHeader) CreateService(cli Client, body json.RawMessage) (srv
 		srv = NewDnsServer(cli, header.URL, body)
 	case "doh", "http", "https":
 		srv = NewDoHServer(cli, header.URL, body)
+	case "doq":
+		srv = NewDoQServer(cli, header.URL, body)
 	default:
 		err = ErrConfigParse
 		panic(err.Error())
@@ -0,0 +1,695 @@
+package drivers
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloudflare/circl/hpke"
+	"github.com/cloudflare/circl/kem"
+	"github.com/miekg/dns"
+)
+
+const (
+	ODOH_VERSION       = 0x0001
+	ODOH_QUERY         = 0x01
+	ODOH_RESPONSE      = 0x02
+	ODOH_CONTENT_TYPE  = "application/oblivious-dns-message"
+	ODOH_CONFIGS_PATH  = "/.well-known/odohconfigs"
+	ODOH_PADDING_BLOCK = 128
+	ODOH_CONFIG_TTL    = time.Hour
+)
+
+var (
+	ErrODoHMessage     = errors.New("malformed odoh message")
+	ErrODoHConfig      = errors.New("no supported odoh config")
+	ErrODoHKeyId       = errors.New("odoh key id mismatch")
+	ErrODoHTarget      = errors.New("odoh target not allowed")
+	ODoHSuite          = hpke.NewSuite(hpke.KEM_X25519_HKDF_SHA256, hpke.KDF_HKDF_SHA256, hpke.AEAD_AES128GCM)
+	ODoHKEM            = hpke.KEM_X25519_HKDF_SHA256
+	ODoHKDF            = hpke.KDF_HKDF_SHA256
+	ODoHAEAD           = hpke.AEAD_AES128GCM
+	odohQueryInfo      = []byte("odoh query")
+	odohResponseSecret = []byte("odoh response")
+)
+
+// ReadVector reads a vector with 2 bytes length prefix.
+func ReadVector(r *bytes.Reader) (b []byte, err error) {
+	var length uint16
+	err = binary.Read(r, binary.BigEndian, &length)
+	if err != nil {
+		return nil, ErrODoHMessage
+	}
+	b = make([]byte, length)
+	_, err = io.ReadFull(r, b)
+	if err != nil {
+		return nil, ErrODoHMessage
+	}
+	return
+}
+
+func AppendVector(buf []byte, b []byte) []byte {
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(b)))
+	return append(buf, b...)
+}
+
+// ODoHConfig is the ObliviousDoHConfigContents in RFC 9230 6.1.
+type ODoHConfig struct {
+	KEM       hpke.KEM
+	KDF       hpke.KDF
+	AEAD      hpke.AEAD
+	PublicKey []byte
+}
+
+func (cfg *ODoHConfig) Contents() (b []byte) {
+	b = binary.BigEndian.AppendUint16(b, uint16(cfg.KEM))
+	b = binary.BigEndian.AppendUint16(b, uint16(cfg.KDF))
+	b = binary.BigEndian.AppendUint16(b, uint16(cfg.AEAD))
+	return AppendVector(b, cfg.PublicKey)
+}
+
+func (cfg *ODoHConfig) KeyId() []byte {
+	prk := cfg.KDF.Extract(cfg.Contents(), nil)
+	return cfg.KDF.Expand(prk, []byte("odoh key id"), uint(cfg.KDF.ExtractSize()))
+}
+
+func (cfg *ODoHConfig) Supported() bool {
+	return cfg.KEM == ODoHKEM && cfg.KDF == ODoHKDF && cfg.AEAD == ODoHAEAD
+}
+
+func MarshalODoHConfigs(cfgs []*ODoHConfig) []byte {
+	var body []byte
+	for _, cfg := range cfgs {
+		body = binary.BigEndian.AppendUint16(body, ODOH_VERSION)
+		body = AppendVector(body, cfg.Contents())
+	}
+	return AppendVector(nil, body)
+}
+
+// ParseODoHConfigs returns configs in supported version, others are skipped.
+func ParseODoHConfigs(b []byte) (cfgs []*ODoHConfig, err error) {
+	body, err := ReadVector(bytes.NewReader(b))
+	if err != nil {
+		return
+	}
+	r := bytes.NewReader(body)
+	for r.Len() > 0 {
+		var version uint16
+		err = binary.Read(r, binary.BigEndian, &version)
+		if err != nil {
+			return nil, ErrODoHMessage
+		}
+		var contents []byte
+		contents, err = ReadVector(r)
+		if err != nil {
+			return
+		}
+		if version != ODOH_VERSION || len(contents) < 8 {
+			continue
+		}
+		cfg := &ODoHConfig{
+			KEM:  hpke.KEM(binary.BigEndian.Uint16(contents[0:2])),
+			KDF:  hpke.KDF(binary.BigEndian.Uint16(contents[2:4])),
+			AEAD: hpke.AEAD(binary.BigEndian.Uint16(contents[4:6])),
+		}
+		cfg.PublicKey, err = ReadVector(bytes.NewReader(contents[6:]))
+		if err != nil {
+			return
+		}
+		cfgs = append(cfgs, cfg)
+	}
+	return
+}
+
+// ODoHMessage is the ObliviousDoHMessage in RFC 9230 6.1.
+type ODoHMessage struct {
+	Type      uint8
+	KeyId     []byte
+	Encrypted []byte
+}
+
+func (msg *ODoHMessage) Marshal() (b []byte) {
+	b = append(b, msg.Type)
+	b = AppendVector(b, msg.KeyId)
+	return AppendVector(b, msg.Encrypted)
+}
+
+func ParseODoHMessage(b []byte) (msg *ODoHMessage, err error) {
+	r := bytes.NewReader(b)
+	msg = &ODoHMessage{}
+	msg.Type, err = r.ReadByte()
+	if err != nil {
+		return nil, ErrODoHMessage
+	}
+	msg.KeyId, err = ReadVector(r)
+	if err != nil {
+		return nil, err
+	}
+	msg.Encrypted, err = ReadVector(r)
+	if err != nil {
+		return nil, err
+	}
+	return
+}
+
+func (msg *ODoHMessage) AAD() []byte {
+	return AppendVector([]byte{msg.Type}, msg.KeyId)
+}
+
+// PadODoHPlaintext makes the ObliviousDoHMessagePlaintext, with zero padding to the block size.
+func PadODoHPlaintext(bmsg []byte) (b []byte) {
+	b = AppendVector(nil, bmsg)
+	padding := (ODOH_PADDING_BLOCK - (len(b)+2)%ODOH_PADDING_BLOCK) % ODOH_PADDING_BLOCK
+	return AppendVector(b, make([]byte, padding))
+}
+
+func UnpadODoHPlaintext(b []byte) (msg *dns.Msg, err error) {
+	r := bytes.NewReader(b)
+	bmsg, err := ReadVector(r)
+	if err != nil {
+		return
+	}
+	padding, err := ReadVector(r)
+	if err != nil {
+		return
+	}
+	if subtle.ConstantTimeCompare(padding, make([]byte, len(padding))) != 1 {
+		return nil, ErrODoHMessage
+	}
+	msg = &dns.Msg{}
+	err = msg.Unpack(bmsg)
+	return
+}
+
+// ODoHResponseKey derives the key and nonce of response, RFC 9230 6.4.
+func ODoHResponseKey(ctx hpke.Context, plain, nonce []byte) (key, iv []byte) {
+	secret := ctx.Export(odohResponseSecret, ODoHAEAD.KeySize())
+	salt := AppendVector(append([]byte{}, plain...), nonce)
+	prk := ODoHKDF.Extract(secret, salt)
+	key = ODoHKDF.Expand(prk, []byte("odoh key"), ODoHAEAD.KeySize())
+	iv = ODoHKDF.Expand(prk, []byte("odoh nonce"), ODoHAEAD.NonceSize())
+	return
+}
+
+func ODoHResponseNonceSize() uint {
+	return max(ODoHAEAD.KeySize(), ODoHAEAD.NonceSize())
+}
+
+type ODoHClient struct {
+	URL         string
+	Proxy       string `json:"proxy"`
+	ODoHConfigs string `json:"odoh-config"`
+	Insecure    bool
+	Timeout     int
+	target      *url.URL
+	transport   *http.Transport
+	static      *ODoHConfig
+	mu          sync.Mutex
+	config      *ODoHConfig
+	expire      time.Time
+}
+
+func NewODoHClient(URL string, body json.RawMessage) (cli *ODoHClient) {
+	cli = &ODoHClient{}
+	if body != nil {
+		err := json.Unmarshal(body, &cli)
+		if err != nil {
+			panic(err.Error())
+		}
+	}
+	cli.URL = URL
+
+	if Insecure {
+		cli.Insecure = Insecure
+	}
+	if Timeout != 0 {
+		cli.Timeout = Timeout
+	}
+
+	u, err := url.Parse(URL)
+	if err != nil {
+		panic(err.Error())
+	}
+	if u.Scheme == "odoh" {
+		u.Scheme = "https"
+	}
+	if u.Path == "" {
+		u.Path = "/dns-query"
+	}
+	cli.target = u
+	if cli.Proxy == "" {
+		logger.Warningf("odoh without proxy, the target can see the address of client.")
+	}
+
+	if cli.ODoHConfigs != "" {
+		b, err := base64.StdEncoding.DecodeString(cli.ODoHConfigs)
+		if err != nil {
+			panic(err.Error())
+		}
+		cfgs, err := ParseODoHConfigs(b)
+		if err != nil {
+			panic(err.Error())
+		}
+		for _, c := range cfgs {
+			if c.Supported() {
+				cli.static = c
+				break
+			}
+		}
+		if cli.static == nil {
+			panic(ErrODoHConfig.Error())
+		}
+	}
+
+	cli.transport = &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+	}
+	if cli.Insecure {
+		cli.transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	return
+}
+
+func (cli *ODoHClient) Url() (u string) {
+	return cli.URL
+}
+
+func (cli *ODoHClient) Do(ctx context.Context, method, URL string, body []byte) (bbody []byte, err error) {
+	req, err := http.NewRequestWithContext(ctx, method, URL, bytes.NewReader(body))
+	if err != nil {
+		return
+	}
+	if body != nil {
+		req.Header.Add("Accept", ODOH_CONTENT_TYPE)
+		req.Header.Add("Content-Type", ODOH_CONTENT_TYPE)
+	}
+
+	resp, err := cli.transport.RoundTrip(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		logger.Infof("odoh %s %s: %s", method, URL, resp.Status)
+		return nil, ErrRequest
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// Config returns the config in odoh-config, or the cached config of target, or fetches it again through the proxy.
+func (cli *ODoHClient) Config(ctx context.Context) (cfg *ODoHConfig, err error) {
+	if cli.static != nil {
+		return cli.static, nil
+	}
+
+	cli.mu.Lock()
+	defer cli.mu.Unlock()
+
+	if cli.config != nil && time.Now().Before(cli.expire) {
+		return cli.config, nil
+	}
+
+	URL := cli.QueryURL(ODOH_CONFIGS_PATH)
+	logger.Debugf("odoh fetch configs from %s", URL)
+	b, err := cli.Do(ctx, "GET", URL, nil)
+	if err != nil {
+		return
+	}
+	cfgs, err := ParseODoHConfigs(b)
+	if err != nil {
+		return
+	}
+	for _, c := range cfgs {
+		if c.Supported() {
+			cli.config = c
+			cli.expire = time.Now().Add(ODOH_CONFIG_TTL)
+			return c, nil
+		}
+	}
+	return nil, ErrODoHConfig
+}
+
+func (cli *ODoHClient) reset(cfg *ODoHConfig) {
+	cli.mu.Lock()
+	defer cli.mu.Unlock()
+	if cli.config == cfg {
+		cli.config = nil
+	}
+}
+
+// QueryURL returns the url of proxy with target and path in parameters, RFC 9230 4.1.
+func (cli *ODoHClient) QueryURL(path string) string {
+	if cli.Proxy == "" {
+		u := *cli.target
+		if path != u.Path {
+			u.Path, u.RawQuery = path, ""
+		}
+		return u.String()
+	}
+	u, err := url.Parse(cli.Proxy)
+	if err != nil {
+		panic(err.Error())
+	}
+	q := u.Query()
+	q.Set("targethost", cli.target.Host)
+	q.Set("targetpath", path)
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+func (cli *ODoHClient) Exchange(ctx context.Context, quiz *dns.Msg) (ans *dns.Msg, err error) {
+	if cli.Timeout != 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(cli.Timeout)*time.Millisecond)
+		defer cancel()
+	}
+
+	cfg, err := cli.Config(ctx)
+	if err != nil {
+		logger.Error(err.Error())
+		return
+	}
+
+	ans, err = cli.exchange(ctx, cfg, quiz)
+	if err != nil {
+		// the key may be rotated by the target, fetch the config again next time.
+		logger.Error(err.Error())
+		cli.reset(cfg)
+		return
+	}
+	return
+}
+
+func (cli *ODoHClient) exchange(ctx context.Context, cfg *ODoHConfig, quiz *dns.Msg) (ans *dns.Msg, err error) {
+	bquiz, err := quiz.Pack()
+	if err != nil {
+		return
+	}
+	plain := PadODoHPlaintext(bquiz)
+
+	pk, err := cfg.KEM.Scheme().UnmarshalBinaryPublicKey(cfg.PublicKey)
+	if err != nil {
+		return
+	}
+	sender, err := ODoHSuite.NewSender(pk, odohQueryInfo)
+	if err != nil {
+		return
+	}
+	enc, sealer, err := sender.Setup(rand.Reader)
+	if err != nil {
+		return
+	}
+
+	msg := &ODoHMessage{Type: ODOH_QUERY, KeyId: cfg.KeyId()}
+	ct, err := sealer.Seal(plain, msg.AAD())
+	if err != nil {
+		return
+	}
+	msg.Encrypted = append(enc, ct...)
+
+	b, err := cli.Do(ctx, "POST", cli.QueryURL(cli.target.Path), msg.Marshal())
+	if err != nil {
+		return
+	}
+
+	resp, err := ParseODoHMessage(b)
+	if err != nil {
+		return
+	}
+	if resp.Type != ODOH_RESPONSE || uint(len(resp.KeyId)) != ODoHResponseNonceSize() {
+		return nil, ErrODoHMessage
+	}
+	key, iv := ODoHResponseKey(sealer, plain, resp.KeyId)
+	aead, err := ODoHAEAD.New(key)
+	if err != nil {
+		return
+	}
+	rplain, err := aead.Open(nil, iv, resp.Encrypted, resp.AAD())
+	if err != nil {
+		return
+	}
+	return UnpadODoHPlaintext(rplain)
+}
+
+// ODoHTarget decrypts the queries by its key pair, and answers by the client.
+type ODoHTarget struct {
+	config *ODoHConfig
+	keyid  []byte
+	sk     kem.PrivateKey
+	cli    Client
+}
+
+// NewODoHTarget derives the key pair from the hex seed, or generates a new one if the seed is empty.
+func NewODoHTarget(cli Client, seed string) (target *ODoHTarget) {
+	scheme := ODoHKEM.Scheme()
+	var pk kem.PublicKey
+	var sk kem.PrivateKey
+	var err error
+	if seed == "" {
+		pk, sk, err = scheme.GenerateKeyPair()
+		if err != nil {
+			panic(err.Error())
+		}
+	} else {
+		var bseed []byte
+		bseed, err = hex.DecodeString(seed)
+		if err != nil || len(bseed) != scheme.SeedSize() {
+			panic(ErrConfigParse.Error())
+		}
+		pk, sk = scheme.DeriveKeyPair(bseed)
+	}
+
+	bpk, err := pk.MarshalBinary()
+	if err != nil {
+		panic(err.Error())
+	}
+	target = &ODoHTarget{
+		config: &ODoHConfig{KEM: ODoHKEM, KDF: ODoHKDF, AEAD: ODoHAEAD, PublicKey: bpk},
+		sk:     sk,
+		cli:    cli,
+	}
+	target.keyid = target.config.KeyId()
+	return
+}
+
+func (target *ODoHTarget) ServeConfigs(w http.ResponseWriter, req *http.Request) {
+	w.Header().Add("Content-Type", "application/octet-stream")
+	w.Header().Add("Cache-Control", "max-age=3600")
+	w.WriteHeader(http.StatusOK)
+	err := WriteFull(w, MarshalODoHConfigs([]*ODoHConfig{target.config}))
+	if err != nil {
+		logger.Error(err.Error())
+	}
+}
+
+func (target *ODoHTarget) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	defer req.Body.Close()
+	if req.Method != "POST" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	b, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		logger.Error(err.Error())
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	msg, err := ParseODoHMessage(b)
+	if err != nil || msg.Type != ODOH_QUERY {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	// RFC 9230 4.3: 401 makes the client fetch the new config.
+	if !bytes.Equal(msg.KeyId, target.keyid) {
+		logger.Info(ErrODoHKeyId.Error())
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	nenc := ODoHKEM.Scheme().CiphertextSize()
+	if len(msg.Encrypted) < nenc {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	receiver, err := ODoHSuite.NewReceiver(target.sk, odohQueryInfo)
+	if err != nil {
+		logger.Error(err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	opener, err := receiver.Setup(msg.Encrypted[:nenc])
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	plain, err := opener.Open(msg.Encrypted[nenc:], msg.AAD())
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	quiz, err := UnpadODoHPlaintext(plain)
+	if err != nil || len(quiz.Question) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	logger.Infof("odoh target query: %s", quiz.Question[0].Name)
+
+	ans, err := target.cli.Exchange(req.Context(), quiz)
+	if err != nil {
+		logger.Error(err.Error())
+		ans = ServFail(quiz, dns.ExtendedErrorCodeOther, err.Error())
+	}
+	bans, err := ans.Pack()
+	if err != nil {
+		logger.Error(err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	resp := &ODoHMessage{Type: ODOH_RESPONSE, KeyId: make([]byte, ODoHResponseNonceSize())}
+	rand.Read(resp.KeyId)
+	key, iv := ODoHResponseKey(opener, plain, resp.KeyId)
+	aead, err := ODoHAEAD.New(key)
+	if err != nil {
+		logger.Error(err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	resp.Encrypted = aead.Seal(nil, iv, PadODoHPlaintext(bans), resp.AAD())
+
+	w.Header().Add("Content-Type", ODOH_CONTENT_TYPE)
+	w.Header().Add("Cache-Control", "no-cache, max-age=0")
+	w.WriteHeader(http.StatusOK)
+	err = WriteFull(w, resp.Marshal())
+	if err != nil {
+		logger.Error(err.Error())
+	}
+}
+
+// ODoHHandler dispatches the oblivious messages to target, and others to next.
+type ODoHHandler struct {
+	target *ODoHTarget
+	next   http.Handler
+}
+
+func (handler *ODoHHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method == "POST" && req.Header.Get("Content-Type") == ODOH_CONTENT_TYPE {
+		handler.target.ServeHTTP(w, req)
+		return
+	}
+	handler.next.ServeHTTP(w, req)
+}
+
+// ODoHProxy forwards the opaque messages to targets, without any information of the client.
+type ODoHProxy struct {
+	targets   []string
+	transport *http.Transport
+}
+
+func NewODoHProxy(targets []string) (proxy *ODoHProxy) {
+	proxy = &ODoHProxy{
+		targets: targets,
+		transport: &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+		},
+	}
+	if Insecure {
+		proxy.transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	if len(targets) == 0 {
+		logger.Warningf("odoh proxy without targets, all the queries will be denied.")
+	}
+	return
+}
+
+// Allowed means the host is in targets, the port is part of host. Nothing is allowed by default, or the proxy is an open relay.
+func (proxy *ODoHProxy) Allowed(host string) bool {
+	for _, t := range proxy.targets {
+		if strings.EqualFold(t, host) {
+			return true
+		}
+	}
+	return false
+}
+
+func (proxy *ODoHProxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	defer req.Body.Close()
+	q := req.URL.Query()
+	host, path := q.Get("targethost"), q.Get("targetpath")
+	switch {
+	case req.Method == "POST" && req.Header.Get("Content-Type") == ODOH_CONTENT_TYPE:
+	case req.Method == "GET" && path == ODOH_CONFIGS_PATH:
+		// the configs are fetched by proxy too, or the target can see the address of client.
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if host == "" || path == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if !proxy.Allowed(host) {
+		logger.Info(ErrODoHTarget.Error())
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	b, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	u := &url.URL{Scheme: "https", Host: host, Path: path}
+	logger.Infof("odoh proxy to %s", u.String())
+	preq, err := http.NewRequestWithContext(req.Context(), req.Method, u.String(), bytes.NewReader(b))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if req.Method == "POST" {
+		preq.Header.Add("Accept", ODOH_CONTENT_TYPE)
+		preq.Header.Add("Content-Type", ODOH_CONTENT_TYPE)
+	}
+
+	resp, err := proxy.transport.RoundTrip(preq)
+	if err != nil {
+		logger.Error(err.Error())
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	bresp, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		logger.Error(err.Error())
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	// pass the status of target, the client needs 401 to refresh its config.
+	if ctype := resp.Header.Get("Content-Type"); ctype != "" {
+		w.Header().Add("Content-Type", ctype)
+	}
+	w.Header().Add("Cache-Control", "no-cache, max-age=0")
+	w.WriteHeader(resp.StatusCode)
+	err = WriteFull(w, bresp)
+	if err != nil {
+		logger.Error(err.Error())
+	}
+}
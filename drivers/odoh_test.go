@@ -0,0 +1,170 @@
+package drivers
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// StartTestODoH starts a target, and a proxy allowing the target only.
+func StartTestODoH(t *testing.T, upstream Client) (target, proxy *httptest.Server, p *ODoHProxy) {
+	srv := NewDoHServer(upstream, "https://127.0.0.1:0", []byte(`{"odoh-target": true}`))
+	target = httptest.NewTLSServer(srv.mux)
+	t.Cleanup(target.Close)
+
+	u, _ := url.Parse(target.URL)
+	srv = NewDoHServer(upstream, "https://127.0.0.1:0", []byte(`{"odoh-proxy": true, "odoh-targets": ["`+u.Host+`"]}`))
+	proxy = httptest.NewTLSServer(srv.mux)
+	t.Cleanup(proxy.Close)
+	h, _ := srv.mux.Handler(httptest.NewRequest("POST", "/proxy", nil))
+	p = h.(*ODoHProxy)
+	p.transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	return
+}
+
+func TestODoH(t *testing.T) {
+	upstream := &StaticClient{Records: []string{"www.example.com. 300 IN A 192.0.2.1"}}
+	target, proxy, _ := StartTestODoH(t, upstream)
+
+	cli := NewODoHClient(target.URL+"/dns-query", []byte(`{"insecure": true, "proxy": "`+proxy.URL+`/proxy"}`))
+	quiz := &dns.Msg{}
+	quiz.SetQuestion("www.example.com.", dns.TypeA)
+	ans, err := cli.Exchange(context.Background(), quiz)
+	if err != nil {
+		t.Fatalf("exchange failed: %s", err)
+	}
+	if ans.Id != quiz.Id || len(ans.Answer) != 1 {
+		t.Fatalf("wrong answer: %s", ans)
+	}
+
+	// a rotated key makes the target return 401, and the client fetches the new config.
+	cli.config = &ODoHConfig{KEM: ODoHKEM, KDF: ODoHKDF, AEAD: ODoHAEAD, PublicKey: NewODoHTarget(upstream, "").config.PublicKey}
+	_, err = cli.Exchange(context.Background(), quiz)
+	if err == nil || cli.config != nil {
+		t.Fatalf("stale config should be dropped: %v", err)
+	}
+	_, err = cli.Exchange(context.Background(), quiz)
+	if err != nil {
+		t.Fatalf("exchange failed: %s", err)
+	}
+
+	// rfc8484 still works in the same path.
+	rfc := NewRfc8484Client(target.URL+"/dns-query", []byte(`{"insecure": true}`))
+	ans, err = rfc.Exchange(context.Background(), quiz)
+	if err != nil || len(ans.Answer) != 1 {
+		t.Fatalf("rfc8484 exchange failed: %v", err)
+	}
+}
+
+func TestODoHProxyTargets(t *testing.T) {
+	upstream := &StaticClient{Records: []string{"www.example.com. 300 IN A 192.0.2.1"}}
+	target, proxy, p := StartTestODoH(t, upstream)
+	p.targets = []string{"odoh.example.com"}
+
+	cli := NewODoHClient(target.URL+"/dns-query", []byte(`{"insecure": true, "proxy": "`+proxy.URL+`/proxy"}`))
+	u, _ := url.Parse(cli.QueryURL(cli.target.Path))
+	if u.Query().Get("targethost") != cli.target.Host || u.Query().Get("targetpath") != "/dns-query" {
+		t.Fatalf("wrong query url: %s", u)
+	}
+
+	quiz := &dns.Msg{}
+	quiz.SetQuestion("www.example.com.", dns.TypeA)
+	_, err := cli.Exchange(context.Background(), quiz)
+	if err == nil {
+		t.Fatalf("target not in list should be forbidden")
+	}
+}
+
+func TestODoHConfigByProxy(t *testing.T) {
+	upstream := &StaticClient{Records: []string{"www.example.com. 300 IN A 192.0.2.1"}}
+	target, proxy, p := StartTestODoH(t, upstream)
+
+	// the target can only be reached by proxy.
+	p.targets = []string{"odoh.test"}
+	p.transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, network, target.Listener.Addr().String())
+	}
+
+	cli := NewODoHClient("odoh://odoh.test", []byte(`{"insecure": true, "proxy": "`+proxy.URL+`/proxy"}`))
+	quiz := &dns.Msg{}
+	quiz.SetQuestion("www.example.com.", dns.TypeA)
+	ans, err := cli.Exchange(context.Background(), quiz)
+	if err != nil {
+		t.Fatalf("exchange failed: %s", err)
+	}
+	if len(ans.Answer) != 1 || cli.config == nil {
+		t.Fatalf("wrong answer: %s", ans)
+	}
+}
+
+func TestODoHStaticConfig(t *testing.T) {
+	upstream := &StaticClient{Records: []string{"www.example.com. 300 IN A 192.0.2.1"}}
+	target, proxy, _ := StartTestODoH(t, upstream)
+
+	resp, err := target.Client().Get(target.URL + ODOH_CONFIGS_PATH)
+	if err != nil {
+		t.Fatalf("get configs failed: %s", err)
+	}
+	b, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	cli := NewODoHClient(target.URL, []byte(`{"insecure": true, "proxy": "`+proxy.URL+`/proxy", "odoh-config": "`+base64.StdEncoding.EncodeToString(b)+`"}`))
+	quiz := &dns.Msg{}
+	quiz.SetQuestion("www.example.com.", dns.TypeA)
+	ans, err := cli.Exchange(context.Background(), quiz)
+	if err != nil {
+		t.Fatalf("exchange failed: %s", err)
+	}
+	if len(ans.Answer) != 1 || cli.config != nil {
+		t.Fatalf("configs should not be fetched: %s", ans)
+	}
+}
+
+func TestODoHProxyAllowed(t *testing.T) {
+	if NewODoHProxy(nil).Allowed("odoh.example.com") {
+		t.Fatalf("proxy without targets should deny all")
+	}
+	proxy := NewODoHProxy([]string{"odoh.example.com", "127.0.0.1:8443"})
+	for _, c := range []struct {
+		host    string
+		allowed bool
+	}{
+		{"odoh.example.com", true},
+		{"ODoH.Example.com", true},
+		{"odoh.example.com:8443", false},
+		{"www.odoh.example.com", false},
+		{"127.0.0.1:8443", true},
+		{"127.0.0.1", false},
+		{"[::1]:8443", false},
+	} {
+		if proxy.Allowed(c.host) != c.allowed {
+			t.Fatalf("wrong allowed of %s", c.host)
+		}
+	}
+}
+
+func TestODoHConfigs(t *testing.T) {
+	seed := "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
+	target := NewODoHTarget(nil, seed)
+	b := MarshalODoHConfigs([]*ODoHConfig{target.config})
+	cfgs, err := ParseODoHConfigs(b)
+	if err != nil || len(cfgs) != 1 || !cfgs[0].Supported() {
+		t.Fatalf("parse configs failed: %v", err)
+	}
+	if !bytes.Equal(cfgs[0].KeyId(), target.keyid) || !bytes.Equal(NewODoHTarget(nil, seed).keyid, target.keyid) {
+		t.Fatalf("key id should be derived from seed")
+	}
+
+	plain := PadODoHPlaintext([]byte{1, 2, 3})
+	if len(plain)%ODOH_PADDING_BLOCK != 0 {
+		t.Fatalf("wrong padding length: %d", len(plain))
+	}
+}
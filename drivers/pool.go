@@ -0,0 +1,320 @@
+package drivers
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	POOL_IDLE_TIMEOUT     = 10 * time.Second
+	POOL_EXCHANGE_TIMEOUT = 2 * time.Second
+	POOL_MAX_CONNS        = 2
+	POOL_MAX_PENDING      = 64
+)
+
+var (
+	ErrConnClosed      = errors.New("connection closed")
+	ErrConnIdle        = errors.New("connection idle")
+	ErrAnswerMismatch  = errors.New("answer doesn't match question")
+	ErrTooManyPendings = errors.New("too many pending queries")
+)
+
+// PipeConn sends queries without waiting for the answers, and matches the answers by id, RFC 7766 6.2.1.1.
+type PipeConn struct {
+	conn    *dns.Conn
+	wmu     sync.Mutex
+	mu      sync.Mutex
+	pending map[uint16]chan *dns.Msg
+	idle    time.Duration
+	timer   *time.Timer
+	err     error
+}
+
+func NewPipeConn(conn *dns.Conn, idle time.Duration) (pc *PipeConn) {
+	pc = &PipeConn{
+		conn:    conn,
+		pending: make(map[uint16]chan *dns.Msg),
+		idle:    idle,
+	}
+	pc.timer = time.AfterFunc(idle, pc.expire)
+	go pc.readLoop()
+	return
+}
+
+func (pc *PipeConn) Pending() int {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	return len(pc.pending)
+}
+
+func (pc *PipeConn) Alive() bool {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	return pc.err == nil
+}
+
+func (pc *PipeConn) expire() {
+	pc.mu.Lock()
+	busy := len(pc.pending) > 0
+	pc.mu.Unlock()
+	if !busy {
+		pc.Close(ErrConnIdle)
+	}
+}
+
+// Close fails all the pending queries with err.
+func (pc *PipeConn) Close(err error) {
+	pc.mu.Lock()
+	if pc.err != nil {
+		pc.mu.Unlock()
+		return
+	}
+	pc.err = err
+	for id, ch := range pc.pending {
+		close(ch)
+		delete(pc.pending, id)
+	}
+	pc.mu.Unlock()
+
+	pc.timer.Stop()
+	pc.conn.Close()
+	logger.Debugf("pipeline connection closed: %s", err.Error())
+}
+
+// release removes the pending id, and starts the idle timer if nothing is pending. must be called with lock.
+func (pc *PipeConn) release(id uint16) {
+	delete(pc.pending, id)
+	if len(pc.pending) == 0 && pc.err == nil {
+		pc.timer.Reset(pc.idle)
+	}
+}
+
+func (pc *PipeConn) readLoop() {
+	for {
+		ans, err := pc.conn.ReadMsg()
+		if err != nil {
+			pc.Close(err)
+			return
+		}
+
+		pc.mu.Lock()
+		// the server tells how long it will keep the connection, RFC 7828 3.3.2.
+		if opt := ans.IsEdns0(); opt != nil {
+			for _, o := range opt.Option {
+				if ka, ok := o.(*dns.EDNS0_TCP_KEEPALIVE); ok && ka.Timeout != 0 {
+					pc.idle = min(pc.idle, time.Duration(ka.Timeout)*100*time.Millisecond)
+				}
+			}
+		}
+		ch, ok := pc.pending[ans.Id]
+		if ok {
+			pc.release(ans.Id)
+		}
+		pc.mu.Unlock()
+
+		if !ok {
+			logger.Infof("unexpected answer id %d", ans.Id)
+			continue
+		}
+		ch <- ans
+	}
+}
+
+// newId returns a random id not in pending. must be called with lock.
+func (pc *PipeConn) newId() (id uint16) {
+	for {
+		id = uint16(rand.Intn(0x10000))
+		if _, ok := pc.pending[id]; !ok {
+			return
+		}
+	}
+}
+
+func (pc *PipeConn) Exchange(ctx context.Context, quiz *dns.Msg) (ans *dns.Msg, err error) {
+	// the answer may never come, wait as long as dns.Client by default.
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, POOL_EXCHANGE_TIMEOUT)
+		defer cancel()
+	}
+
+	ch := make(chan *dns.Msg, 1)
+	pc.mu.Lock()
+	if pc.err != nil {
+		pc.mu.Unlock()
+		return nil, ErrConnClosed
+	}
+	if len(pc.pending) >= 0xffff {
+		pc.mu.Unlock()
+		return nil, ErrTooManyPendings
+	}
+	id := pc.newId()
+	pc.pending[id] = ch
+	pc.timer.Stop()
+	pc.mu.Unlock()
+
+	req := quiz.Copy()
+	req.Id = id
+	StripKeepalive(req)
+	if opt := req.IsEdns0(); opt != nil {
+		opt.Option = append(opt.Option, &dns.EDNS0_TCP_KEEPALIVE{Code: dns.EDNS0TCPKEEPALIVE})
+	}
+
+	pc.wmu.Lock()
+	if deadline, ok := ctx.Deadline(); ok {
+		pc.conn.SetWriteDeadline(deadline)
+	}
+	err = pc.conn.WriteMsg(req)
+	pc.wmu.Unlock()
+	if err != nil {
+		pc.Close(err)
+		return
+	}
+
+	select {
+	case ans, ok := <-ch:
+		if !ok {
+			return nil, ErrConnClosed
+		}
+		if len(ans.Question) != len(req.Question) || len(ans.Question) > 0 && !EqualName(ans.Question[0].Name, req.Question[0].Name) {
+			return nil, ErrAnswerMismatch
+		}
+		ans.Id = quiz.Id
+		StripKeepalive(ans)
+		return ans, nil
+
+	case <-ctx.Done():
+		// the idle timer starts again if nothing is pending.
+		pc.mu.Lock()
+		if _, ok := pc.pending[id]; ok {
+			pc.release(id)
+		}
+		pc.mu.Unlock()
+		return nil, ctx.Err()
+	}
+}
+
+// StripKeepalive removes the keepalive option in answer, it's for the connection, not the client.
+func StripKeepalive(ans *dns.Msg) {
+	opt := ans.IsEdns0()
+	if opt == nil {
+		return
+	}
+	options := opt.Option[:0]
+	for _, o := range opt.Option {
+		if o.Option() != dns.EDNS0TCPKEEPALIVE {
+			options = append(options, o)
+		}
+	}
+	opt.Option = options
+}
+
+// ConnPool keeps a few pipeline connections, a new connection is made only when the others are busy.
+// One connection is dialed at a time, without lock, so a slow dial doesn't block the queries in other connections.
+type ConnPool struct {
+	dial     func(ctx context.Context) (*dns.Conn, error)
+	idle     time.Duration
+	maxConns int
+	mu       sync.Mutex
+	conns    []*PipeConn
+	dialing  chan struct{}
+}
+
+func NewConnPool(dial func(ctx context.Context) (*dns.Conn, error), idle time.Duration, maxConns int) (pool *ConnPool) {
+	if idle == 0 {
+		idle = POOL_IDLE_TIMEOUT
+	}
+	if maxConns == 0 {
+		maxConns = POOL_MAX_CONNS
+	}
+	return &ConnPool{
+		dial:     dial,
+		idle:     idle,
+		maxConns: maxConns,
+	}
+}
+
+func (pool *ConnPool) Get(ctx context.Context) (pc *PipeConn, err error) {
+	for {
+		pool.mu.Lock()
+		conns := pool.conns[:0]
+		for _, c := range pool.conns {
+			if c.Alive() {
+				conns = append(conns, c)
+			}
+		}
+		pool.conns = conns
+
+		var best *PipeConn
+		pending := 0
+		for _, c := range pool.conns {
+			if n := c.Pending(); best == nil || n < pending {
+				best, pending = c, n
+			}
+		}
+		if best != nil && (pending < POOL_MAX_PENDING || len(pool.conns) >= pool.maxConns || pool.dialing != nil) {
+			pool.mu.Unlock()
+			return best, nil
+		}
+
+		// nothing to use, wait for the connection being dialed, or dial one with lock held.
+		wait := pool.dialing
+		if wait == nil {
+			break
+		}
+		pool.mu.Unlock()
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	dialing := make(chan struct{})
+	pool.dialing = dialing
+	pool.mu.Unlock()
+
+	conn, err := pool.dial(ctx)
+
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	pool.dialing = nil
+	close(dialing)
+	if err != nil {
+		return
+	}
+	pc = NewPipeConn(conn, pool.idle)
+	pool.conns = append(pool.conns, pc)
+	return
+}
+
+func (pool *ConnPool) Exchange(ctx context.Context, quiz *dns.Msg) (ans *dns.Msg, err error) {
+	// the connection may be closed by the server for idle, try again with a new one.
+	for i := 0; i < 2; i++ {
+		var pc *PipeConn
+		pc, err = pool.Get(ctx)
+		if err != nil {
+			return
+		}
+		ans, err = pc.Exchange(ctx, quiz)
+		if err == nil || ctx.Err() != nil || pc.Alive() {
+			return
+		}
+		logger.Info(err.Error())
+	}
+	return
+}
+
+func (pool *ConnPool) Close() {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	for _, c := range pool.conns {
+		c.Close(ErrConnClosed)
+	}
+	pool.conns = nil
+}
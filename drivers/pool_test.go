@@ -0,0 +1,251 @@
+package drivers
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// StartTestPipeline serves tcp by handler, and counts the connections.
+func StartTestPipeline(t *testing.T, handler func(conn *dns.Conn)) (URL string, accepted *atomic.Int32) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %s", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	accepted = &atomic.Int32{}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			accepted.Add(1)
+			go func() {
+				defer conn.Close()
+				handler(&dns.Conn{Conn: conn})
+			}()
+		}
+	}()
+	return "tcp://" + ln.Addr().String(), accepted
+}
+
+func KeepaliveAnswer(quiz *dns.Msg, keepalive uint16) (ans *dns.Msg) {
+	ans = &dns.Msg{}
+	ans.SetReply(quiz)
+	rr, _ := dns.NewRR(quiz.Question[0].Name + " 300 IN A 192.0.2.1")
+	ans.Answer = append(ans.Answer, rr)
+	if opt := quiz.IsEdns0(); opt != nil {
+		ans.SetEdns0(opt.UDPSize(), false)
+		ans.IsEdns0().Option = append(ans.IsEdns0().Option,
+			&dns.EDNS0_TCP_KEEPALIVE{Code: dns.EDNS0TCPKEEPALIVE, Timeout: keepalive})
+	}
+	return
+}
+
+func TestPipelineOutOfOrder(t *testing.T) {
+	// answer three queries in reversed order.
+	URL, accepted := StartTestPipeline(t, func(conn *dns.Conn) {
+		var quizs []*dns.Msg
+		for len(quizs) < 3 {
+			quiz, err := conn.ReadMsg()
+			if err != nil {
+				return
+			}
+			quizs = append(quizs, quiz)
+		}
+		for i := len(quizs) - 1; i >= 0; i-- {
+			conn.WriteMsg(KeepaliveAnswer(quizs[i], 0))
+		}
+		conn.ReadMsg()
+	})
+
+	cli := NewDnsClient(URL, []byte(`{"timeout": 2000}`))
+	var wg sync.WaitGroup
+	for _, name := range []string{"a.example.com.", "b.example.com.", "c.example.com."} {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			quiz := &dns.Msg{}
+			quiz.SetQuestion(name, dns.TypeA)
+			quiz.SetEdns0(4096, false)
+			ans, err := cli.Exchange(context.Background(), quiz)
+			if err != nil {
+				t.Errorf("exchange failed: %s", err)
+				return
+			}
+			if ans.Id != quiz.Id || ans.Answer[0].Header().Name != name {
+				t.Errorf("wrong answer for %s: %s", name, ans)
+			}
+			if len(ans.IsEdns0().Option) != 0 {
+				t.Errorf("keepalive should be stripped: %s", ans)
+			}
+		}(name)
+	}
+	wg.Wait()
+
+	if accepted.Load() != 1 {
+		t.Fatalf("queries should be in one connection: %d", accepted.Load())
+	}
+}
+
+func TestPipelineKeepalive(t *testing.T) {
+	var keepalive atomic.Bool
+	URL, accepted := StartTestPipeline(t, func(conn *dns.Conn) {
+		for {
+			quiz, err := conn.ReadMsg()
+			if err != nil {
+				return
+			}
+			for _, o := range quiz.IsEdns0().Option {
+				if o.Option() == dns.EDNS0TCPKEEPALIVE {
+					keepalive.Store(true)
+				}
+			}
+			conn.WriteMsg(KeepaliveAnswer(quiz, 1))
+		}
+	})
+
+	cli := NewDnsClient(URL, []byte(`{"timeout": 2000}`))
+	quiz := &dns.Msg{}
+	quiz.SetQuestion("www.example.com.", dns.TypeA)
+	quiz.SetEdns0(4096, false)
+	for i := 0; i < 2; i++ {
+		_, err := cli.Exchange(context.Background(), quiz)
+		if err != nil {
+			t.Fatalf("exchange failed: %s", err)
+		}
+	}
+	if !keepalive.Load() || accepted.Load() != 1 {
+		t.Fatalf("connection should be reused with keepalive: %d", accepted.Load())
+	}
+
+	// the server asked for 100ms idle timeout.
+	time.Sleep(300 * time.Millisecond)
+	if len(cli.pool.conns) != 1 || cli.pool.conns[0].Alive() {
+		t.Fatalf("idle connection should be closed")
+	}
+	_, err := cli.Exchange(context.Background(), quiz)
+	if err != nil || accepted.Load() != 2 {
+		t.Fatalf("new connection should be made: %v", err)
+	}
+}
+
+func TestPipelineServerClose(t *testing.T) {
+	// close the connection after each answer.
+	URL, accepted := StartTestPipeline(t, func(conn *dns.Conn) {
+		quiz, err := conn.ReadMsg()
+		if err != nil {
+			return
+		}
+		conn.WriteMsg(KeepaliveAnswer(quiz, 0))
+	})
+
+	cli := NewDnsClient(URL, []byte(`{"timeout": 2000}`))
+	quiz := &dns.Msg{}
+	quiz.SetQuestion("www.example.com.", dns.TypeA)
+	for i := 0; i < 3; i++ {
+		_, err := cli.Exchange(context.Background(), quiz)
+		if err != nil {
+			t.Fatalf("exchange failed: %s", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if accepted.Load() != 3 {
+		t.Fatalf("closed connection should be replaced: %d", accepted.Load())
+	}
+}
+
+func TestPipelineNoAnswer(t *testing.T) {
+	// read the queries but never answer.
+	URL, _ := StartTestPipeline(t, func(conn *dns.Conn) {
+		for {
+			if _, err := conn.ReadMsg(); err != nil {
+				return
+			}
+		}
+	})
+
+	cli := NewDnsClient(URL, []byte(`{"idle-timeout": 100}`))
+	quiz := &dns.Msg{}
+	quiz.SetQuestion("www.example.com.", dns.TypeA)
+	begin := time.Now()
+	_, err := cli.Exchange(context.Background(), quiz)
+	if !errors.Is(err, context.DeadlineExceeded) || time.Since(begin) > 2*POOL_EXCHANGE_TIMEOUT {
+		t.Fatalf("query without answer should time out: %v", err)
+	}
+
+	pc := cli.pool.conns[0]
+	if pc.Pending() != 0 {
+		t.Fatalf("timed out query should not be pending")
+	}
+	time.Sleep(200 * time.Millisecond)
+	if pc.Alive() {
+		t.Fatalf("idle connection should be closed after timeout")
+	}
+}
+
+func TestPoolSlowDial(t *testing.T) {
+	URL, _ := StartTestPipeline(t, func(conn *dns.Conn) {
+		for {
+			quiz, err := conn.ReadMsg()
+			if err != nil {
+				return
+			}
+			conn.WriteMsg(KeepaliveAnswer(quiz, 0))
+		}
+	})
+	addr := URL[len("tcp://"):]
+
+	// the first dial hangs until its caller gives up.
+	var dials atomic.Int32
+	pool := NewConnPool(func(ctx context.Context) (*dns.Conn, error) {
+		if dials.Add(1) == 1 {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		return &dns.Conn{Conn: conn}, nil
+	}, 0, 0)
+	defer pool.Close()
+
+	slow, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		_, err := pool.Get(slow)
+		done <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	// the other query waits by its own deadline, not blocked by the lock.
+	ctx, cancel2 := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel2()
+	begin := time.Now()
+	_, err := pool.Get(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) || time.Since(begin) > 200*time.Millisecond {
+		t.Fatalf("query should give up by its own deadline: %s %v", time.Since(begin), err)
+	}
+
+	// a new connection is dialed after the slow one failed.
+	if err = <-done; err == nil {
+		t.Fatalf("slow dial should fail")
+	}
+	quiz := &dns.Msg{}
+	quiz.SetQuestion("www.example.com.", dns.TypeA)
+	_, err = pool.Exchange(context.Background(), quiz)
+	if err != nil || dials.Load() != 2 {
+		t.Fatalf("exchange failed: %d %v", dials.Load(), err)
+	}
+}
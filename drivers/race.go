@@ -0,0 +1,189 @@
+package drivers
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	RACE_FAIL_RTT       = time.Second
+	RACE_MAX_RTT        = 10 * time.Second
+	RACE_PROBE_INTERVAL = 16
+)
+
+// RaceClient sends the quiz to clients concurrently, and returns the first valid answer.
+type RaceClient struct {
+	Clients  []json.RawMessage
+	Parallel int `json:"parallel"`
+	Stagger  int `json:"stagger"`
+	clis     []Client
+	mu       sync.Mutex
+	rtts     []time.Duration
+	count    int
+}
+
+type raceResult struct {
+	idx int
+	ans *dns.Msg
+	err error
+	rtt time.Duration
+}
+
+func NewRaceClient(URL string, body json.RawMessage) (cli *RaceClient) {
+	var err error
+	cli = &RaceClient{}
+	if body != nil {
+		err = json.Unmarshal(body, &cli)
+		if err != nil {
+			panic(err.Error())
+		}
+	}
+
+	var header DriverHeader
+	for _, cfg := range cli.Clients {
+		header = DriverHeader{}
+		err = json.Unmarshal(cfg, &header)
+		if err != nil {
+			panic(err.Error())
+		}
+		cli.clis = append(cli.clis, header.CreateClient(cfg))
+	}
+	if len(cli.clis) == 0 {
+		panic(ErrEmptyClients.Error())
+	}
+	cli.rtts = make([]time.Duration, len(cli.clis))
+
+	return
+}
+
+func (cli *RaceClient) Url() (u string) {
+	var urls []string
+	for _, c := range cli.clis {
+		urls = append(urls, c.Url())
+	}
+	return strings.Join(urls, "|")
+}
+
+// Ranked returns the index of clients to race, the fastest first.
+// Only the best parallel ones are used, except all of them are probed once in a while.
+func (cli *RaceClient) Ranked() (order []int) {
+	cli.mu.Lock()
+	defer cli.mu.Unlock()
+
+	for i := range cli.clis {
+		order = append(order, i)
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return cli.rtts[order[i]] < cli.rtts[order[j]]
+	})
+
+	cli.count++
+	if cli.Parallel > 0 && cli.Parallel < len(order) && cli.count%RACE_PROBE_INTERVAL != 0 {
+		order = order[:cli.Parallel]
+	}
+	return
+}
+
+// update smooths the rtt of client as TCP does. The failed one is penalized, and the loser is at least as slow as elapsed.
+func (cli *RaceClient) update(idx int, rtt time.Duration, failed, lost bool) {
+	cli.mu.Lock()
+	defer cli.mu.Unlock()
+
+	cur := cli.rtts[idx]
+	switch {
+	case lost:
+		cur = max(cur, rtt)
+	case failed:
+		cur = max(2*cur, RACE_FAIL_RTT)
+	case cur == 0:
+		cur = rtt
+	default:
+		cur = (7*cur + rtt) / 8
+	}
+	cli.rtts[idx] = min(cur, RACE_MAX_RTT)
+}
+
+// ValidAnswer means the answer can be trusted, not a failure of the server.
+func ValidAnswer(ans *dns.Msg) bool {
+	return ans.Rcode != dns.RcodeServerFailure && ans.Rcode != dns.RcodeRefused
+}
+
+func (cli *RaceClient) Exchange(ctx context.Context, quiz *dns.Msg) (ans *dns.Msg, err error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	order := cli.Ranked()
+	results := make(chan *raceResult, len(order))
+	started := make(map[int]time.Time)
+	next := 0
+	launch := func() {
+		idx := order[next]
+		next++
+		started[idx] = time.Now()
+		go func() {
+			begin := time.Now()
+			ans, err := cli.clis[idx].Exchange(ctx, quiz)
+			results <- &raceResult{idx: idx, ans: ans, err: err, rtt: time.Since(begin)}
+		}()
+	}
+
+	// the losers are still running when we return.
+	defer func() {
+		for idx, begin := range started {
+			cli.update(idx, time.Since(begin), false, true)
+		}
+	}()
+
+	stagger := time.Duration(cli.Stagger) * time.Millisecond
+	timer := time.NewTimer(stagger)
+	defer timer.Stop()
+
+	var last *raceResult
+	for len(started) > 0 || next < len(order) {
+		if next < len(order) && (stagger == 0 || len(started) == 0) {
+			launch()
+			timer.Reset(stagger)
+			continue
+		}
+		var tick <-chan time.Time
+		if next < len(order) {
+			tick = timer.C
+		}
+
+		select {
+		case r := <-results:
+			delete(started, r.idx)
+			valid := r.err == nil && ValidAnswer(r.ans)
+			cli.update(r.idx, r.rtt, !valid, false)
+			if valid {
+				return r.ans, nil
+			}
+			if r.err != nil {
+				logger.Info(r.err.Error())
+			}
+			// the answer of failure is better than an error.
+			if last == nil || last.err != nil {
+				last = r
+			}
+			// a failure starts the next one at once.
+			if next < len(order) {
+				launch()
+				timer.Reset(stagger)
+			}
+
+		case <-tick:
+			launch()
+			timer.Reset(stagger)
+
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	return last.ans, last.err
+}
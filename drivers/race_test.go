@@ -0,0 +1,122 @@
+package drivers
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// DelayClient answers by upstream after delay, or fails if it's cancelled.
+type DelayClient struct {
+	upstream  Client
+	Delay     time.Duration
+	Cancelled atomic.Int32
+}
+
+func (cli *DelayClient) Url() (u string) {
+	return "delay://"
+}
+
+func (cli *DelayClient) Exchange(ctx context.Context, quiz *dns.Msg) (ans *dns.Msg, err error) {
+	select {
+	case <-time.After(cli.Delay):
+		return cli.upstream.Exchange(ctx, quiz)
+	case <-ctx.Done():
+		cli.Cancelled.Add(1)
+		return nil, ctx.Err()
+	}
+}
+
+func NewTestRace(body string, clis ...Client) (cli *RaceClient) {
+	cli = NewRaceClient("", []byte(body))
+	cli.clis = clis
+	cli.rtts = make([]time.Duration, len(clis))
+	return
+}
+
+func TestRace(t *testing.T) {
+	answer := &StaticClient{Records: []string{"www.example.com. 300 IN A 192.0.2.1"}}
+	failed := &StaticClient{Err: errors.New("failed")}
+	servfail := &StaticClient{Rcode: dns.RcodeServerFailure}
+	slow := &DelayClient{upstream: answer, Delay: 100 * time.Millisecond}
+
+	quiz := &dns.Msg{}
+	quiz.SetQuestion("www.example.com.", dns.TypeA)
+	for _, c := range []struct {
+		clis []Client
+		ok   bool
+	}{
+		{[]Client{slow, answer}, true},
+		{[]Client{failed, slow}, true},
+		{[]Client{servfail, slow}, true},
+		{[]Client{failed, servfail}, false},
+	} {
+		cli := NewTestRace(`{"clients": [{"url": "udp://127.0.0.1"}]}`, c.clis...)
+		ans, err := cli.Exchange(context.Background(), quiz)
+		if c.ok && (err != nil || len(ans.Answer) != 1) {
+			t.Fatalf("wrong answer: %s %v", ans, err)
+		}
+		if !c.ok && (err != nil || ans.Rcode != dns.RcodeServerFailure) {
+			t.Fatalf("the answer of failure should be returned: %s %v", ans, err)
+		}
+	}
+
+	// the slow one is cancelled after the fast one answered.
+	time.Sleep(10 * time.Millisecond)
+	if slow.Cancelled.Load() != 1 {
+		t.Fatalf("the loser should be cancelled: %d", slow.Cancelled.Load())
+	}
+}
+
+func TestRaceStagger(t *testing.T) {
+	first := &DelayClient{upstream: &StaticClient{Records: []string{"www.example.com. 300 IN A 192.0.2.1"}}, Delay: 20 * time.Millisecond}
+	second := &StaticClient{Records: []string{"www.example.com. 300 IN A 192.0.2.2"}}
+	cli := NewTestRace(`{"clients": [{"url": "udp://127.0.0.1"}], "stagger": 100}`, first, second)
+
+	quiz := &dns.Msg{}
+	quiz.SetQuestion("www.example.com.", dns.TypeA)
+	ans, err := cli.Exchange(context.Background(), quiz)
+	if err != nil || ans.Answer[0].(*dns.A).A.String() != "192.0.2.1" || second.Count.Load() != 0 {
+		t.Fatalf("the second should not start before stagger: %s %v", ans, err)
+	}
+
+	// the second starts after stagger if the first is too slow.
+	first.Delay = time.Second
+	begin := time.Now()
+	ans, err = cli.Exchange(context.Background(), quiz)
+	if err != nil || ans.Answer[0].(*dns.A).A.String() != "192.0.2.2" || time.Since(begin) > 500*time.Millisecond {
+		t.Fatalf("the second should start after stagger: %s %v", ans, err)
+	}
+
+	// the second starts at once if the first failed.
+	cli = NewTestRace(`{"clients": [{"url": "udp://127.0.0.1"}], "stagger": 1000}`, &StaticClient{Err: errors.New("failed")}, second)
+	begin = time.Now()
+	_, err = cli.Exchange(context.Background(), quiz)
+	if err != nil || time.Since(begin) > 500*time.Millisecond {
+		t.Fatalf("the second should start after failure: %v", err)
+	}
+}
+
+func TestRaceParallel(t *testing.T) {
+	upstream := &StaticClient{Records: []string{"www.example.com. 300 IN A 192.0.2.1"}}
+	slow := &DelayClient{upstream: upstream, Delay: 50 * time.Millisecond}
+	fast := &StaticClient{Records: []string{"www.example.com. 300 IN A 192.0.2.1"}}
+	cli := NewTestRace(`{"clients": [{"url": "udp://127.0.0.1"}], "parallel": 1}`, slow, fast)
+
+	quiz := &dns.Msg{}
+	quiz.SetQuestion("www.example.com.", dns.TypeA)
+	for i := 0; i < RACE_PROBE_INTERVAL*2; i++ {
+		_, err := cli.Exchange(context.Background(), quiz)
+		if err != nil {
+			t.Fatalf("exchange failed: %s", err)
+		}
+	}
+	// the first query tries the slow one only, then the fast one is found by probing.
+	if fast.Count.Load() < RACE_PROBE_INTERVAL || slow.Cancelled.Load() > 2 {
+		t.Fatalf("the fast one should be preferred: %d %d", fast.Count.Load(), slow.Cancelled.Load())
+	}
+}
@@ -2,87 +2,189 @@ package drivers
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"math/rand"
-	"reflect"
+	"net"
+	"os"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/miekg/dns"
+	"github.com/shell909090/doh/rrtree"
+)
+
+const (
+	MAX_RECURSIVE_DEEP = 8
+	MAX_ITERATIONS     = 32
+	MAX_CNAME_CHAIN    = 16
+	MAX_MINIMISE_COUNT = 10
+	PRUNE_INTERVAL     = 60 * time.Second
+
+	DEFAULT_RECURSIVE_MAXTIME = 10000
 )
 
 var (
-	ErrUndeterminedNext = errors.New("can't determine next hop")
+	ErrUndeterminedNext  = errors.New("can't determine next hop")
+	ErrTooDeep           = errors.New("recursion too deep")
+	ErrLameDelegation    = errors.New("lame delegation")
+	ErrTooManyIterations = errors.New("too many iterations")
+	ErrCNAMELoop         = errors.New("cname loop detected")
+	ErrCNAMEChain        = errors.New("cname chain too long")
 )
 
 type RecursiveClient struct {
+	RootHints   string `json:"root-hints"`
+	IPv4        bool
+	IPv6        bool
+	Prefer      string
+	TCPFallback bool `json:"tcp-fallback"`
+	Timeout     int
+	MaxTime     int    `json:"max-time"`
+	QnameMin    bool   `json:"qname-minimisation"`
+	DNSSEC      bool   `json:"dnssec"`
+	TrustAnchor string `json:"trust-anchor"`
 	client      *dns.Client
-	Cache       map[string][]string
-	NameServers map[string][]string
+	tcpclient   *dns.Client
+	tree        *rrtree.RRTree
+	validator   *Validator
+	port        string
+	lastPrune   atomic.Int64
 }
 
-func NewRecursiveClient() (cli *RecursiveClient) {
+func NewRecursiveClient(URL string, body json.RawMessage) (cli *RecursiveClient) {
 	cli = &RecursiveClient{
-		client: &dns.Client{Net: "udp"},
-		Cache: map[string][]string{
-			"a.root-servers.net": []string{"198.41.0.4"},
-			"b.root-servers.net": []string{"199.9.14.201"},
-			"c.root-servers.net": []string{"192.33.4.12"},
-			"d.root-servers.net": []string{"199.7.91.13"},
-			"e.root-servers.net": []string{"192.203.230.10"},
-			"f.root-servers.net": []string{"192.5.5.241"},
-			"g.root-servers.net": []string{"192.112.36.4"},
-			"h.root-servers.net": []string{"198.97.190.53"},
-			"i.root-servers.net": []string{"192.36.148.17"},
-			"j.root-servers.net": []string{"192.58.128.30"},
-			"k.root-servers.net": []string{"193.0.14.129"},
-			"l.root-servers.net": []string{"199.7.83.42"},
-			"m.root-servers.net": []string{"202.12.27.33"},
-		},
-		NameServers: map[string][]string{
-			".": []string{
-				"a.root-servers.net", "b.root-servers.net", "c.root-servers.net", "d.root-servers.net",
-				"e.root-servers.net", "f.root-servers.net", "g.root-servers.net", "h.root-servers.net",
-				"i.root-servers.net", "j.root-servers.net", "k.root-servers.net", "l.root-servers.net",
-				"m.root-servers.net",
-			},
-		},
+		IPv4:        true,
+		IPv6:        true,
+		TCPFallback: true,
+		MaxTime:     DEFAULT_RECURSIVE_MAXTIME,
+		port:        "53",
+	}
+	if body != nil {
+		err := json.Unmarshal(body, &cli)
+		if err != nil {
+			panic(err.Error())
+		}
+	}
+
+	if Timeout != 0 {
+		cli.Timeout = Timeout
+	}
+	if !cli.IPv4 && !cli.IPv6 {
+		panic(ErrConfigParse.Error())
+	}
+
+	cli.client = &dns.Client{Net: "udp"}
+	cli.tcpclient = &dns.Client{Net: "tcp"}
+	if cli.Timeout != 0 {
+		cli.client.Timeout = time.Duration(cli.Timeout) * time.Millisecond
+		cli.tcpclient.Timeout = time.Duration(cli.Timeout) * time.Millisecond
 	}
 
+	if cli.RootHints == "" {
+		cli.tree = rrtree.NewRootTree()
+	} else {
+		var err error
+		cli.tree, err = ReadRootHintsFile(cli.RootHints)
+		if err != nil {
+			panic(err.Error())
+		}
+	}
+
+	if cli.DNSSEC {
+		anchors := DefaultTrustAnchors()
+		if cli.TrustAnchor != "" {
+			var err error
+			anchors, err = ReadTrustAnchorFile(cli.TrustAnchor)
+			if err != nil {
+				panic(err.Error())
+			}
+		}
+		cli.validator = NewValidator(cli.Resolve, anchors)
+	}
+
+	cli.lastPrune.Store(time.Now().UnixNano())
 	return
 }
 
-func (client *RecursiveClient) ReadSection(section []dns.RR) (err error) {
-	for _, rr := range section {
-		if v, ok := rr.(*dns.A); ok {
-			client.Cache[v.Hdr.Name] = append(client.Cache[v.Hdr.Name], v.A.String())
+func ReadRootHintsFile(filename string) (tree *rrtree.RRTree, err error) {
+	logger.Infof("load root hints from file %s.", filename)
+
+	file, err := os.Open(filename)
+	if err != nil {
+		logger.Error(err.Error())
+		return
+	}
+	defer file.Close()
+
+	tree = rrtree.NewRRTree()
+	count := 0
+	zp := dns.NewZoneParser(file, ".", filename)
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		switch rr.Header().Rrtype {
+		case dns.TypeNS, dns.TypeA, dns.TypeAAAA:
+			tree.AddHint(rr)
+			count++
 		}
 	}
+	err = zp.Err()
+	if err != nil {
+		logger.Error(err.Error())
+		return
+	}
+
+	if count == 0 {
+		err = ErrConfigParse
+		return
+	}
+	logger.Infof("root hints loaded %d record(s).", count)
 	return
 }
 
-func (client *RecursiveClient) AddNameServer(name, server string) {
-	client.NameServers[name] = append(client.NameServers[name], server)
+func (cli *RecursiveClient) Addresses(host string) (addrs []string) {
+	var addrs4, addrs6 []string
+	if cli.IPv4 {
+		for _, rr := range cli.tree.Get(host, dns.TypeA) {
+			addrs4 = append(addrs4, rr.(*dns.A).A.String())
+		}
+	}
+	if cli.IPv6 {
+		for _, rr := range cli.tree.Get(host, dns.TypeAAAA) {
+			addrs6 = append(addrs6, rr.(*dns.AAAA).AAAA.String())
+		}
+	}
+
+	switch cli.Prefer {
+	case "ipv4":
+		Shuffle(addrs4)
+		Shuffle(addrs6)
+		addrs = append(addrs4, addrs6...)
+	case "ipv6":
+		Shuffle(addrs4)
+		Shuffle(addrs6)
+		addrs = append(addrs6, addrs4...)
+	default:
+		addrs = append(addrs4, addrs6...)
+		Shuffle(addrs)
+	}
 	return
 }
 
-func (client *RecursiveClient) SetNameServer(name, server string) {
-	client.NameServers[name] = nil
-	client.NameServers[name] = append(client.NameServers[name], server)
-	return
+func Shuffle[T any](s []T) {
+	rand.Shuffle(len(s), func(i, j int) {
+		s[i], s[j] = s[j], s[i]
+	})
 }
 
-func (client *RecursiveClient) MatchNameServers(domain string) (suffix string, servers []string) {
-	length := 0
-	for name, srv := range client.NameServers {
-		if !strings.HasSuffix(domain, name) {
-			continue
-		}
-		if len(name) > length {
-			suffix = name
-			servers = srv
-			length = len(name)
-		}
+func (cli *RecursiveClient) Prune() {
+	now := time.Now().UnixNano()
+	last := cli.lastPrune.Load()
+	if now-last < int64(PRUNE_INTERVAL) || !cli.lastPrune.CompareAndSwap(last, now) {
+		return
 	}
+	count := cli.tree.Prune()
+	logger.Debugf("%d expired records pruned.", count)
 	return
 }
 
@@ -91,75 +193,166 @@ func (cli *RecursiveClient) Url() (u string) {
 }
 
 func (cli *RecursiveClient) Exchange(ctx context.Context, quiz *dns.Msg) (ans *dns.Msg, err error) {
+	// the timeout is for each query, the whole resolution and validation is limited by max-time.
+	if cli.MaxTime != 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(cli.MaxTime)*time.Millisecond)
+		defer cancel()
+	}
+	ans, err = cli.Resolve(ctx, quiz)
+	if err != nil || cli.validator == nil || quiz.CheckingDisabled {
+		return
+	}
+
+	secure, err := cli.validator.Validate(ctx, ans)
+	if err != nil {
+		logger.Infof("validate %s failed: %s", quiz.Question[0].Name, err.Error())
+		return ServFail(quiz, ValidateErrorCode(err), err.Error()), nil
+	}
+	ans.AuthenticatedData = secure
+	return
+}
+
+// Resolve answers the quiz without validation.
+func (cli *RecursiveClient) Resolve(ctx context.Context, quiz *dns.Msg) (ans *dns.Msg, err error) {
+	cli.Prune()
 	query := NewRecursiveQuery(ctx, cli, quiz)
 	err = query.Procedure()
 	if err != nil {
-		return
+		logger.Infof("recursive query %s failed: %s", quiz.Question[0].Name, err.Error())
+		return ServFail(quiz, RecursiveErrorCode(err), err.Error()), nil
 	}
 	ans = query.ans
 	return
 }
 
+func RecursiveErrorCode(err error) (code uint16) {
+	var nerr net.Error
+	switch {
+	case errors.As(err, &nerr), errors.Is(err, ErrLameDelegation), errors.Is(err, ErrUndeterminedNext):
+		code = dns.ExtendedErrorCodeNoReachableAuthority
+	default:
+		code = dns.ExtendedErrorCodeOther
+	}
+	return
+}
+
 type RecursiveQuery struct {
-	client  *RecursiveClient
-	ctx     context.Context
-	deep    int
-	quiz    *dns.Msg
-	ans     *dns.Msg
-	current string
+	client    *RecursiveClient
+	ctx       context.Context
+	deep      int
+	quiz      *dns.Msg
+	ans       *dns.Msg
+	zone      string
+	current   string
+	chain     map[string]bool
+	extra     int
+	minimised bool
 }
 
 func NewRecursiveQuery(ctx context.Context, client *RecursiveClient, quiz *dns.Msg) (query *RecursiveQuery) {
 	query = &RecursiveQuery{
 		client: client,
 		ctx:    ctx,
-		quiz:   quiz.Copy(),
+		quiz:   &dns.Msg{},
 		ans:    &dns.Msg{},
+		chain:  map[string]bool{dns.CanonicalName(quiz.Question[0].Name): true},
 	}
+	// the edns options of client are not sent to authorities, and only one OPT is allowed, RFC 6891 6.1.1.
+	query.quiz.SetQuestion(quiz.Question[0].Name, quiz.Question[0].Qtype)
+	query.quiz.Question[0].Qclass = quiz.Question[0].Qclass
 	query.quiz.MsgHdr.RecursionDesired = false
-	query.quiz.SetEdns0(4096, true)
-	query.ans.SetReply(query.quiz)
+	query.quiz.CheckingDisabled = quiz.CheckingDisabled
+	opt := quiz.IsEdns0()
+	query.quiz.SetEdns0(4096, client.validator != nil || opt != nil && opt.Do())
+	query.ans.SetReply(quiz)
+	query.ans.RecursionAvailable = true
 	return
 }
 
 func (query *RecursiveQuery) SelectServer() (host, addr string, err error) {
 	question := query.quiz.Question[0]
-	suffix, servers := query.client.MatchNameServers(question.Name)
-	logger.Infof("%d %s match %s in ns cache.", query.deep, question.Name, suffix)
-
-	host = servers[rand.Intn(len(servers))]
-
-	addrs, ok := query.client.Cache[host]
-	if ok {
-		addr = addrs[rand.Intn(len(addrs))]
+	name := question.Name
+	if question.Qtype == dns.TypeDS {
+		// DS is served by the parent zone.
+		name = ParentName(name)
+	}
+	zone, servers := query.client.tree.Closest(name, dns.TypeNS)
+	if len(servers) == 0 {
+		err = ErrUndeterminedNext
 		return
 	}
+	query.zone = zone
+	logger.Infof("%d %s match %s in ns cache.", query.deep, question.Name, zone)
+
+	Shuffle(servers)
+	for _, rr := range servers {
+		host = rr.(*dns.NS).Ns
+		if addrs := query.client.Addresses(host); len(addrs) != 0 {
+			addr = addrs[0]
+			return
+		}
+	}
 
-	logger.Infof("%d query A record for host %s", query.deep, host)
-
-	quiz := &dns.Msg{}
-	quiz.SetQuestion(host, dns.TypeA)
-	quiz.SetEdns0(4096, true)
-
-	rquery := NewRecursiveQuery(query.ctx, query.client, quiz)
-	rquery.deep = query.deep + 1
-	err = rquery.Procedure()
-	if err != nil {
+	if query.deep >= MAX_RECURSIVE_DEEP {
+		err = ErrTooDeep
 		return
 	}
 
-	query.client.ReadSection(rquery.ans.Answer)
-	addrs, ok = query.client.Cache[host]
-	if ok {
-		addr = addrs[rand.Intn(len(addrs))]
-		logger.Infof("%d %s: %s", query.deep, host, addr)
-		return
+	for _, rr := range servers {
+		host = rr.(*dns.NS).Ns
+		if dns.IsSubDomain(zone, host) {
+			// in zone server without glue can't be resolved.
+			continue
+		}
+
+		query.ResolveHost(host)
+		if addrs := query.client.Addresses(host); len(addrs) != 0 {
+			addr = addrs[0]
+			logger.Infof("%d %s: %s", query.deep, host, addr)
+			return
+		}
 	}
 
 	err = ErrUndeterminedNext
 	return
 }
 
+func (query *RecursiveQuery) ResolveHost(host string) {
+	var qtypes []uint16
+	if query.client.IPv4 {
+		qtypes = append(qtypes, dns.TypeA)
+	}
+	if query.client.IPv6 {
+		qtypes = append(qtypes, dns.TypeAAAA)
+	}
+
+	for _, qtype := range qtypes {
+		logger.Infof("%d query %s record for host %s", query.deep, dns.TypeToString[qtype], host)
+
+		quiz := &dns.Msg{}
+		quiz.SetQuestion(host, qtype)
+
+		rquery := NewRecursiveQuery(query.ctx, query.client, quiz)
+		rquery.deep = query.deep + 1
+		err := rquery.Procedure()
+		if err != nil {
+			logger.Info(err.Error())
+			continue
+		}
+
+		for _, rr := range rquery.ans.Answer {
+			if rr.Header().Rrtype != qtype {
+				continue
+			}
+			rr = dns.Copy(rr)
+			rr.Header().Name = host
+			query.client.tree.AddRecord(rr)
+		}
+	}
+	return
+}
+
 func (query *RecursiveQuery) Query() (interm *dns.Msg, err error) {
 	var addr string
 	for i := 0; i < 3; i++ {
@@ -168,23 +361,38 @@ func (query *RecursiveQuery) Query() (interm *dns.Msg, err error) {
 			return
 		}
 
-		question := query.quiz.Question[0]
+		msg := query.quiz
+		name, minimised := query.MinimisedName()
+		query.minimised = minimised
+		if minimised {
+			msg = query.quiz.Copy()
+			msg.Question[0].Name = name
+			msg.Question[0].Qtype = dns.TypeA
+		}
+
+		question := msg.Question[0]
 		logger.Infof("%d doh -[%s %s]-> %s|%s",
 			query.deep, question.Name, dns.TypeToString[question.Qtype], query.current, addr)
 
-		interm, _, err = query.client.client.ExchangeContext(query.ctx, query.quiz, addr+":53")
+		addr = net.JoinHostPort(addr, query.client.port)
+		var rtt time.Duration
+		interm, rtt, err = query.client.client.ExchangeContext(query.ctx, msg, addr)
+		if err == nil && interm.Truncated && query.client.TCPFallback {
+			logger.Infof("%d truncated, retry in tcp.", query.deep)
+			var tcprtt time.Duration
+			interm, tcprtt, err = query.client.tcpclient.ExchangeContext(query.ctx, msg, addr)
+			rtt += tcprtt
+		}
+		if trace := GetTrace(query.ctx); trace != nil {
+			trace.Add(NewTraceStep(query.deep, query.zone, query.current, addr, msg, interm, rtt, err))
+		}
 		if err == nil {
 			break
 		}
 		logger.Infof(err.Error())
 	}
 
-	switch {
-	case err == nil:
-	case interm != nil:
-		query.ans.MsgHdr.Rcode = interm.MsgHdr.Rcode
-		return
-	default:
+	if err != nil {
 		query.ans.MsgHdr.Rcode = dns.RcodeServerFailure
 		return
 	}
@@ -193,75 +401,260 @@ func (query *RecursiveQuery) Query() (interm *dns.Msg, err error) {
 	return
 }
 
-func (query *RecursiveQuery) ParseAnswer(section []dns.RR) (finished bool) {
+// RFC 9156: reveal one more label to the servers of each zone.
+func (query *RecursiveQuery) MinimisedName() (name string, ok bool) {
+	if !query.client.QnameMin || query.extra >= MAX_MINIMISE_COUNT {
+		return
+	}
+	labels := dns.SplitDomainName(query.quiz.Question[0].Name)
+	n := dns.CountLabel(query.zone) + 1 + query.extra
+	if n >= len(labels) {
+		return
+	}
+	name = dns.Fqdn(strings.Join(labels[len(labels)-n:], "."))
+	ok = true
+	return
+}
+
+func (query *RecursiveQuery) Chase(target string) (err error) {
+	key := dns.CanonicalName(target)
+	if query.chain[key] {
+		return ErrCNAMELoop
+	}
+	if len(query.chain) > MAX_CNAME_CHAIN {
+		return ErrCNAMEChain
+	}
+	query.chain[key] = true
+	query.quiz.Question[0].Name = target
+	query.extra = 0
+	return
+}
+
+// RFC 6672: replace the suffix with the target.
+func DNAMETarget(name string, dname *dns.DNAME) (target string) {
+	labels := dns.SplitDomainName(name)
+	target = strings.Join(labels[:len(labels)-dns.CountLabel(dname.Hdr.Name)], ".") + "."
+	if dname.Target != "." {
+		target += dname.Target
+	}
+	return
+}
+
+func (query *RecursiveQuery) ParseDNAME(section []dns.RR) (finished bool, err error) {
 	for _, rr := range section {
-		switch rr.Header().Rrtype {
-		case dns.TypeCNAME:
-			v := rr.(*dns.CNAME)
-			query.quiz.Question[0].Name = v.Target
-			query.ans.Answer = append(query.ans.Answer, v)
-			logger.Infof("%d doh <-[%s CNAME]- %s", query.deep, v.Target, query.current)
-			query.deep++
-
-		case query.quiz.Question[0].Qtype:
-			query.ans.Answer = append(query.ans.Answer, rr)
+		v, ok := rr.(*dns.DNAME)
+		if !ok {
+			continue
+		}
+		name := query.quiz.Question[0].Name
+		if EqualName(v.Hdr.Name, name) || !dns.IsSubDomain(v.Hdr.Name, name) {
+			continue
+		}
+		if !dns.IsSubDomain(query.zone, v.Hdr.Name) {
+			logger.Infof("%d ignore out of bailiwick dname %s", query.deep, v.Hdr.Name)
+			continue
+		}
+
+		target := DNAMETarget(name, v)
+		query.ans.Answer = append(query.ans.Answer, v)
+		if len(target) > 255 {
+			query.ans.Rcode = dns.RcodeYXDomain
 			finished = true
+			return
+		}
+
+		cname := &dns.CNAME{
+			Hdr: dns.RR_Header{
+				Name:   name,
+				Rrtype: dns.TypeCNAME,
+				Class:  v.Hdr.Class,
+				Ttl:    v.Hdr.Ttl,
+			},
+			Target: target,
+		}
+		query.ans.Answer = append(query.ans.Answer, cname)
+		logger.Infof("%d doh <-[%s DNAME]- %s", query.deep, target, query.current)
+
+		err = query.Chase(target)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (query *RecursiveQuery) ParseAnswer(section []dns.RR) (finished bool, err error) {
+	start := len(query.ans.Answer)
+	defer func() {
+		query.ans.Answer = AppendSignatures(query.ans.Answer, start, section)
+	}()
+
+	if query.quiz.Question[0].Qtype != dns.TypeDNAME {
+		finished, err = query.ParseDNAME(section)
+		if finished || err != nil {
+			return
+		}
+	}
+
+	// the records may be out of order, go through the section until the name not changed.
+	for changed := true; changed && !finished; {
+		changed = false
+		for _, rr := range section {
+			question := query.quiz.Question[0]
+			hdr := rr.Header()
+			if !EqualName(hdr.Name, question.Name) {
+				continue
+			}
+			if !dns.IsSubDomain(query.zone, hdr.Name) {
+				logger.Infof("%d ignore out of bailiwick answer %s", query.deep, hdr.Name)
+				continue
+			}
+
+			switch hdr.Rrtype {
+			case question.Qtype:
+				query.ans.Answer = append(query.ans.Answer, rr)
+				finished = true
+
+			case dns.TypeCNAME:
+				v := rr.(*dns.CNAME)
+				query.ans.Answer = append(query.ans.Answer, v)
+				logger.Infof("%d doh <-[%s CNAME]- %s", query.deep, v.Target, query.current)
+				err = query.Chase(v.Target)
+				if err != nil {
+					return
+				}
+				changed = true
+			}
 		}
 	}
 	return
 }
 
-func (query *RecursiveQuery) ParseAuthority(section []dns.RR) {
+func (query *RecursiveQuery) ParseAuthority(section []dns.RR) (referral bool) {
 	domain := query.quiz.Question[0].Name
 	name := ""
-	qtype := ""
 	count := 0
 	for _, rr := range section {
-		switch v := rr.(type) {
-		case *dns.NS:
-			qtype = "NS"
-			name = v.Hdr.Name
-			query.client.AddNameServer(name, v.Ns)
-
-			if !strings.HasSuffix(domain, name) {
-				count++
-			}
-
-		case *dns.SOA:
-			qtype = "SOA"
-			name = v.Hdr.Name
-			query.client.SetNameServer(name, v.Ns)
-
-			if strings.HasSuffix(domain, name) {
-				count++
-			}
-			break
+		v, ok := rr.(*dns.NS)
+		if !ok {
+			continue
+		}
+		// the delegation should be under the current zone and above the domain.
+		if EqualName(v.Hdr.Name, query.zone) || !dns.IsSubDomain(query.zone, v.Hdr.Name) ||
+			!dns.IsSubDomain(v.Hdr.Name, domain) ||
+			(query.quiz.Question[0].Qtype == dns.TypeDS && EqualName(v.Hdr.Name, domain)) {
+			logger.Infof("%d ignore bad delegation %s from %s", query.deep, v.Hdr.Name, query.zone)
+			continue
 		}
+		name = v.Hdr.Name
+		query.client.tree.AddRecord(v)
+		count++
 	}
 
 	if count != 0 {
-		logger.Infof("%d doh <-[%s %s %d]- %s",
-			query.deep, name, qtype, count, query.current)
-		logger.Infof("%d ns: %v",
-			query.deep, reflect.ValueOf(query.client.NameServers).MapKeys())
+		referral = true
+		// the labels revealed are counted from the new zone.
+		query.extra = 0
+		logger.Infof("%d doh <-[%s NS %d]- %s", query.deep, name, count, query.current)
 	}
+	return
+}
 
+func (query *RecursiveQuery) ReadGlue(section []dns.RR) {
+	for _, rr := range section {
+		switch rr.(type) {
+		case *dns.A, *dns.AAAA:
+			if dns.IsSubDomain(query.zone, rr.Header().Name) {
+				query.client.tree.AddRecord(rr)
+			}
+		}
+	}
 	return
 }
 
 func (query *RecursiveQuery) Procedure() (err error) {
 	var interm *dns.Msg
-	for i := 0; i < 10; i++ {
+	var finished bool
+	for i := 0; i < MAX_ITERATIONS; i++ {
 		interm, err = query.Query()
 		if err != nil {
 			return
 		}
-		if query.ParseAnswer(interm.Answer) {
+
+		if interm.Rcode != dns.RcodeSuccess && interm.Rcode != dns.RcodeNameError {
+			query.ans.Rcode = interm.Rcode
+			return
+		}
+
+		if query.minimised {
+			switch {
+			case query.ParseAuthority(interm.Ns):
+				query.ReadGlue(interm.Extra)
+			case interm.Rcode == dns.RcodeNameError:
+				// RFC 8020: there is nothing under a NXDOMAIN.
+				logger.Infof("%d doh <-[NXDOMAIN]- %s", query.deep, query.current)
+				query.ans.Rcode = interm.Rcode
+				query.ans.Ns = interm.Ns
+				return
+			default:
+				query.extra++
+			}
+			continue
+		}
+
+		name := query.quiz.Question[0].Name
+		finished, err = query.ParseAnswer(interm.Answer)
+		if err != nil {
+			return
+		}
+		if finished {
 			logger.Infof("%d doh <-[final]- %s", query.deep, query.current)
-			break
+			// keep the proof of wildcard expansion.
+			for _, rr := range interm.Ns {
+				switch v := rr.(type) {
+				case *dns.NSEC, *dns.NSEC3:
+					query.ans.Ns = append(query.ans.Ns, rr)
+				case *dns.RRSIG:
+					if v.TypeCovered == dns.TypeNSEC || v.TypeCovered == dns.TypeNSEC3 {
+						query.ans.Ns = append(query.ans.Ns, rr)
+					}
+				}
+			}
+			return
+		}
+
+		if query.ParseAuthority(interm.Ns) {
+			query.ReadGlue(interm.Extra)
+			continue
 		}
-		query.ParseAuthority(interm.Ns)
-		query.client.ReadSection(interm.Extra)
+
+		target := query.quiz.Question[0].Name
+		if !EqualName(name, target) {
+			// the NXDOMAIN is for the target if it's in the same zone.
+			if interm.Rcode == dns.RcodeNameError && interm.Authoritative && dns.IsSubDomain(query.zone, target) {
+				query.ans.Rcode = interm.Rcode
+				query.ans.Ns = interm.Ns
+				return
+			}
+			continue
+		}
+
+		if len(interm.Answer) == 0 && !interm.Authoritative {
+			err = ErrLameDelegation
+			query.ans.Rcode = dns.RcodeServerFailure
+			return
+		}
+
+		logger.Infof("%d doh <-[%s]- %s", query.deep, dns.RcodeToString[interm.Rcode], query.current)
+		query.ans.Rcode = interm.Rcode
+		query.ans.Ns = interm.Ns
+		return
 	}
+
+	err = ErrTooManyIterations
 	return
 }
+
+func EqualName(a, b string) bool {
+	return dns.CanonicalName(a) == dns.CanonicalName(b)
+}
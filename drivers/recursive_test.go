@@ -0,0 +1,627 @@
+package drivers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// TestAuth is a minimal authoritative server, serving different zones on different loopback addresses.
+type TestAuth struct {
+	Port    string
+	zones   map[string][]dns.RR
+	servers []*dns.Server
+	queries atomic.Int32
+	options atomic.Int32
+	mu      sync.Mutex
+	seen    []string
+}
+
+var TestZones = map[string]string{
+	"127.0.0.1": `
+. 86400 IN SOA a.root. admin.root. 1 1800 900 604800 86400
+. 86400 IN NS a.root.
+a.root. 86400 IN A 127.0.0.1
+com. 3600 IN NS ns.com.
+ns.com. 3600 IN A 127.0.0.2
+`,
+	"127.0.0.2": `
+com. 3600 IN SOA ns.com. admin.com. 1 1800 900 604800 300
+com. 3600 IN NS ns.com.
+ns.com. 3600 IN A 127.0.0.2
+example.com. 3600 IN NS ns1.example.com.
+ns1.example.com. 3600 IN A 127.0.0.3
+ample.com. 3600 IN NS ns.ample.com.
+ns.ample.com. 3600 IN A 127.0.0.4
+v6.com. 3600 IN NS ns.v6.com.
+ns.v6.com. 3600 IN AAAA ::1
+`,
+	"127.0.0.3": `
+example.com. 3600 IN SOA ns1.example.com. admin.example.com. 1 1800 900 604800 300
+example.com. 3600 IN NS ns1.example.com.
+ns1.example.com. 3600 IN A 127.0.0.3
+www.example.com. 300 IN A 192.0.2.1
+alias.example.com. 300 IN CNAME www.example.com.
+tc.example.com. 300 IN A 192.0.2.2
+out.example.com. 300 IN CNAME www.ample.com.
+www.ample.com. 300 IN A 198.51.100.1
+loop1.example.com. 300 IN CNAME loop2.example.com.
+loop2.example.com. 300 IN CNAME loop1.example.com.
+nxalias.example.com. 300 IN CNAME nx.example.com.
+old.example.com. 300 IN DNAME ample.com.
+bogus.example.com. 300 IN A 192.0.2.66
+`,
+	"127.0.0.4": `
+ample.com. 3600 IN SOA ns.ample.com. admin.ample.com. 1 1800 900 604800 300
+ample.com. 3600 IN NS ns.ample.com.
+ns.ample.com. 3600 IN A 127.0.0.4
+www.ample.com. 300 IN A 192.0.2.100
+`,
+	"::1": `
+v6.com. 3600 IN SOA ns.v6.com. admin.v6.com. 1 1800 900 604800 300
+v6.com. 3600 IN NS ns.v6.com.
+ns.v6.com. 3600 IN AAAA ::1
+www.v6.com. 300 IN A 192.0.2.6
+`,
+}
+
+func ParseTestZones(t *testing.T, zones map[string]string) (parsed map[string][]dns.RR) {
+	parsed = make(map[string][]dns.RR)
+	for addr, zone := range zones {
+		zp := dns.NewZoneParser(strings.NewReader(zone), "", "")
+		for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+			parsed[addr] = append(parsed[addr], rr)
+		}
+		if err := zp.Err(); err != nil {
+			t.Fatalf("parse zone failed: %s", err)
+		}
+	}
+	return
+}
+
+func StartTestAuth(t *testing.T, zones map[string]string) (auth *TestAuth) {
+	return ServeTestZones(t, ParseTestZones(t, zones))
+}
+
+func ServeTestZones(t *testing.T, zones map[string][]dns.RR) (auth *TestAuth) {
+	auth = &TestAuth{zones: zones}
+	for addr := range zones {
+		pc, err := net.ListenPacket("udp", net.JoinHostPort(addr, auth.Port))
+		if err != nil {
+			t.Fatalf("listen failed: %s", err)
+		}
+		if auth.Port == "" {
+			_, auth.Port, _ = net.SplitHostPort(pc.LocalAddr().String())
+		}
+		l, err := net.Listen("tcp", net.JoinHostPort(addr, auth.Port))
+		if err != nil {
+			t.Fatalf("listen failed: %s", err)
+		}
+		auth.servers = append(auth.servers,
+			&dns.Server{PacketConn: pc, Handler: auth},
+			&dns.Server{Listener: l, Handler: auth})
+	}
+
+	for _, srv := range auth.servers {
+		go srv.ActivateAndServe()
+	}
+	t.Cleanup(func() {
+		for _, srv := range auth.servers {
+			srv.Shutdown()
+		}
+	})
+	return
+}
+
+func (auth *TestAuth) ServeDNS(w dns.ResponseWriter, quiz *dns.Msg) {
+	auth.queries.Add(1)
+	host, _, _ := net.SplitHostPort(w.LocalAddr().String())
+	auth.mu.Lock()
+	auth.seen = append(auth.seen, host+" "+quiz.Question[0].Name)
+	auth.mu.Unlock()
+	// RFC 6891 6.1.1: more than one OPT is a format error.
+	opts := 0
+	for _, rr := range quiz.Extra {
+		if rr.Header().Rrtype == dns.TypeOPT {
+			opts++
+		}
+	}
+	if opt := quiz.IsEdns0(); opt != nil && len(opt.Option) != 0 {
+		auth.options.Add(1)
+	}
+	if opts > 1 {
+		ans := &dns.Msg{}
+		ans.SetRcode(quiz, dns.RcodeFormatError)
+		w.WriteMsg(ans)
+		return
+	}
+	records := auth.zones[host]
+	ans := auth.Answer(records, quiz)
+	if opt := quiz.IsEdns0(); opt != nil && opt.Do() {
+		ans.Answer = AppendSignatures(ans.Answer, 0, records)
+		ans.Ns = AppendSignatures(ans.Ns, 0, records)
+		if len(ans.Answer) == 0 {
+			// not the minimal proof, but enough for the validator to find it.
+			var denial []dns.RR
+			for _, rr := range records {
+				switch rr.Header().Rrtype {
+				case dns.TypeNSEC, dns.TypeNSEC3:
+					denial = append(denial, rr)
+				}
+			}
+			ans.Ns = append(ans.Ns, denial...)
+			ans.Ns = AppendSignatures(ans.Ns, len(ans.Ns)-len(denial), records)
+		}
+	}
+	if strings.HasPrefix(quiz.Question[0].Name, "tc.") && w.LocalAddr().Network() == "udp" {
+		ans.Truncated = true
+		ans.Answer = nil
+	}
+	w.WriteMsg(ans)
+}
+
+func (auth *TestAuth) Answer(records []dns.RR, quiz *dns.Msg) (ans *dns.Msg) {
+	question := quiz.Question[0]
+	ans = &dns.Msg{}
+	ans.SetReply(quiz)
+
+	var soa *dns.SOA
+	for _, rr := range records {
+		if v, ok := rr.(*dns.SOA); ok {
+			soa = v
+		}
+	}
+	apex := soa.Hdr.Name
+
+	// delegation: the deepest NS under apex and above qname.
+	cut := ""
+	for _, rr := range records {
+		name := rr.Header().Name
+		if rr.Header().Rrtype != dns.TypeNS || EqualName(name, apex) || !dns.IsSubDomain(name, question.Name) {
+			continue
+		}
+		if question.Qtype == dns.TypeDS && EqualName(name, question.Name) {
+			continue
+		}
+		if cut == "" || dns.CountLabel(name) > dns.CountLabel(cut) {
+			cut = name
+		}
+	}
+	if cut != "" {
+		for _, rr := range records {
+			if rr.Header().Rrtype == dns.TypeNS && EqualName(rr.Header().Name, cut) {
+				ans.Ns = append(ans.Ns, rr)
+				for _, glue := range records {
+					isAddr := glue.Header().Rrtype == dns.TypeA || glue.Header().Rrtype == dns.TypeAAAA
+					if isAddr && EqualName(glue.Header().Name, rr.(*dns.NS).Ns) {
+						ans.Extra = append(ans.Extra, glue)
+					}
+				}
+			}
+			if rr.Header().Rrtype == dns.TypeDS && EqualName(rr.Header().Name, cut) {
+				ans.Ns = append(ans.Ns, rr)
+			}
+		}
+		return
+	}
+
+	ans.Authoritative = true
+	exist := false
+	for _, rr := range records {
+		name := rr.Header().Name
+		if dns.IsSubDomain(question.Name, name) {
+			exist = true
+		}
+		if rr.Header().Rrtype == dns.TypeDNAME && !EqualName(name, question.Name) && dns.IsSubDomain(name, question.Name) {
+			ans.Answer = append(ans.Answer, rr)
+			return
+		}
+	}
+
+	// follow cnames in the records we have, like most authoritative servers do.
+	name := question.Name
+	for i := 0; i < 4; i++ {
+		target := ""
+		for _, rr := range records {
+			if !EqualName(rr.Header().Name, name) {
+				continue
+			}
+			switch rr.Header().Rrtype {
+			case question.Qtype:
+				ans.Answer = append(ans.Answer, rr)
+			case dns.TypeCNAME:
+				ans.Answer = append(ans.Answer, rr)
+				target = rr.(*dns.CNAME).Target
+			}
+		}
+		if target == "" {
+			break
+		}
+		name = target
+	}
+
+	if len(ans.Answer) == 0 {
+		if !exist {
+			ans.Rcode = dns.RcodeNameError
+		}
+		ans.Ns = append(ans.Ns, soa)
+	}
+	return
+}
+
+const TestRootHints = `
+; fake root for test
+.                        3600000      NS    A.ROOT.
+A.ROOT.                  3600000      A     127.0.0.1
+`
+
+func NewTestRecursiveClient(t *testing.T, auth *TestAuth, config string) (cli *RecursiveClient) {
+	hints := filepath.Join(t.TempDir(), "named.root")
+	err := os.WriteFile(hints, []byte(TestRootHints), 0600)
+	if err != nil {
+		t.Fatalf("write root hints failed: %s", err)
+	}
+
+	body := fmt.Sprintf(`{"root-hints": "%s"%s}`, hints, config)
+	cli = NewRecursiveClient("", json.RawMessage(body))
+	cli.port = auth.Port
+	return
+}
+
+func TestRecursive(t *testing.T) {
+	auth := StartTestAuth(t, TestZones)
+	cli := NewTestRecursiveClient(t, auth, "")
+
+	quiz := &dns.Msg{}
+	quiz.SetQuestion("www.example.com.", dns.TypeA)
+	ans, err := cli.Exchange(context.Background(), quiz)
+	if err != nil {
+		t.Fatalf("exchange failed: %s", err)
+	}
+	if len(ans.Answer) != 1 || ans.Answer[0].(*dns.A).A.String() != "192.0.2.1" {
+		t.Fatalf("wrong answer: %s", ans)
+	}
+
+	zone, _ := cli.tree.Closest("www.example.com.", dns.TypeNS)
+	if zone != "example.com." {
+		t.Fatalf("delegation not cached: %s", zone)
+	}
+
+	quiz.SetQuestion("www.ample.com.", dns.TypeA)
+	ans, err = cli.Exchange(context.Background(), quiz)
+	if err != nil {
+		t.Fatalf("exchange failed: %s", err)
+	}
+	if len(ans.Answer) != 1 || ans.Answer[0].(*dns.A).A.String() != "192.0.2.100" {
+		t.Fatalf("ample.com should not match example.com: %s", ans)
+	}
+
+	quiz.SetQuestion("alias.example.com.", dns.TypeA)
+	ans, err = cli.Exchange(context.Background(), quiz)
+	if err != nil {
+		t.Fatalf("exchange failed: %s", err)
+	}
+	if len(ans.Answer) != 2 || ans.Question[0].Name != "alias.example.com." {
+		t.Fatalf("wrong cname answer: %s", ans)
+	}
+
+	quiz.SetQuestion("nx.example.com.", dns.TypeA)
+	ans, err = cli.Exchange(context.Background(), quiz)
+	if err != nil {
+		t.Fatalf("exchange failed: %s", err)
+	}
+	if ans.Rcode != dns.RcodeNameError || len(ans.Ns) != 1 {
+		t.Fatalf("wrong nxdomain answer: %s", ans)
+	}
+}
+
+func TestRecursiveEdns(t *testing.T) {
+	auth := StartTestAuth(t, TestZones)
+	cli := NewTestRecursiveClient(t, auth, "")
+
+	quiz := &dns.Msg{}
+	quiz.SetQuestion("www.example.com.", dns.TypeA)
+	quiz.SetEdns0(4096, true)
+	quiz.IsEdns0().Option = append(quiz.IsEdns0().Option, &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		Family:        1,
+		SourceNetmask: 24,
+		Address:       net.ParseIP("198.51.100.0").To4(),
+	})
+	ans, err := cli.Exchange(context.Background(), quiz)
+	if err != nil {
+		t.Fatalf("exchange failed: %s", err)
+	}
+	if ans.Rcode != dns.RcodeSuccess || len(ans.Answer) == 0 {
+		t.Fatalf("wrong answer: %s", ans)
+	}
+	if auth.options.Load() != 0 {
+		t.Fatalf("edns options of client should not be sent to authorities: %d", auth.options.Load())
+	}
+}
+
+func TestRecursiveConcurrency(t *testing.T) {
+	auth := StartTestAuth(t, TestZones)
+	cli := NewTestRecursiveClient(t, auth, "")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			names := []string{"www.example.com.", "www.ample.com.", fmt.Sprintf("nx%d.example.com.", i)}
+			quiz := &dns.Msg{}
+			quiz.SetQuestion(names[i%len(names)], dns.TypeA)
+			_, err := cli.Exchange(context.Background(), quiz)
+			if err != nil {
+				t.Errorf("exchange failed: %s", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestRecursiveTCPFallback(t *testing.T) {
+	auth := StartTestAuth(t, TestZones)
+	cli := NewTestRecursiveClient(t, auth, "")
+
+	quiz := &dns.Msg{}
+	quiz.SetQuestion("tc.example.com.", dns.TypeA)
+	ans, err := cli.Exchange(context.Background(), quiz)
+	if err != nil {
+		t.Fatalf("exchange failed: %s", err)
+	}
+	if len(ans.Answer) != 1 {
+		t.Fatalf("truncated answer should be retried in tcp: %s", ans)
+	}
+
+	cli = NewTestRecursiveClient(t, auth, `, "tcp-fallback": false`)
+	ans, err = cli.Exchange(context.Background(), quiz)
+	if err != nil {
+		t.Fatalf("exchange failed: %s", err)
+	}
+	if len(ans.Answer) != 0 {
+		t.Fatalf("tcp fallback should be disabled: %s", ans)
+	}
+}
+
+func TestRecursiveMaxTime(t *testing.T) {
+	zones := make(map[string]string)
+	for addr, zone := range TestZones {
+		zones[addr] = zone
+	}
+	zones["127.0.0.2"] += `
+slow.com. 3600 IN NS ns.slow.com.
+ns.slow.com. 3600 IN A 127.0.0.6
+`
+	auth := StartTestAuth(t, zones)
+	// the server of slow.com never answers.
+	pc, err := net.ListenPacket("udp", net.JoinHostPort("127.0.0.6", auth.Port))
+	if err != nil {
+		t.Fatalf("listen failed: %s", err)
+	}
+	defer pc.Close()
+	cli := NewTestRecursiveClient(t, auth, `, "timeout": 1000, "max-time": 200`)
+
+	quiz := &dns.Msg{}
+	quiz.SetQuestion("www.slow.com.", dns.TypeA)
+	begin := time.Now()
+	ans, err := cli.Exchange(context.Background(), quiz)
+	if err != nil {
+		t.Fatalf("exchange failed: %s", err)
+	}
+	if ans.Rcode != dns.RcodeServerFailure || time.Since(begin) > time.Second {
+		t.Fatalf("resolution should be stopped by max-time in %s: %s", time.Since(begin), ans)
+	}
+}
+
+func TestRecursiveIPv6(t *testing.T) {
+	auth := StartTestAuth(t, TestZones)
+	cli := NewTestRecursiveClient(t, auth, `, "prefer": "ipv6"`)
+
+	quiz := &dns.Msg{}
+	quiz.SetQuestion("www.v6.com.", dns.TypeA)
+	ans, err := cli.Exchange(context.Background(), quiz)
+	if err != nil {
+		t.Fatalf("exchange failed: %s", err)
+	}
+	if len(ans.Answer) != 1 {
+		t.Fatalf("wrong answer: %s", ans)
+	}
+
+	cli = NewTestRecursiveClient(t, auth, `, "ipv6": false`)
+	ans, err = cli.Exchange(context.Background(), quiz)
+	if err != nil {
+		t.Fatalf("exchange failed: %s", err)
+	}
+	if ans.Rcode != dns.RcodeServerFailure {
+		t.Fatalf("ipv6 only server should not be reached: %s", ans)
+	}
+}
+
+func TestRecursiveChase(t *testing.T) {
+	auth := StartTestAuth(t, TestZones)
+	cli := NewTestRecursiveClient(t, auth, "")
+
+	quiz := &dns.Msg{}
+	quiz.SetQuestion("out.example.com.", dns.TypeA)
+	quiz.SetEdns0(4096, false)
+	ans, err := cli.Exchange(context.Background(), quiz)
+	if err != nil {
+		t.Fatalf("exchange failed: %s", err)
+	}
+	if len(ans.Answer) != 2 || ans.Answer[1].(*dns.A).A.String() != "192.0.2.100" {
+		t.Fatalf("out of bailiwick answer should be ignored: %s", ans)
+	}
+
+	quiz.SetQuestion("www.old.example.com.", dns.TypeA)
+	ans, err = cli.Exchange(context.Background(), quiz)
+	if err != nil {
+		t.Fatalf("exchange failed: %s", err)
+	}
+	if len(ans.Answer) != 3 || ans.Answer[1].(*dns.CNAME).Target != "www.ample.com." {
+		t.Fatalf("wrong dname answer: %s", ans)
+	}
+
+	quiz.SetQuestion("nxalias.example.com.", dns.TypeA)
+	ans, err = cli.Exchange(context.Background(), quiz)
+	if err != nil {
+		t.Fatalf("exchange failed: %s", err)
+	}
+	if ans.Rcode != dns.RcodeNameError || len(ans.Answer) != 1 {
+		t.Fatalf("wrong nxdomain answer: %s", ans)
+	}
+
+	quiz.SetQuestion("loop1.example.com.", dns.TypeA)
+	ans, err = cli.Exchange(context.Background(), quiz)
+	if err != nil {
+		t.Fatalf("exchange failed: %s", err)
+	}
+	if ans.Rcode != dns.RcodeServerFailure {
+		t.Fatalf("cname loop should be servfail: %s", ans)
+	}
+	ede, ok := ans.IsEdns0().Option[0].(*dns.EDNS0_EDE)
+	if !ok || ede.ExtraText != ErrCNAMELoop.Error() {
+		t.Fatalf("servfail should have reason: %s", ans)
+	}
+}
+
+func TestRecursiveQnameMinimisation(t *testing.T) {
+	auth := StartTestAuth(t, TestZones)
+	cli := NewTestRecursiveClient(t, auth, `, "qname-minimisation": true`)
+
+	quiz := &dns.Msg{}
+	quiz.SetQuestion("www.example.com.", dns.TypeA)
+	ans, err := cli.Exchange(context.Background(), quiz)
+	if err != nil {
+		t.Fatalf("exchange failed: %s", err)
+	}
+	if len(ans.Answer) != 1 {
+		t.Fatalf("wrong answer: %s", ans)
+	}
+
+	quiz.SetQuestion("a.b.nx.example.com.", dns.TypeA)
+	ans, err = cli.Exchange(context.Background(), quiz)
+	if err != nil {
+		t.Fatalf("exchange failed: %s", err)
+	}
+	if ans.Rcode != dns.RcodeNameError {
+		t.Fatalf("wrong nxdomain answer: %s", ans)
+	}
+
+	auth.mu.Lock()
+	defer auth.mu.Unlock()
+	for _, seen := range auth.seen {
+		if strings.HasPrefix(seen, "127.0.0.1 ") && seen != "127.0.0.1 com." {
+			t.Fatalf("root server saw too much: %s", seen)
+		}
+		if strings.HasPrefix(seen, "127.0.0.2 ") && seen != "127.0.0.2 example.com." {
+			t.Fatalf("com server saw too much: %s", seen)
+		}
+		if strings.HasSuffix(seen, "a.b.nx.example.com.") {
+			t.Fatalf("query should stop at nxdomain: %s", seen)
+		}
+	}
+}
+
+func TestRecursiveQnameMinimisationDelegation(t *testing.T) {
+	zones := make(map[string]string)
+	for addr, zone := range TestZones {
+		zones[addr] = zone
+	}
+	// sub.com is an empty non-terminal in com, and deep.sub.com is delegated.
+	zones["127.0.0.2"] += `
+deep.sub.com. 3600 IN NS ns.deep.sub.com.
+ns.deep.sub.com. 3600 IN A 127.0.0.5
+`
+	zones["127.0.0.5"] = `
+deep.sub.com. 3600 IN SOA ns.deep.sub.com. admin.deep.sub.com. 1 1800 900 604800 300
+deep.sub.com. 3600 IN NS ns.deep.sub.com.
+ns.deep.sub.com. 3600 IN A 127.0.0.5
+www.a.deep.sub.com. 300 IN A 192.0.2.5
+`
+	auth := StartTestAuth(t, zones)
+	cli := NewTestRecursiveClient(t, auth, `, "qname-minimisation": true`)
+
+	quiz := &dns.Msg{}
+	quiz.SetQuestion("www.a.deep.sub.com.", dns.TypeA)
+	ans, err := cli.Exchange(context.Background(), quiz)
+	if err != nil {
+		t.Fatalf("exchange failed: %s", err)
+	}
+	if len(ans.Answer) != 1 {
+		t.Fatalf("wrong answer: %s", ans)
+	}
+
+	auth.mu.Lock()
+	defer auth.mu.Unlock()
+	for _, seen := range auth.seen {
+		if strings.HasPrefix(seen, "127.0.0.5 ") {
+			if seen != "127.0.0.5 a.deep.sub.com." {
+				t.Fatalf("deep.sub.com server saw too much: %s", seen)
+			}
+			return
+		}
+	}
+	t.Fatalf("deep.sub.com server not queried: %v", auth.seen)
+}
+
+func TestRecursiveTrace(t *testing.T) {
+	auth := StartTestAuth(t, TestZones)
+	cli := NewTestRecursiveClient(t, auth, "")
+
+	trace := &Trace{}
+	quiz := &dns.Msg{}
+	quiz.SetQuestion("www.example.com.", dns.TypeA)
+	_, err := cli.Exchange(WithTrace(context.Background(), trace), quiz)
+	if err != nil {
+		t.Fatalf("exchange failed: %s", err)
+	}
+
+	if len(trace.Steps) != 3 {
+		t.Fatalf("wrong steps: %d", len(trace.Steps))
+	}
+	for i, zone := range []string{".", "com.", "example.com."} {
+		if trace.Steps[i].Zone != zone || trace.Steps[i].Rcode != "NOERROR" {
+			t.Fatalf("wrong step %d: %+v", i, trace.Steps[i])
+		}
+	}
+	referral := trace.Steps[1].Response
+	if len(referral.Authority) != 1 || referral.Authority[0].Data != "ns1.example.com." || len(referral.Additional) != 1 {
+		t.Fatalf("wrong referral: %+v", referral)
+	}
+	if !strings.Contains(trace.Steps[2].Format(false), "192.0.2.1") {
+		t.Fatalf("final answer not in trace: %s", trace.Steps[2].Format(false))
+	}
+}
+
+func TestReadRootHints(t *testing.T) {
+	cli := NewRecursiveClient("", nil)
+	if len(cli.Addresses("a.root-servers.net.")) != 2 {
+		t.Fatalf("default root hints should have both ipv4 and ipv6.")
+	}
+
+	hints := filepath.Join(t.TempDir(), "named.root")
+	os.WriteFile(hints, []byte(TestRootHints), 0600)
+	tree, err := ReadRootHintsFile(hints)
+	if err != nil {
+		t.Fatalf("read root hints failed: %s", err)
+	}
+	zone, rrs := tree.Closest("www.example.com.", dns.TypeNS)
+	if zone != "." || len(rrs) != 1 {
+		t.Fatalf("wrong root hints: %s %v", zone, rrs)
+	}
+	if len(tree.Get("a.root.", dns.TypeA)) != 1 {
+		t.Fatalf("wrong root hints.")
+	}
+}
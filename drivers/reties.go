@@ -4,23 +4,41 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"net"
+	"strings"
+	"time"
 
 	"github.com/miekg/dns"
 )
 
 var (
 	ErrEmptyClients = errors.New("empty client list")
+	ErrRcode        = errors.New("unknown rcode")
 )
 
+var (
+	DEFAULT_RETRY_RCODES = []string{"SERVFAIL", "REFUSED"}
+)
+
+// RetiesClient tries the clients in turn, each of them is tried tries times like attempts in resolv.conf.
 type RetiesClient struct {
-	Tries   int
-	Clients []json.RawMessage
-	clis    []Client
+	Tries          int
+	Timeout        int
+	Clients        []json.RawMessage
+	RetryRcodes    []string `json:"retry-rcodes"`
+	RetryEmpty     bool     `json:"retry-empty"`
+	RetryTruncated bool     `json:"retry-truncated"`
+	BogusIPs       []string `json:"bogus-ips"`
+	clis           []Client
+	rcodes         map[int]bool
+	bogus          []*net.IPNet
 }
 
 func NewRetiesClient(URL string, body json.RawMessage) (cli *RetiesClient) {
 	var err error
-	cli = &RetiesClient{}
+	cli = &RetiesClient{
+		RetryRcodes: append([]string{}, DEFAULT_RETRY_RCODES...),
+	}
 	if body != nil {
 		err = json.Unmarshal(body, &cli)
 		if err != nil {
@@ -37,6 +55,20 @@ func NewRetiesClient(URL string, body json.RawMessage) (cli *RetiesClient) {
 		cli.clis = append(cli.clis, header.CreateClient(cfg))
 	}
 
+	cli.rcodes = make(map[int]bool)
+	for _, s := range cli.RetryRcodes {
+		rcode, ok := dns.StringToRcode[strings.ToUpper(s)]
+		if !ok {
+			panic(ErrRcode.Error())
+		}
+		cli.rcodes[rcode] = true
+	}
+
+	cli.bogus, err = ParseCIDRs(cli.BogusIPs)
+	if err != nil {
+		panic(err.Error())
+	}
+
 	return
 }
 
@@ -48,18 +80,78 @@ func (cli *RetiesClient) Url() (u string) {
 	return cli.clis[0].Url()
 }
 
+// Retry tells if the answer is not good enough, and the next client should be tried.
+func (cli *RetiesClient) Retry(ans *dns.Msg) bool {
+	switch {
+	case cli.rcodes[ans.Rcode]:
+		return true
+	case cli.RetryEmpty && ans.Rcode == dns.RcodeSuccess && len(ans.Answer) == 0:
+		return true
+	case cli.RetryTruncated && ans.Truncated:
+		return true
+	}
+
+	for _, rr := range ans.Answer {
+		var ip net.IP
+		switch v := rr.(type) {
+		case *dns.A:
+			ip = v.A
+		case *dns.AAAA:
+			ip = v.AAAA
+		default:
+			continue
+		}
+		for _, ipnet := range cli.bogus {
+			if ipnet.Contains(ip) {
+				logger.Infof("bogus ip %s in answer", ip.String())
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Exchange splits the time left equally to the tries left, so a quick failure leaves more time to the others.
 func (cli *RetiesClient) Exchange(ctx context.Context, quiz *dns.Msg) (ans *dns.Msg, err error) {
 	if len(cli.clis) == 0 {
 		panic(ErrEmptyClients.Error())
 	}
 
-	for i := 0; i < cli.Tries; i++ {
+	if cli.Timeout != 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(cli.Timeout)*time.Millisecond)
+		defer cancel()
+	}
+
+	tries := max(cli.Tries, 1) * len(cli.clis)
+	for i := 0; i < tries; i++ {
 		cur := cli.clis[i%len(cli.clis)]
-		ans, err = cur.Exchange(ctx, quiz)
-		if err == nil {
-			return
+
+		tryctx, cancel := ctx, context.CancelFunc(func() {})
+		if deadline, ok := ctx.Deadline(); ok {
+			tryctx, cancel = context.WithTimeout(ctx, time.Until(deadline)/time.Duration(tries-i))
+		}
+		var cur_ans *dns.Msg
+		cur_ans, err = cur.Exchange(tryctx, quiz)
+		cancel()
+
+		switch {
+		case err != nil:
+			logger.Info(err.Error())
+		case cli.Retry(cur_ans):
+			logger.Infof("retry answer from %s: %s", cur.Url(), dns.RcodeToString[cur_ans.Rcode])
+			ans = cur_ans
+		default:
+			return cur_ans, nil
 		}
-		logger.Info(err.Error())
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	// the answer to retry is better than an error.
+	if ans != nil {
+		err = nil
 	}
 	return
 }
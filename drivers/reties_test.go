@@ -0,0 +1,91 @@
+package drivers
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func NewTestReties(body string, clis ...Client) (cli *RetiesClient) {
+	cli = NewRetiesClient("", []byte(body))
+	for _, c := range clis {
+		cli.AddClient(c)
+	}
+	return
+}
+
+func TestRetiesConditions(t *testing.T) {
+	quiz := &dns.Msg{}
+	quiz.SetQuestion("www.example.com.", dns.TypeA)
+
+	for _, c := range []struct {
+		body  string
+		first *StaticClient
+		retry bool
+	}{
+		{`{}`, &StaticClient{Rcode: dns.RcodeServerFailure}, true},
+		{`{}`, &StaticClient{Rcode: dns.RcodeRefused}, true},
+		{`{}`, &StaticClient{Rcode: dns.RcodeNameError}, false},
+		{`{"retry-rcodes": ["nxdomain"]}`, &StaticClient{Rcode: dns.RcodeNameError}, true},
+		{`{"retry-rcodes": []}`, &StaticClient{Rcode: dns.RcodeServerFailure}, false},
+		{`{}`, &StaticClient{}, false},
+		{`{"retry-empty": true}`, &StaticClient{}, true},
+		{`{"bogus-ips": ["198.51.100.0/24"]}`, &StaticClient{Records: []string{"www.example.com. 300 IN A 198.51.100.1"}}, true},
+		{`{"bogus-ips": ["198.51.100.2"]}`, &StaticClient{Records: []string{"www.example.com. 300 IN A 198.51.100.1"}}, false},
+		{`{}`, &StaticClient{Err: errors.New("failed")}, true},
+	} {
+		second := &StaticClient{Records: []string{"www.example.com. 300 IN A 192.0.2.1"}}
+		cli := NewTestReties(c.body, c.first, second)
+		ans, err := cli.Exchange(context.Background(), quiz)
+		if err != nil {
+			t.Fatalf("exchange failed: %s", err)
+		}
+		if (second.Count.Load() == 1) != c.retry || c.retry && len(ans.Answer) != 1 {
+			t.Fatalf("wrong retry of %s %+v: %s", c.body, c.first, ans)
+		}
+	}
+}
+
+func TestRetiesTries(t *testing.T) {
+	quiz := &dns.Msg{}
+	quiz.SetQuestion("www.example.com.", dns.TypeA)
+
+	// each client is tried tries times, and the answer to retry is returned at last.
+	first := &StaticClient{Rcode: dns.RcodeServerFailure}
+	second := &StaticClient{Err: errors.New("failed")}
+	cli := NewTestReties(`{"tries": 2}`, first, second)
+	ans, err := cli.Exchange(context.Background(), quiz)
+	if err != nil || ans.Rcode != dns.RcodeServerFailure {
+		t.Fatalf("the answer to retry should be returned: %s %v", ans, err)
+	}
+	if first.Count.Load() != 2 || second.Count.Load() != 2 {
+		t.Fatalf("wrong tries: %d %d", first.Count.Load(), second.Count.Load())
+	}
+
+	cli = NewTestReties(`{}`, second)
+	_, err = cli.Exchange(context.Background(), quiz)
+	if err == nil {
+		t.Fatalf("exchange should fail")
+	}
+}
+
+func TestRetiesTimeout(t *testing.T) {
+	quiz := &dns.Msg{}
+	quiz.SetQuestion("www.example.com.", dns.TypeA)
+
+	// the slow one gets half of the budget, and the other one still has time.
+	slow := &DelayClient{upstream: &StaticClient{}, Delay: time.Second}
+	fast := &StaticClient{Records: []string{"www.example.com. 300 IN A 192.0.2.1"}}
+	cli := NewTestReties(`{"timeout": 200}`, slow, fast)
+	begin := time.Now()
+	ans, err := cli.Exchange(context.Background(), quiz)
+	if err != nil || len(ans.Answer) != 1 {
+		t.Fatalf("exchange failed: %s %v", ans, err)
+	}
+	if elapsed := time.Since(begin); elapsed < 80*time.Millisecond || elapsed > 200*time.Millisecond {
+		t.Fatalf("wrong time of try: %s", elapsed)
+	}
+}
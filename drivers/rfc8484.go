@@ -8,10 +8,21 @@ import (
 	"encoding/json"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+const (
+	HTTP3_OFF     = ""
+	HTTP3_UPGRADE = "upgrade"
+	HTTP3_ALWAYS  = "always"
 )
 
 func WriteFull(w io.Writer, b []byte) (err error) {
@@ -26,10 +37,17 @@ func WriteFull(w io.Writer, b []byte) (err error) {
 }
 
 type Rfc8484Client struct {
-	URL       string
-	Insecure  bool
-	Timeout   int
-	transport *http.Transport
+	URL     string
+	Timeout int
+	TLSOptions
+	HTTP3       string   `json:"http3"`
+	ECH         string   `json:"ech"`
+	ECHConfig   string   `json:"ech-config"`
+	Bootstrap   []string `json:"bootstrap"`
+	bootstrap   *Bootstrap
+	transport   *http.Transport
+	h3transport *http3.Transport
+	altsvc      atomic.Pointer[string]
 }
 
 func NewRfc8484Client(URL string, body json.RawMessage) (cli *Rfc8484Client) {
@@ -49,16 +67,119 @@ func NewRfc8484Client(URL string, body json.RawMessage) (cli *Rfc8484Client) {
 		cli.Timeout = Timeout
 	}
 
+	tlsconf, err := cli.NewTLSConfig("")
+	if err != nil {
+		panic(err.Error())
+	}
+
 	cli.transport = &http.Transport{
-		Proxy: http.ProxyFromEnvironment,
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: tlsconf,
+	}
+	// connect to the bootstrap IPs directly, not the proxy.
+	cli.bootstrap = NewBootstrap(cli.Bootstrap)
+	if cli.bootstrap != nil {
+		cli.transport.Proxy = nil
+		cli.transport.DialContext = cli.bootstrap.DialContext
+	}
+	if cli.ECH != ECH_OFF {
+		// ECH is not used in http3.
+		if cli.HTTP3 != HTTP3_OFF {
+			panic(ErrConfigParse.Error())
+		}
+		dialer, err := NewECHDialer(cli.ECH, cli.ECHConfig, cli.bootstrap, tlsconf)
+		if err != nil {
+			panic(err.Error())
+		}
+		cli.transport.Proxy = nil
+		cli.transport.DialTLSContext = dialer.DialTLSContext
+		cli.transport.ForceAttemptHTTP2 = true
 	}
-	if cli.Insecure {
-		cli.transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+
+	switch cli.HTTP3 {
+	case HTTP3_OFF:
+	case HTTP3_UPGRADE, HTTP3_ALWAYS:
+		cli.h3transport = &http3.Transport{
+			TLSClientConfig: tlsconf.Clone(),
+			Dial:            cli.DialQUIC,
+		}
+	default:
+		panic(ErrConfigParse.Error())
 	}
 
 	return
 }
 
+// DialQUIC connects to the alternative service if there is one, otherwise the origin.
+func (cli *Rfc8484Client) DialQUIC(ctx context.Context, addr string, tlsconf *tls.Config, conf *quic.Config) (conn *quic.Conn, err error) {
+	if alt := cli.altsvc.Load(); alt != nil {
+		addr = *alt
+	}
+	addrs, err := cli.bootstrap.Addrs(ctx, addr)
+	if err != nil {
+		return
+	}
+	for _, addr := range addrs {
+		logger.Debugf("http3 connect to %s", addr)
+		conn, err = quic.DialAddrEarly(ctx, addr, tlsconf, conf)
+		if err == nil {
+			return
+		}
+		logger.Info(err.Error())
+	}
+	return
+}
+
+// RoundTrip sends the request in http3 if it's forced or upgraded, falls back to tcp when upgraded one failed.
+func (cli *Rfc8484Client) RoundTrip(req *http.Request) (resp *http.Response, err error) {
+	if cli.HTTP3 == HTTP3_ALWAYS || cli.altsvc.Load() != nil {
+		resp, err = cli.h3transport.RoundTrip(req)
+		if err == nil || cli.HTTP3 == HTTP3_ALWAYS || req.Context().Err() != nil {
+			return
+		}
+		logger.Infof("http3 failed, fall back to tcp: %s", err.Error())
+		cli.altsvc.Store(nil)
+
+		req = req.Clone(req.Context())
+		req.Body, err = req.GetBody()
+		if err != nil {
+			return
+		}
+	}
+
+	resp, err = cli.transport.RoundTrip(req)
+	if err != nil || cli.HTTP3 != HTTP3_UPGRADE {
+		return
+	}
+	if addr, ok := ParseAltSvcH3(resp.Header.Values("Alt-Svc"), req.URL.Hostname()); ok {
+		logger.Infof("upgrade to http3: %s", addr)
+		cli.altsvc.Store(&addr)
+	}
+	return
+}
+
+// ParseAltSvcH3 returns the address of the first h3 alternative in Alt-Svc headers, RFC 7838 3.
+func ParseAltSvcH3(values []string, host string) (addr string, ok bool) {
+	for _, value := range values {
+		for _, alt := range strings.Split(value, ",") {
+			alt, _, _ = strings.Cut(strings.TrimSpace(alt), ";")
+			proto, authority, found := strings.Cut(alt, "=")
+			if !found || strings.TrimSpace(proto) != http3.NextProtoH3 {
+				continue
+			}
+			h, port, err := net.SplitHostPort(strings.Trim(strings.TrimSpace(authority), "\""))
+			if err != nil {
+				continue
+			}
+			if h == "" {
+				h = host
+			}
+			return net.JoinHostPort(h, port), true
+		}
+	}
+	return
+}
+
 func (cli *Rfc8484Client) Url() (u string) {
 	return cli.URL
 }
@@ -70,7 +191,9 @@ func (cli *Rfc8484Client) Exchange(ctx context.Context, quiz *dns.Msg) (ans *dns
 	}
 
 	if cli.Timeout != 0 {
-		ctx, _ = context.WithTimeout(ctx, time.Duration(cli.Timeout)*time.Millisecond)
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(cli.Timeout)*time.Millisecond)
+		defer cancel()
 	}
 
 	req, err := http.NewRequestWithContext(ctx, "POST", cli.URL, bytes.NewBuffer(bquiz))
@@ -81,7 +204,7 @@ func (cli *Rfc8484Client) Exchange(ctx context.Context, quiz *dns.Msg) (ans *dns
 	req.Header.Add("Accept", "application/dns-message")
 	req.Header.Add("Content-Type", "application/dns-message")
 
-	resp, err := cli.transport.RoundTrip(req)
+	resp, err := cli.RoundTrip(req)
 	if err != nil {
 		logger.Error(err.Error())
 		return
@@ -0,0 +1,216 @@
+package drivers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"regexp"
+	"strings"
+
+	"github.com/miekg/dns"
+	"github.com/shell909090/doh/domainlist"
+	"github.com/shell909090/doh/iplist"
+)
+
+var (
+	ErrNoRoute = errors.New("no rule matches the quiz")
+)
+
+// RouterRule matches the quiz if all the conditions in it are matched, a rule without condition matches everything.
+type RouterRule struct {
+	Names        []string `json:"names"`
+	DomainLists  []string `json:"domain-lists"`
+	Regex        string   `json:"regex"`
+	QTypes       []string `json:"qtypes"`
+	Subnets      []string `json:"subnets"`
+	AnswerRoutes string   `json:"answer-routes"`
+	AnswerIPs    []string `json:"answer-ips"`
+	Client       json.RawMessage
+	domains      *domainlist.DomainList
+	regex        *regexp.Regexp
+	qtypes       map[uint16]bool
+	subnets      []*net.IPNet
+	routes       *iplist.IPList
+	ips          []*net.IPNet
+	cli          Client
+}
+
+func (rule *RouterRule) Init() (err error) {
+	// names and domain lists are in the same trie.
+	if len(rule.Names) > 0 || len(rule.DomainLists) > 0 {
+		rule.domains, err = domainlist.ReadDomainListFile(rule.DomainLists...)
+		if err != nil {
+			return
+		}
+		for _, name := range rule.Names {
+			rule.domains.Add(name)
+		}
+	}
+	if rule.Regex != "" {
+		rule.regex, err = regexp.Compile(rule.Regex)
+		if err != nil {
+			return
+		}
+	}
+
+	if len(rule.QTypes) > 0 {
+		rule.qtypes = make(map[uint16]bool)
+		for _, s := range rule.QTypes {
+			qtype, ok := dns.StringToType[strings.ToUpper(s)]
+			if !ok {
+				return ErrConfigParse
+			}
+			rule.qtypes[qtype] = true
+		}
+	}
+
+	rule.subnets, err = ParseCIDRs(rule.Subnets)
+	if err != nil {
+		return
+	}
+	rule.ips, err = ParseCIDRs(rule.AnswerIPs)
+	if err != nil {
+		return
+	}
+	if rule.AnswerRoutes != "" {
+		rule.routes, err = iplist.ReadIPListFile(rule.AnswerRoutes)
+		if err != nil {
+			return
+		}
+	}
+
+	var header DriverHeader
+	err = json.Unmarshal(rule.Client, &header)
+	if err != nil {
+		return
+	}
+	rule.cli = header.CreateClient(rule.Client)
+	return
+}
+
+// Match checks the conditions of quiz, except the answer.
+func (rule *RouterRule) Match(quiz *dns.Msg) bool {
+	name := dns.CanonicalName(quiz.Question[0].Name)
+	if rule.domains != nil && !rule.domains.Contain(name) {
+		return false
+	}
+	if rule.regex != nil && !rule.regex.MatchString(strings.TrimSuffix(name, ".")) {
+		return false
+	}
+	if rule.qtypes != nil && !rule.qtypes[quiz.Question[0].Qtype] {
+		return false
+	}
+
+	if len(rule.subnets) > 0 {
+		var subnet *dns.EDNS0_SUBNET
+		if opt := quiz.IsEdns0(); opt != nil {
+			for _, o := range opt.Option {
+				if e, ok := o.(*dns.EDNS0_SUBNET); ok {
+					subnet = e
+				}
+			}
+		}
+		if subnet == nil || !iplist.ListConatins(rule.subnets, subnet.Address) {
+			return false
+		}
+	}
+	return true
+}
+
+// NeedAnswer means the rule has to query its client to decide.
+func (rule *RouterRule) NeedAnswer() bool {
+	return rule.routes != nil || len(rule.ips) > 0
+}
+
+// MatchAnswer means one of the addresses in answer is in the routes or ips.
+func (rule *RouterRule) MatchAnswer(ans *dns.Msg) bool {
+	for _, rr := range ans.Answer {
+		var ip net.IP
+		switch v := rr.(type) {
+		case *dns.A:
+			ip = v.A
+		case *dns.AAAA:
+			ip = v.AAAA
+		default:
+			continue
+		}
+		if rule.routes != nil && rule.routes.Contain(ip) || iplist.ListConatins(rule.ips, ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// RouterClient sends the quiz to the client of the first matched rule, or the default client.
+type RouterClient struct {
+	Rules       []*RouterRule
+	Default     json.RawMessage
+	default_cli Client
+}
+
+func NewRouterClient(URL string, body json.RawMessage) (cli *RouterClient) {
+	var err error
+	cli = &RouterClient{}
+	if body != nil {
+		err = json.Unmarshal(body, &cli)
+		if err != nil {
+			panic(err.Error())
+		}
+	}
+
+	for _, rule := range cli.Rules {
+		err = rule.Init()
+		if err != nil {
+			panic(err.Error())
+		}
+	}
+
+	if cli.Default != nil {
+		var header DriverHeader
+		err = json.Unmarshal(cli.Default, &header)
+		if err != nil {
+			panic(err.Error())
+		}
+		cli.default_cli = header.CreateClient(cli.Default)
+	}
+
+	if len(cli.Rules) == 0 && cli.default_cli == nil {
+		panic(ErrEmptyClients.Error())
+	}
+	return
+}
+
+func (cli *RouterClient) Url() (u string) {
+	if cli.default_cli != nil {
+		return cli.default_cli.Url()
+	}
+	return cli.Rules[0].cli.Url()
+}
+
+func (cli *RouterClient) Exchange(ctx context.Context, quiz *dns.Msg) (ans *dns.Msg, err error) {
+	for i, rule := range cli.Rules {
+		if !rule.Match(quiz) {
+			continue
+		}
+		if !rule.NeedAnswer() {
+			logger.Debugf("rule %d matched", i)
+			return rule.cli.Exchange(ctx, quiz)
+		}
+
+		ans, err = rule.cli.Exchange(ctx, quiz)
+		if err != nil {
+			logger.Info(err.Error())
+			continue
+		}
+		if rule.MatchAnswer(ans) {
+			logger.Debugf("rule %d matched by answer", i)
+			return
+		}
+	}
+
+	if cli.default_cli == nil {
+		return nil, ErrNoRoute
+	}
+	return cli.default_cli.Exchange(ctx, quiz)
+}
@@ -0,0 +1,141 @@
+package drivers
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// NewTestRouter replaces the clients of rules by static ones, answering 192.0.2.x for rule x, and 198.51.100.1 for default.
+func NewTestRouter(t *testing.T, body string) (cli *RouterClient) {
+	cli = NewRouterClient("", []byte(body))
+	for i, rule := range cli.Rules {
+		rule.cli = &StaticClient{Records: []string{fmt.Sprintf("www.example.com. 300 IN A 192.0.2.%d", i)}}
+	}
+	cli.default_cli = &StaticClient{Records: []string{"www.example.com. 300 IN A 198.51.100.1"}}
+	return
+}
+
+func TestRouter(t *testing.T) {
+	cli := NewTestRouter(t, `{
+	"rules": [
+		{"names": ["cn", "Example.com"], "client": {"url": "udp://127.0.0.1"}},
+		{"regex": "^ads\\.", "client": {"url": "udp://127.0.0.1"}},
+		{"names": ["example.org"], "qtypes": ["aaaa"], "client": {"url": "udp://127.0.0.1"}},
+		{"subnets": ["10.0.0.0/8"], "client": {"url": "udp://127.0.0.1"}},
+		{"answer-ips": ["192.0.2.0/24"], "client": {"url": "udp://127.0.0.1"}}
+	],
+	"default": {"url": "udp://127.0.0.1"}}`)
+
+	for _, c := range []struct {
+		name   string
+		qtype  uint16
+		subnet string
+		ip     string
+	}{
+		{"www.baidu.cn.", dns.TypeA, "", "192.0.2.0"},
+		{"EXAMPLE.com.", dns.TypeA, "", "192.0.2.0"},
+		{"ads.example.net.", dns.TypeA, "", "192.0.2.1"},
+		{"www.example.org.", dns.TypeAAAA, "", "192.0.2.2"},
+		{"10.0.0.1.example.net.", dns.TypeA, "10.0.0.1", "192.0.2.3"},
+		// the answer of the last rule is in answer-ips.
+		{"www.example.net.", dns.TypeA, "", "192.0.2.4"},
+	} {
+		quiz := &dns.Msg{}
+		quiz.SetQuestion(c.name, c.qtype)
+		if c.subnet != "" {
+			AppendEdns0Subnet(quiz, net.ParseIP(c.subnet), 24)
+		}
+		ans, err := cli.Exchange(context.Background(), quiz)
+		if err != nil {
+			t.Fatalf("exchange failed: %s", err)
+		}
+		if ip := ans.Answer[0].(*dns.A).A.String(); ip != c.ip {
+			t.Fatalf("wrong route of %s: %s", c.name, ip)
+		}
+	}
+
+	// the answer not in answer-ips goes to default.
+	cli.Rules[4].cli = &StaticClient{Records: []string{"www.example.com. 300 IN A 203.0.113.1"}}
+	quiz := &dns.Msg{}
+	quiz.SetQuestion("www.example.net.", dns.TypeA)
+	ans, err := cli.Exchange(context.Background(), quiz)
+	if err != nil || ans.Answer[0].(*dns.A).A.String() != "198.51.100.1" {
+		t.Fatalf("should go to default: %s %v", ans, err)
+	}
+
+	cli.default_cli = nil
+	_, err = cli.Exchange(context.Background(), quiz)
+	if err != ErrNoRoute {
+		t.Fatalf("no route should fail: %v", err)
+	}
+}
+
+func TestRouterNames(t *testing.T) {
+	rule := &RouterRule{Names: []string{"example.com"}, Client: []byte(`{"url": "udp://127.0.0.1"}`)}
+	err := rule.Init()
+	if err != nil {
+		t.Fatalf("init failed: %s", err)
+	}
+	for _, c := range []struct {
+		name  string
+		match bool
+	}{
+		{"example.com.", true},
+		{"www.example.com.", true},
+		{"notexample.com.", false},
+		{"example.com.cn.", false},
+	} {
+		quiz := &dns.Msg{}
+		quiz.SetQuestion(c.name, dns.TypeA)
+		if rule.Match(quiz) != c.match {
+			t.Fatalf("wrong match of %s", c.name)
+		}
+	}
+}
+
+// WriteTestDomainList writes a gzipped domain list in dnsmasq format.
+func WriteTestDomainList(t *testing.T, content string) (filename string) {
+	filename = filepath.Join(t.TempDir(), "accelerated-domains.china.conf.gz")
+	f, err := os.Create(filename)
+	if err != nil {
+		t.Fatalf("create failed: %s", err)
+	}
+	defer f.Close()
+	w := gzip.NewWriter(f)
+	defer w.Close()
+	w.Write([]byte(content))
+	return
+}
+
+func TestRouterDomainLists(t *testing.T) {
+	filename := WriteTestDomainList(t, "server=/baidu.com/114.114.114.114\n")
+	cli := NewTestRouter(t, `{
+	"rules": [{"names": ["cn"], "domain-lists": ["`+filename+`"], "client": {"url": "udp://127.0.0.1"}}],
+	"default": {"url": "udp://127.0.0.1"}}`)
+
+	for _, c := range []struct {
+		name string
+		ip   string
+	}{
+		{"www.baidu.com.", "192.0.2.0"},
+		{"www.gov.cn.", "192.0.2.0"},
+		{"www.google.com.", "198.51.100.1"},
+	} {
+		quiz := &dns.Msg{}
+		quiz.SetQuestion(c.name, dns.TypeA)
+		ans, err := cli.Exchange(context.Background(), quiz)
+		if err != nil {
+			t.Fatalf("exchange failed: %s", err)
+		}
+		if ip := ans.Answer[0].(*dns.A).A.String(); ip != c.ip {
+			t.Fatalf("wrong route of %s: %s", c.name, ip)
+		}
+	}
+}
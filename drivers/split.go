@@ -0,0 +1,63 @@
+package drivers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/miekg/dns"
+	"github.com/shell909090/doh/domainlist"
+)
+
+// SplitClient sends the names in domain lists to the client, and the others to the default.
+type SplitClient struct {
+	Lists       []string
+	Client      json.RawMessage
+	Default     json.RawMessage
+	list        *domainlist.DomainList
+	cli         Client
+	default_cli Client
+}
+
+func NewSplitClient(URL string, body json.RawMessage) (cli *SplitClient) {
+	var err error
+	cli = &SplitClient{}
+	if body != nil {
+		err = json.Unmarshal(body, &cli)
+		if err != nil {
+			panic(err.Error())
+		}
+	}
+
+	cli.list, err = domainlist.ReadDomainListFile(cli.Lists...)
+	if err != nil {
+		panic(err.Error())
+	}
+
+	var header DriverHeader
+	err = json.Unmarshal(cli.Client, &header)
+	if err != nil {
+		panic(err.Error())
+	}
+	cli.cli = header.CreateClient(cli.Client)
+
+	header = DriverHeader{}
+	err = json.Unmarshal(cli.Default, &header)
+	if err != nil {
+		panic(err.Error())
+	}
+	cli.default_cli = header.CreateClient(cli.Default)
+
+	return
+}
+
+func (cli *SplitClient) Url() (u string) {
+	return fmt.Sprintf("%s+%s", cli.cli.Url(), cli.default_cli.Url())
+}
+
+func (cli *SplitClient) Exchange(ctx context.Context, quiz *dns.Msg) (ans *dns.Msg, err error) {
+	if cli.list.Contain(quiz.Question[0].Name) {
+		return cli.cli.Exchange(ctx, quiz)
+	}
+	return cli.default_cli.Exchange(ctx, quiz)
+}
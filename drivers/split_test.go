@@ -0,0 +1,34 @@
+package drivers
+
+import (
+	"context"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestSplit(t *testing.T) {
+	filename := WriteTestDomainList(t, "server=/baidu.com/114.114.114.114\nserver=/qq.com/114.114.114.114\n")
+	cli := NewSplitClient("", []byte(`{"lists": ["`+filename+`"], "client": {"url": "udp://127.0.0.1"}, "default": {"url": "udp://127.0.0.2"}}`))
+	cli.cli = &StaticClient{Records: []string{"www.example.com. 300 IN A 192.0.2.1"}}
+	cli.default_cli = &StaticClient{Records: []string{"www.example.com. 300 IN A 198.51.100.1"}}
+
+	for _, c := range []struct {
+		name string
+		ip   string
+	}{
+		{"www.baidu.com.", "192.0.2.1"},
+		{"QQ.com.", "192.0.2.1"},
+		{"www.google.com.", "198.51.100.1"},
+	} {
+		quiz := &dns.Msg{}
+		quiz.SetQuestion(c.name, dns.TypeA)
+		ans, err := cli.Exchange(context.Background(), quiz)
+		if err != nil {
+			t.Fatalf("exchange failed: %s", err)
+		}
+		if ip := ans.Answer[0].(*dns.A).A.String(); ip != c.ip {
+			t.Fatalf("wrong split of %s: %s", c.name, ip)
+		}
+	}
+}
@@ -0,0 +1,327 @@
+package drivers
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/url"
+	"strings"
+)
+
+const (
+	STAMP_PLAIN    = 0x00
+	STAMP_DNSCRYPT = 0x01
+	STAMP_DOH      = 0x02
+	STAMP_DOT      = 0x03
+	STAMP_DOQ      = 0x04
+	STAMP_PREFIX   = "sdns://"
+)
+
+var (
+	ErrStamp      = errors.New("malformed dns stamp")
+	ErrStampProto = errors.New("unsupported dns stamp protocol")
+	ErrCertHash   = errors.New("no certificate matches the hashes")
+)
+
+// Stamp is the DNS stamp in https://dnscrypt.info/stamps-specifications.
+// The dnsstamps package doesn't read the bootstrap IPs, so here is our own.
+type Stamp struct {
+	Proto     uint8
+	Props     uint64
+	Addr      string
+	Hashes    [][]byte
+	Host      string
+	Path      string
+	Bootstrap []string
+	PublicKey []byte
+}
+
+type stampReader struct {
+	b   []byte
+	err error
+}
+
+func (r *stampReader) byte() (c byte) {
+	if r.err != nil || len(r.b) == 0 {
+		r.err = ErrStamp
+		return
+	}
+	c, r.b = r.b[0], r.b[1:]
+	return
+}
+
+func (r *stampReader) bytes(n int) (b []byte) {
+	if r.err != nil || len(r.b) < n {
+		r.err = ErrStamp
+		return
+	}
+	b, r.b = r.b[:n], r.b[n:]
+	return
+}
+
+// LP reads a length prefixed string.
+func (r *stampReader) LP() []byte {
+	return r.bytes(int(r.byte()))
+}
+
+// VLP reads a set of strings, the high bit of length means there are more.
+func (r *stampReader) VLP() (set [][]byte) {
+	for r.err == nil {
+		l := r.byte()
+		if b := r.bytes(int(l & 0x7f)); len(b) > 0 {
+			set = append(set, b)
+		}
+		if l&0x80 == 0 {
+			break
+		}
+	}
+	return
+}
+
+func AppendLP(buf []byte, b []byte) []byte {
+	buf = append(buf, byte(len(b)))
+	return append(buf, b...)
+}
+
+func AppendVLP(buf []byte, set [][]byte) []byte {
+	if len(set) == 0 {
+		return append(buf, 0)
+	}
+	for i, b := range set {
+		l := byte(len(b))
+		if i < len(set)-1 {
+			l |= 0x80
+		}
+		buf = append(buf, l)
+		buf = append(buf, b...)
+	}
+	return buf
+}
+
+func ParseStamp(s string) (stamp *Stamp, err error) {
+	if !strings.HasPrefix(s, STAMP_PREFIX) {
+		return nil, ErrStamp
+	}
+	b, err := base64.RawURLEncoding.DecodeString(s[len(STAMP_PREFIX):])
+	if err != nil {
+		return nil, ErrStamp
+	}
+
+	r := &stampReader{b: b}
+	stamp = &Stamp{Proto: r.byte()}
+	if p := r.bytes(8); p != nil {
+		stamp.Props = binary.LittleEndian.Uint64(p)
+	}
+	stamp.Addr = string(r.LP())
+
+	switch stamp.Proto {
+	case STAMP_PLAIN:
+	case STAMP_DNSCRYPT:
+		stamp.PublicKey = r.LP()
+		stamp.Host = string(r.LP())
+	case STAMP_DOH, STAMP_DOT, STAMP_DOQ:
+		stamp.Hashes = r.VLP()
+		stamp.Host = string(r.LP())
+		if stamp.Proto == STAMP_DOH {
+			stamp.Path = string(r.LP())
+		}
+		// the bootstrap IPs are optional.
+		if r.err == nil && len(r.b) > 0 {
+			for _, ip := range r.VLP() {
+				stamp.Bootstrap = append(stamp.Bootstrap, string(ip))
+			}
+		}
+	default:
+		return nil, ErrStampProto
+	}
+
+	if r.err != nil || len(r.b) != 0 {
+		return nil, ErrStamp
+	}
+	return
+}
+
+func (stamp *Stamp) String() string {
+	b := []byte{stamp.Proto}
+	b = binary.LittleEndian.AppendUint64(b, stamp.Props)
+	b = AppendLP(b, []byte(stamp.Addr))
+
+	switch stamp.Proto {
+	case STAMP_DNSCRYPT:
+		b = AppendLP(b, stamp.PublicKey)
+		b = AppendLP(b, []byte(stamp.Host))
+	case STAMP_DOH, STAMP_DOT, STAMP_DOQ:
+		b = AppendVLP(b, stamp.Hashes)
+		b = AppendLP(b, []byte(stamp.Host))
+		if stamp.Proto == STAMP_DOH {
+			b = AppendLP(b, []byte(stamp.Path))
+		}
+		if len(stamp.Bootstrap) > 0 {
+			var ips [][]byte
+			for _, ip := range stamp.Bootstrap {
+				ips = append(ips, []byte(ip))
+			}
+			b = AppendVLP(b, ips)
+		}
+	}
+	return STAMP_PREFIX + base64.RawURLEncoding.EncodeToString(b)
+}
+
+func (stamp *Stamp) Driver() (driver string) {
+	switch stamp.Proto {
+	case STAMP_PLAIN:
+		return "dns"
+	case STAMP_DNSCRYPT:
+		return "dnscrypt"
+	case STAMP_DOH:
+		return "rfc8484"
+	case STAMP_DOT:
+		return "dns"
+	case STAMP_DOQ:
+		return "doq"
+	}
+	return
+}
+
+// URL returns the url for driver, the stamp itself for dnscrypt.
+func (stamp *Stamp) URL() (URL string) {
+	host := stamp.Host
+	if host == "" {
+		host = stamp.Addr
+	}
+	switch stamp.Proto {
+	case STAMP_PLAIN:
+		return "udp://" + stamp.Addr
+	case STAMP_DNSCRYPT:
+		return stamp.String()
+	case STAMP_DOH:
+		return (&url.URL{Scheme: "https", Host: host, Path: stamp.Path}).String()
+	case STAMP_DOT:
+		return "tcp-tls://" + host
+	case STAMP_DOQ:
+		return "quic://" + host
+	}
+	return
+}
+
+// BootstrapIPs returns the IPs to connect, the address and bootstrap IPs in stamp.
+func (stamp *Stamp) BootstrapIPs() (ips []string) {
+	for _, addr := range append([]string{stamp.Addr}, stamp.Bootstrap...) {
+		if addr == "" {
+			continue
+		}
+		if host, _, err := net.SplitHostPort(addr); err == nil {
+			addr = host
+		}
+		addr = strings.Trim(addr, "[]")
+		if net.ParseIP(addr) != nil {
+			ips = append(ips, addr)
+		}
+	}
+	return
+}
+
+// Options merges the hashes and bootstrap IPs of stamp into the body of client, the body has higher priority.
+func (stamp *Stamp) Options(body json.RawMessage) (nbody json.RawMessage, err error) {
+	opts := make(map[string]json.RawMessage)
+	if body != nil {
+		err = json.Unmarshal(body, &opts)
+		if err != nil {
+			return
+		}
+	}
+
+	if _, ok := opts["hashes"]; !ok && len(stamp.Hashes) > 0 {
+		var hashes []string
+		for _, h := range stamp.Hashes {
+			hashes = append(hashes, hex.EncodeToString(h))
+		}
+		opts["hashes"], _ = json.Marshal(hashes)
+	}
+	if ips := stamp.BootstrapIPs(); len(ips) > 0 && stamp.Proto != STAMP_PLAIN {
+		if _, ok := opts["bootstrap"]; !ok {
+			opts["bootstrap"], _ = json.Marshal(ips)
+		}
+	}
+	return json.Marshal(opts)
+}
+
+// NewStampFromURL makes the stamp of url, without hashes.
+func NewStampFromURL(URL string) (stamp *Stamp, err error) {
+	if strings.HasPrefix(URL, STAMP_PREFIX) {
+		return ParseStamp(URL)
+	}
+
+	u, err := url.Parse(URL)
+	if err != nil {
+		return
+	}
+	stamp = &Stamp{}
+
+	var port string
+	switch u.Scheme {
+	case "udp", "tcp":
+		stamp.Proto, port = STAMP_PLAIN, "53"
+	case "tcp-tls":
+		stamp.Proto, port = STAMP_DOT, "853"
+	case "quic":
+		stamp.Proto, port = STAMP_DOQ, "853"
+	case "https":
+		stamp.Proto, port = STAMP_DOH, "443"
+		stamp.Path = u.Path
+	default:
+		return nil, ErrStampProto
+	}
+
+	// the default port is omitted in stamps.
+	host := u.Host
+	if u.Port() == port {
+		host = u.Hostname()
+		if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+	}
+	if net.ParseIP(u.Hostname()) != nil {
+		stamp.Addr = host
+	}
+	if stamp.Proto != STAMP_PLAIN {
+		stamp.Host = host
+	}
+	if stamp.Proto == STAMP_PLAIN && stamp.Addr == "" {
+		return nil, ErrStamp
+	}
+	return
+}
+
+// ExpandStamp translates the stamp into driver, url and body of the client.
+func ExpandStamp(URL string, body json.RawMessage) (driver, nURL string, nbody json.RawMessage, err error) {
+	stamp, err := ParseStamp(URL)
+	if err != nil {
+		return
+	}
+	nbody, err = stamp.Options(body)
+	if err != nil {
+		return
+	}
+	return stamp.Driver(), stamp.URL(), nbody, nil
+}
+
+// VerifyCertHashes checks that one of certificates has the sha256 of TBS certificate in hashes.
+func VerifyCertHashes(hashes []string) func(cs tls.ConnectionState) error {
+	return func(cs tls.ConnectionState) error {
+		for _, cert := range cs.PeerCertificates {
+			sum := sha256.Sum256(cert.RawTBSCertificate)
+			for _, h := range hashes {
+				if strings.EqualFold(h, hex.EncodeToString(sum[:])) {
+					return nil
+				}
+			}
+		}
+		return ErrCertHash
+	}
+}
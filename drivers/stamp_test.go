@@ -0,0 +1,124 @@
+package drivers
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestParseStamp(t *testing.T) {
+	for _, c := range []struct {
+		stamp  string
+		driver string
+		URL    string
+	}{
+		{"sdns://AgUAAAAAAAAAAAAKZG5zLmdvb2dsZQovZG5zLXF1ZXJ5", "rfc8484", "https://dns.google/dns-query"},
+		{"sdns://AAAAAAAAAAAABzguOC44Ljg", "dns", "udp://8.8.8.8"},
+		{"sdns://AwAAAAAAAAAABzEuMS4xLjEABzEuMS4xLjE", "dns", "tcp-tls://1.1.1.1"},
+		{"sdns://BAAAAAAAAAAAAAAPZG5zLmFkZ3VhcmQuY29t", "doq", "quic://dns.adguard.com"},
+	} {
+		stamp, err := ParseStamp(c.stamp)
+		if err != nil {
+			t.Fatalf("parse %s failed: %s", c.stamp, err)
+		}
+		if stamp.Driver() != c.driver || stamp.URL() != c.URL {
+			t.Fatalf("wrong stamp %s: %s %s", c.stamp, stamp.Driver(), stamp.URL())
+		}
+		if driver, _ := GuessDriver(c.stamp); driver != c.driver {
+			t.Fatalf("wrong driver guessed for %s: %s", c.stamp, driver)
+		}
+	}
+
+	_, err := ParseStamp("sdns://AgUAAAAAAAAAAAAKZG5z")
+	if err == nil {
+		t.Fatalf("truncated stamp should fail")
+	}
+}
+
+func TestStampRoundTrip(t *testing.T) {
+	stamp := &Stamp{
+		Proto:     STAMP_DOH,
+		Props:     1,
+		Hashes:    [][]byte{make([]byte, 32), {1, 2, 3}},
+		Host:      "doh.example.com:8443",
+		Path:      "/dns-query",
+		Bootstrap: []string{"192.0.2.1", "2001:db8::1"},
+	}
+	parsed, err := ParseStamp(stamp.String())
+	if err != nil {
+		t.Fatalf("parse failed: %s", err)
+	}
+	if parsed.String() != stamp.String() || len(parsed.Hashes) != 2 || len(parsed.Bootstrap) != 2 {
+		t.Fatalf("wrong round trip: %+v", parsed)
+	}
+
+	body, err := parsed.Options([]byte(`{"timeout": 100, "bootstrap": ["198.51.100.1"]}`))
+	if err != nil {
+		t.Fatalf("options failed: %s", err)
+	}
+	var opts struct {
+		Timeout   int
+		Hashes    []string
+		Bootstrap []string
+	}
+	json.Unmarshal(body, &opts)
+	if opts.Timeout != 100 || len(opts.Hashes) != 2 || len(opts.Bootstrap) != 1 || opts.Bootstrap[0] != "198.51.100.1" {
+		t.Fatalf("wrong options: %s", body)
+	}
+}
+
+func TestStampDoQ(t *testing.T) {
+	upstream := &StaticClient{Records: []string{"www.example.com. 300 IN A 192.0.2.1"}}
+	URL := StartTestDoQ(t, upstream)
+	_, port, _ := net.SplitHostPort(strings.TrimPrefix(URL, "quic://"))
+
+	// the hostname is only used in tls, the address is from bootstrap.
+	stamp := &Stamp{Proto: STAMP_DOQ, Host: "localhost:" + port, Bootstrap: []string{"127.0.0.1"}}
+	header := &DriverHeader{URL: stamp.String()}
+	cli := header.CreateClient([]byte(`{"insecure": true}`)).(*DoQClient)
+	addrs, _ := cli.bootstrap.Addrs(context.Background(), cli.addr)
+	if len(addrs) != 1 || addrs[0] != "127.0.0.1:"+port || cli.tlsconf.ServerName != "localhost" {
+		t.Fatalf("wrong address: %v %s", addrs, cli.tlsconf.ServerName)
+	}
+
+	quiz := &dns.Msg{}
+	quiz.SetQuestion("www.example.com.", dns.TypeA)
+	_, err := cli.Exchange(context.Background(), quiz)
+	if err != nil {
+		t.Fatalf("exchange failed: %s", err)
+	}
+
+	stamp.Hashes = [][]byte{make([]byte, 32)}
+	header = &DriverHeader{URL: stamp.String()}
+	cli = header.CreateClient([]byte(`{"insecure": true, "timeout": 1000}`)).(*DoQClient)
+	_, err = cli.Exchange(context.Background(), quiz)
+	if err == nil {
+		t.Fatalf("wrong hash should fail")
+	}
+}
+
+func TestVerifyCertHashes(t *testing.T) {
+	certfile, keyfile := NewTestCert(t)
+	cert, err := tls.LoadX509KeyPair(certfile, keyfile)
+	if err != nil {
+		t.Fatalf("load cert failed: %s", err)
+	}
+	leaf := cert.Leaf
+	sum := sha256.Sum256(leaf.RawTBSCertificate)
+
+	cs := tls.ConnectionState{PeerCertificates: []*x509.Certificate{leaf}}
+	if VerifyCertHashes([]string{hex.EncodeToString(sum[:])})(cs) != nil {
+		t.Fatalf("hash of certificate should match")
+	}
+	if VerifyCertHashes([]string{hex.EncodeToString(make([]byte, 32))})(cs) != ErrCertHash {
+		t.Fatalf("wrong hash should not match")
+	}
+}
@@ -0,0 +1,88 @@
+package drivers
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"os"
+)
+
+var (
+	ErrCAFile  = errors.New("no certificate in ca file")
+	ErrCertPin = errors.New("no certificate matches the pins")
+)
+
+// TLSOptions are the tls settings shared by the clients in tls.
+type TLSOptions struct {
+	Insecure   bool
+	CAFile     string   `json:"ca-file"`
+	Pins       []string `json:"pins"`
+	Hashes     []string `json:"hashes"`
+	ServerName string   `json:"server-name"`
+	CertFile   string   `json:"cert-file"`
+	KeyFile    string   `json:"key-file"`
+}
+
+// NewTLSConfig makes the tls config, serverName is used if server-name isn't set.
+func (opts *TLSOptions) NewTLSConfig(serverName string) (tlsconf *tls.Config, err error) {
+	tlsconf = &tls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: opts.Insecure,
+	}
+	if opts.ServerName != "" {
+		tlsconf.ServerName = opts.ServerName
+	}
+
+	if opts.CAFile != "" {
+		var pem []byte
+		pem, err = os.ReadFile(opts.CAFile)
+		if err != nil {
+			return
+		}
+		tlsconf.RootCAs = x509.NewCertPool()
+		if !tlsconf.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, ErrCAFile
+		}
+	}
+
+	if opts.CertFile != "" && opts.KeyFile != "" {
+		var cert tls.Certificate
+		cert, err = tls.LoadX509KeyPair(opts.CertFile, opts.KeyFile)
+		if err != nil {
+			return
+		}
+		tlsconf.Certificates = []tls.Certificate{cert}
+	}
+
+	if len(opts.Hashes) > 0 || len(opts.Pins) > 0 {
+		tlsconf.VerifyConnection = func(cs tls.ConnectionState) error {
+			if len(opts.Hashes) > 0 {
+				if err := VerifyCertHashes(opts.Hashes)(cs); err != nil {
+					return err
+				}
+			}
+			if len(opts.Pins) > 0 {
+				return VerifyCertPins(opts.Pins)(cs)
+			}
+			return nil
+		}
+	}
+	return
+}
+
+// VerifyCertPins checks that one of certificates has the base64 encoded sha256 of SPKI in pins, RFC 7858 4.2.
+func VerifyCertPins(pins []string) func(cs tls.ConnectionState) error {
+	return func(cs tls.ConnectionState) error {
+		for _, cert := range cs.PeerCertificates {
+			sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+			for _, pin := range pins {
+				if pin == base64.StdEncoding.EncodeToString(sum[:]) {
+					return nil
+				}
+			}
+		}
+		return ErrCertPin
+	}
+}
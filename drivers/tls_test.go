@@ -0,0 +1,80 @@
+package drivers
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"os"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// StartTestMutualTLS serves upstream in tcp-tls, and requires the client certificate signed by the cert itself.
+func StartTestMutualTLS(t *testing.T, upstream Client, certfile, keyfile string) (addr string) {
+	cert, err := tls.LoadX509KeyPair(certfile, keyfile)
+	if err != nil {
+		t.Fatalf("load cert failed: %s", err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert.Leaf)
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+	})
+	if err != nil {
+		t.Fatalf("listen failed: %s", err)
+	}
+	srv := &dns.Server{Listener: ln, Net: "tcp-tls", Handler: dns.HandlerFunc(func(w dns.ResponseWriter, quiz *dns.Msg) {
+		ans, _ := upstream.Exchange(context.Background(), quiz)
+		w.WriteMsg(ans)
+	})}
+	go srv.ActivateAndServe()
+	t.Cleanup(func() { srv.Shutdown() })
+	return ln.Addr().String()
+}
+
+func TestTLSOptions(t *testing.T) {
+	upstream := &StaticClient{Records: []string{"www.example.com. 300 IN A 192.0.2.1"}}
+	certfile, keyfile := NewTestCert(t)
+	addr := StartTestMutualTLS(t, upstream, certfile, keyfile)
+
+	cert, _ := tls.LoadX509KeyPair(certfile, keyfile)
+	sum := sha256.Sum256(cert.Leaf.RawSubjectPublicKeyInfo)
+	pin := base64.StdEncoding.EncodeToString(sum[:])
+	ca := `"ca-file": "` + certfile + `"`
+	mtls := `"cert-file": "` + certfile + `", "key-file": "` + keyfile + `"`
+
+	quiz := &dns.Msg{}
+	quiz.SetQuestion("www.example.com.", dns.TypeA)
+	for _, c := range []struct {
+		body string
+		ok   bool
+	}{
+		{`{"insecure": false}`, false},
+		{`{` + ca + `}`, false},
+		{`{` + ca + `, ` + mtls + `}`, true},
+		{`{` + ca + `, ` + mtls + `, "server-name": "dns.example.test"}`, false},
+		{`{` + ca + `, ` + mtls + `, "pins": ["` + pin + `"]}`, true},
+		{`{` + ca + `, ` + mtls + `, "pins": ["AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA="]}`, false},
+		{`{"insecure": true, ` + mtls + `, "pins": ["` + pin + `"]}`, true},
+	} {
+		cli := NewDnsClient("tcp-tls://"+addr, []byte(`{"timeout": 1000, "no-pipeline": true, `+c.body[1:]))
+		_, err := cli.Exchange(context.Background(), quiz)
+		if (err == nil) != c.ok {
+			t.Fatalf("wrong result of %s: %v", c.body, err)
+		}
+	}
+}
+
+func TestTLSOptionsCAFile(t *testing.T) {
+	file := t.TempDir() + "/ca.pem"
+	os.WriteFile(file, []byte("not a certificate"), 0600)
+	opts := &TLSOptions{CAFile: file}
+	if _, err := opts.NewTLSConfig(""); err != ErrCAFile {
+		t.Fatalf("wrong ca file should fail: %v", err)
+	}
+}
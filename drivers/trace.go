@@ -0,0 +1,104 @@
+package drivers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+type traceKey struct{}
+
+// TraceStep is one query sent to a name server during the recursion.
+type TraceStep struct {
+	Depth    int
+	Zone     string
+	Server   string
+	Address  string
+	Name     string
+	Type     string
+	RTT      time.Duration
+	Rcode    string
+	Error    string  `json:",omitempty"`
+	Response *DNSMsg `json:",omitempty"`
+	msg      *dns.Msg
+}
+
+type Trace struct {
+	mu    sync.Mutex
+	Steps []*TraceStep
+}
+
+func WithTrace(ctx context.Context, trace *Trace) context.Context {
+	return context.WithValue(ctx, traceKey{}, trace)
+}
+
+func GetTrace(ctx context.Context) (trace *Trace) {
+	trace, _ = ctx.Value(traceKey{}).(*Trace)
+	return
+}
+
+func (trace *Trace) Add(step *TraceStep) {
+	trace.mu.Lock()
+	defer trace.mu.Unlock()
+	trace.Steps = append(trace.Steps, step)
+	return
+}
+
+func NewTraceStep(depth int, zone, server, addr string, quiz, interm *dns.Msg, rtt time.Duration, err error) (step *TraceStep) {
+	step = &TraceStep{
+		Depth:   depth,
+		Zone:    zone,
+		Server:  server,
+		Address: addr,
+		Name:    quiz.Question[0].Name,
+		Type:    dns.TypeToString[quiz.Question[0].Qtype],
+		RTT:     rtt,
+	}
+	if err != nil {
+		step.Error = err.Error()
+		return
+	}
+	step.Rcode = dns.RcodeToString[interm.Rcode]
+	step.msg = interm
+	response := &DNSMsg{}
+	err = response.FromAnswer(quiz, interm)
+	if err != nil {
+		step.Error = err.Error()
+		return
+	}
+	step.Response = response
+	return
+}
+
+// Format prints the step like dig +trace, rtt in microseconds if micro is true.
+func (step *TraceStep) Format(micro bool) string {
+	var sb strings.Builder
+	indent := strings.Repeat("  ", step.Depth)
+	rtt := fmt.Sprintf("%d ms", step.RTT.Milliseconds())
+	if micro {
+		rtt = fmt.Sprintf("%d us", step.RTT.Microseconds())
+	}
+
+	status := step.Rcode
+	if step.Error != "" {
+		status = "error: " + step.Error
+	}
+	fmt.Fprintf(&sb, "%s;; %s %s @%s(%s) zone %s in %s: %s\n",
+		indent, step.Name, step.Type, step.Server, step.Address, step.Zone, rtt, status)
+
+	if step.msg != nil {
+		for _, section := range [][]dns.RR{step.msg.Answer, step.msg.Ns, step.msg.Extra} {
+			for _, rr := range section {
+				if rr.Header().Rrtype == dns.TypeOPT {
+					continue
+				}
+				fmt.Fprintf(&sb, "%s%s\n", indent, rr.String())
+			}
+		}
+	}
+	return sb.String()
+}
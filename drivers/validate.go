@@ -0,0 +1,88 @@
+package drivers
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/miekg/dns"
+)
+
+type ValidateClient struct {
+	Client      json.RawMessage
+	TrustAnchor string `json:"trust-anchor"`
+	cli         Client
+	validator   *Validator
+}
+
+func NewValidateClient(URL string, body json.RawMessage) (cli *ValidateClient) {
+	var err error
+	cli = &ValidateClient{}
+	if body != nil {
+		err = json.Unmarshal(body, &cli)
+		if err != nil {
+			panic(err.Error())
+		}
+	}
+
+	var header DriverHeader
+	err = json.Unmarshal(cli.Client, &header)
+	if err != nil {
+		panic(err.Error())
+	}
+	cli.cli = header.CreateClient(cli.Client)
+	logger.Debugf("validate upstream: %+v", cli.cli)
+
+	anchors := DefaultTrustAnchors()
+	if cli.TrustAnchor != "" {
+		anchors, err = ReadTrustAnchorFile(cli.TrustAnchor)
+		if err != nil {
+			panic(err.Error())
+		}
+	}
+	cli.validator = NewValidator(cli.cli.Exchange, anchors)
+	return
+}
+
+func (cli *ValidateClient) Url() (u string) {
+	return cli.cli.Url()
+}
+
+func (cli *ValidateClient) Exchange(ctx context.Context, quiz *dns.Msg) (ans *dns.Msg, err error) {
+	if len(quiz.Question) != 1 {
+		return cli.cli.Exchange(ctx, quiz)
+	}
+
+	// ask for the signatures, and don't let the upstream drop the bogus data.
+	req := quiz.Copy()
+	if opt := req.IsEdns0(); opt != nil {
+		opt.SetDo()
+	} else {
+		req.SetEdns0(4096, true)
+	}
+	req.CheckingDisabled = true
+
+	ans, err = cli.cli.Exchange(ctx, req)
+	if err != nil {
+		return
+	}
+	ans.Id = quiz.Id
+	ans.AuthenticatedData = false
+
+	if !quiz.CheckingDisabled {
+		var secure bool
+		secure, err = cli.validator.Validate(ctx, ans)
+		if err != nil {
+			logger.Infof("validate %s failed: %s", quiz.Question[0].Name, err.Error())
+			return ServFail(quiz, ValidateErrorCode(err), err.Error()), nil
+		}
+		ans.AuthenticatedData = secure
+	}
+
+	if opt := quiz.IsEdns0(); opt == nil || !opt.Do() {
+		StripDNSSEC(ans, quiz.Question[0].Qtype)
+		if opt == nil {
+			StripOPT(ans)
+		}
+	}
+	return
+}
@@ -0,0 +1,130 @@
+package drivers
+
+import (
+	"context"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func NewTestValidate(t *testing.T, upstream Client, anchors string) (cli *ValidateClient) {
+	cli = NewValidateClient("", []byte(`{"client": {"url": "udp://127.0.0.1:1"}, "trust-anchor": "`+anchors+`"}`))
+	cli.cli = upstream
+	cli.validator.exchange = upstream.Exchange
+	return
+}
+
+func TestValidate(t *testing.T) {
+	auth, anchors := StartSignedTestAuth(t)
+	upstream := NewTestRecursiveClient(t, auth, "")
+	cli := NewTestValidate(t, upstream, anchors)
+
+	quiz := &dns.Msg{}
+	quiz.SetQuestion("www.example.com.", dns.TypeA)
+	quiz.SetEdns0(4096, true)
+	ans, err := cli.Exchange(context.Background(), quiz)
+	if err != nil {
+		t.Fatalf("exchange failed: %s", err)
+	}
+	if !ans.AuthenticatedData || len(Signatures(ans.Answer, "www.example.com.", dns.TypeA)) == 0 {
+		t.Fatalf("wrong secure answer: %s", ans)
+	}
+
+	quiz.SetQuestion("bogus.example.com.", dns.TypeA)
+	ans, err = cli.Exchange(context.Background(), quiz)
+	if err != nil {
+		t.Fatalf("exchange failed: %s", err)
+	}
+	if ans.Rcode != dns.RcodeServerFailure {
+		t.Fatalf("bogus answer should be servfail: %s", ans)
+	}
+
+	quiz = &dns.Msg{}
+	quiz.SetQuestion("nx.example.com.", dns.TypeA)
+	ans, err = cli.Exchange(context.Background(), quiz)
+	if err != nil {
+		t.Fatalf("exchange failed: %s", err)
+	}
+	if ans.Rcode != dns.RcodeNameError || !ans.AuthenticatedData || len(ans.Ns) != 1 || ans.IsEdns0() != nil {
+		t.Fatalf("dnssec records should be stripped: %s", ans)
+	}
+}
+
+func TestValidateUnsigned(t *testing.T) {
+	auth, anchors := StartSignedTestAuth(t)
+	upstream := &StaticClient{Records: []string{"www.example.com. 300 IN A 192.0.2.1"}}
+	cli := NewTestValidate(t, upstream, anchors)
+	cli.validator.exchange = NewTestRecursiveClient(t, auth, "").Exchange
+
+	quiz := &dns.Msg{}
+	quiz.SetQuestion("www.example.com.", dns.TypeA)
+	ans, err := cli.Exchange(context.Background(), quiz)
+	if err != nil {
+		t.Fatalf("exchange failed: %s", err)
+	}
+	if ans.Rcode != dns.RcodeServerFailure {
+		t.Fatalf("unsigned answer in signed zone should be servfail: %s", ans)
+	}
+
+	upstream.Records = []string{"www.ample.com. 300 IN A 192.0.2.100"}
+	quiz.SetQuestion("www.ample.com.", dns.TypeA)
+	ans, err = cli.Exchange(context.Background(), quiz)
+	if err != nil {
+		t.Fatalf("exchange failed: %s", err)
+	}
+	if ans.Rcode != dns.RcodeSuccess || ans.AuthenticatedData {
+		t.Fatalf("unsigned answer in insecure zone should be passed: %s", ans)
+	}
+}
+
+// ForgeClient answers every quiz with a forged denial, without the question if NoQuestion is set.
+type ForgeClient struct {
+	Rcode      int
+	NoQuestion bool
+}
+
+func (cli *ForgeClient) Url() (u string) {
+	return "forge://"
+}
+
+func (cli *ForgeClient) Exchange(ctx context.Context, quiz *dns.Msg) (ans *dns.Msg, err error) {
+	ans = ForgeDenial(quiz, cli.Rcode)
+	if cli.NoQuestion {
+		ans.Question = nil
+	}
+	return
+}
+
+func TestValidateForgedDenial(t *testing.T) {
+	auth, anchors := StartSignedTestAuth(t)
+	for _, rcode := range []int{dns.RcodeNameError, dns.RcodeSuccess} {
+		cli := NewTestValidate(t, &ForgeClient{Rcode: rcode}, anchors)
+		cli.validator.exchange = NewTestRecursiveClient(t, auth, "").Exchange
+
+		quiz := &dns.Msg{}
+		quiz.SetQuestion("www.example.com.", dns.TypeA)
+		ans, err := cli.Exchange(context.Background(), quiz)
+		if err != nil {
+			t.Fatalf("exchange failed: %s", err)
+		}
+		if ans.Rcode != dns.RcodeServerFailure {
+			t.Fatalf("forged %s should be servfail: %s", dns.RcodeToString[rcode], ans)
+		}
+	}
+}
+
+func TestValidateNoQuestion(t *testing.T) {
+	auth, anchors := StartSignedTestAuth(t)
+	cli := NewTestValidate(t, &ForgeClient{Rcode: dns.RcodeSuccess, NoQuestion: true}, anchors)
+	cli.validator.exchange = NewTestRecursiveClient(t, auth, "").Exchange
+
+	quiz := &dns.Msg{}
+	quiz.SetQuestion("www.example.com.", dns.TypeA)
+	ans, err := cli.Exchange(context.Background(), quiz)
+	if err != nil {
+		t.Fatalf("exchange failed: %s", err)
+	}
+	if ans.Rcode != dns.RcodeServerFailure {
+		t.Fatalf("answer without question should be servfail: %s", ans)
+	}
+}
@@ -1,16 +1,32 @@
 package rrtree
 
 import (
-	"fmt"
+	"sync"
+	"time"
 
 	"github.com/miekg/dns"
 )
 
 type ResourceRecord struct {
-	Name string
-	Type uint16
-	// Expire time.Time
-	RR dns.RR
+	Name   string
+	Type   uint16
+	Expire time.Time // zero means never expire
+	RR     dns.RR
+}
+
+func (record *ResourceRecord) Expired(now time.Time) bool {
+	return !record.Expire.IsZero() && !now.Before(record.Expire)
+}
+
+func (record *ResourceRecord) Copy(now time.Time, owner string) (rr dns.RR) {
+	rr = dns.Copy(record.RR)
+	if !record.Expire.IsZero() {
+		rr.Header().Ttl = uint32(record.Expire.Sub(now) / time.Second)
+	}
+	if owner != "" {
+		rr.Header().Name = owner
+	}
+	return
 }
 
 type Node struct {
@@ -28,86 +44,251 @@ func NewNode(name string) (node *Node) {
 	return
 }
 
+func JoinName(label, parent string) string {
+	if parent == "." {
+		return label + "."
+	}
+	return label + "." + parent
+}
+
+func (node *Node) Records(now time.Time, qtype uint16, owner string) (rrs []dns.RR) {
+	for _, record := range node.Resources[qtype] {
+		if record.Expired(now) {
+			continue
+		}
+		rrs = append(rrs, record.Copy(now, owner))
+	}
+	return
+}
+
+func (node *Node) Prune(now time.Time) (count int) {
+	for qtype, records := range node.Resources {
+		var alive []*ResourceRecord
+		for _, record := range records {
+			if record.Expired(now) {
+				count++
+				continue
+			}
+			alive = append(alive, record)
+		}
+		if len(alive) == 0 {
+			delete(node.Resources, qtype)
+		} else {
+			node.Resources[qtype] = alive
+		}
+	}
+
+	for label, sub := range node.Subs {
+		count += sub.Prune(now)
+		if sub.Empty() {
+			delete(node.Subs, label)
+		}
+	}
+	return
+}
+
+func (node *Node) Empty() bool {
+	return len(node.Subs) == 0 && len(node.Resources) == 0
+}
+
 type RRTree struct {
-	*Node
+	mu   sync.RWMutex
+	root *Node
 }
 
 func NewRRTree() (tree *RRTree) {
 	tree = &RRTree{
-		Node: NewNode(""),
+		root: NewNode("."),
 	}
 	return
 }
 
 func (tree *RRTree) AddRecord(rr dns.RR) {
+	expire := time.Now().Add(time.Duration(rr.Header().Ttl) * time.Second)
+	tree.add(rr, expire)
+	return
+}
+
+func (tree *RRTree) AddHint(rr dns.RR) {
+	tree.add(rr, time.Time{})
+	return
+}
+
+func (tree *RRTree) add(rr dns.RR, expire time.Time) {
 	record := &ResourceRecord{
-		Name: rr.Header().Name,
-		Type: rr.Header().Rrtype,
-		// Expire: time.Now().Add(time.Duration(rr.Header().Ttl) * time.Second),
-		RR: rr,
+		Name:   dns.CanonicalName(rr.Header().Name),
+		Type:   rr.Header().Rrtype,
+		Expire: expire,
+		RR:     dns.Copy(rr),
 	}
-
 	labels := dns.SplitDomainName(record.Name)
-	fmt.Println(labels)
 
-	node := tree.Node
+	tree.mu.Lock()
+	defer tree.mu.Unlock()
+
+	node := tree.root
 	for i := len(labels) - 1; i >= 0; i-- {
 		sub, ok := node.Subs[labels[i]]
 		if !ok {
-			sub = NewNode(labels[i])
+			sub = NewNode(JoinName(labels[i], node.Name))
 			node.Subs[labels[i]] = sub
 		}
 		node = sub
 	}
 
-	node.Resources[record.Type] = append(node.Resources[record.Type], record)
+	records := node.Resources[record.Type]
+	for i, old := range records {
+		if !dns.IsDuplicate(old.RR, rr) {
+			continue
+		}
+		if old.Expire.IsZero() {
+			// hints never expire.
+			record.Expire = old.Expire
+		}
+		records[i] = record
+		return
+	}
+	node.Resources[record.Type] = append(records, record)
 	return
 }
 
-func (tree *RRTree) GetNode(name string) (node *Node, partial bool) {
+func (tree *RRTree) Get(name string, qtype uint16) (rrs []dns.RR) {
+	name = dns.CanonicalName(name)
 	labels := dns.SplitDomainName(name)
-	fmt.Println(labels)
+	now := time.Now()
+
+	tree.mu.RLock()
+	defer tree.mu.RUnlock()
 
-	node = tree.Node
+	node := tree.root
 	for i := len(labels) - 1; i >= 0; i-- {
 		sub, ok := node.Subs[labels[i]]
 		if !ok {
-			partial = true
+			// RFC 4592: node is the closest encloser, try the wildcard under it.
+			if wild, ok := node.Subs["*"]; ok {
+				rrs = wild.Records(now, qtype, name)
+			}
 			return
 		}
 		node = sub
 	}
 
+	rrs = node.Records(now, qtype, "")
 	return
 }
 
-var DefaultTree *RRTree = NewRRTree()
+func (tree *RRTree) Closest(name string, qtype uint16) (owner string, rrs []dns.RR) {
+	labels := dns.SplitDomainName(dns.CanonicalName(name))
+	now := time.Now()
+
+	tree.mu.RLock()
+	defer tree.mu.RUnlock()
+
+	node := tree.root
+	for i := len(labels); ; i-- {
+		if found := node.Records(now, qtype, ""); len(found) != 0 {
+			owner = node.Name
+			rrs = found
+		}
+		if i == 0 {
+			break
+		}
+		sub, ok := node.Subs[labels[i-1]]
+		if !ok {
+			break
+		}
+		node = sub
+	}
+	return
+}
+
+func (tree *RRTree) Remove(name string, qtype uint16) {
+	labels := dns.SplitDomainName(dns.CanonicalName(name))
+
+	tree.mu.Lock()
+	defer tree.mu.Unlock()
+
+	path := []*Node{tree.root}
+	node := tree.root
+	for i := len(labels) - 1; i >= 0; i-- {
+		sub, ok := node.Subs[labels[i]]
+		if !ok {
+			return
+		}
+		node = sub
+		path = append(path, node)
+	}
+
+	if qtype == dns.TypeANY {
+		node.Resources = make(map[uint16][]*ResourceRecord, 0)
+	} else {
+		delete(node.Resources, qtype)
+	}
+
+	for i := len(path) - 1; i > 0 && path[i].Empty(); i-- {
+		delete(path[i-1].Subs, labels[len(labels)-i])
+	}
+	return
+}
+
+func (tree *RRTree) Prune() (count int) {
+	tree.mu.Lock()
+	defer tree.mu.Unlock()
+	return tree.root.Prune(time.Now())
+}
 
 var (
 	ROOTDNS = []string{
-		"a.root-servers.net. 300 IN A 198.41.0.4",
-		"b.root-servers.net. 300 IN A 199.9.14.201",
-		"c.root-servers.net. 300 IN A 192.33.4.12",
-		"d.root-servers.net. 300 IN A 199.7.91.13",
-		"e.root-servers.net. 300 IN A 192.203.230.10",
-		"f.root-servers.net. 300 IN A 192.5.5.241",
-		"g.root-servers.net. 300 IN A 192.112.36.4",
-		"h.root-servers.net. 300 IN A 198.97.190.53",
-		"i.root-servers.net. 300 IN A 192.36.148.17",
-		"j.root-servers.net. 300 IN A 192.58.128.30",
-		"k.root-servers.net. 300 IN A 193.0.14.129",
-		"l.root-servers.net. 300 IN A 199.7.83.42",
-		"m.root-servers.net. 300 IN A 202.12.27.33",
+		". 518400 IN NS a.root-servers.net.",
+		". 518400 IN NS b.root-servers.net.",
+		". 518400 IN NS c.root-servers.net.",
+		". 518400 IN NS d.root-servers.net.",
+		". 518400 IN NS e.root-servers.net.",
+		". 518400 IN NS f.root-servers.net.",
+		". 518400 IN NS g.root-servers.net.",
+		". 518400 IN NS h.root-servers.net.",
+		". 518400 IN NS i.root-servers.net.",
+		". 518400 IN NS j.root-servers.net.",
+		". 518400 IN NS k.root-servers.net.",
+		". 518400 IN NS l.root-servers.net.",
+		". 518400 IN NS m.root-servers.net.",
+		"a.root-servers.net. 518400 IN A 198.41.0.4",
+		"b.root-servers.net. 518400 IN A 170.247.170.2",
+		"c.root-servers.net. 518400 IN A 192.33.4.12",
+		"d.root-servers.net. 518400 IN A 199.7.91.13",
+		"e.root-servers.net. 518400 IN A 192.203.230.10",
+		"f.root-servers.net. 518400 IN A 192.5.5.241",
+		"g.root-servers.net. 518400 IN A 192.112.36.4",
+		"h.root-servers.net. 518400 IN A 198.97.190.53",
+		"i.root-servers.net. 518400 IN A 192.36.148.17",
+		"j.root-servers.net. 518400 IN A 192.58.128.30",
+		"k.root-servers.net. 518400 IN A 193.0.14.129",
+		"l.root-servers.net. 518400 IN A 199.7.83.42",
+		"m.root-servers.net. 518400 IN A 202.12.27.33",
+		"a.root-servers.net. 518400 IN AAAA 2001:503:ba3e::2:30",
+		"b.root-servers.net. 518400 IN AAAA 2801:1b8:10::b",
+		"c.root-servers.net. 518400 IN AAAA 2001:500:2::c",
+		"d.root-servers.net. 518400 IN AAAA 2001:500:2d::d",
+		"e.root-servers.net. 518400 IN AAAA 2001:500:a8::e",
+		"f.root-servers.net. 518400 IN AAAA 2001:500:2f::f",
+		"g.root-servers.net. 518400 IN AAAA 2001:500:12::d0d",
+		"h.root-servers.net. 518400 IN AAAA 2001:500:1::53",
+		"i.root-servers.net. 518400 IN AAAA 2001:7fe::53",
+		"j.root-servers.net. 518400 IN AAAA 2001:503:c27::2:30",
+		"k.root-servers.net. 518400 IN AAAA 2001:7fd::1",
+		"l.root-servers.net. 518400 IN AAAA 2001:500:9f::42",
+		"m.root-servers.net. 518400 IN AAAA 2001:dc3::35",
 	}
 )
 
-func init() {
+func NewRootTree() (tree *RRTree) {
+	tree = NewRRTree()
 	for _, s := range ROOTDNS {
 		rr, err := dns.NewRR(s)
 		if err != nil {
 			panic(err.Error())
 		}
-		DefaultTree.AddRecord(rr)
+		tree.AddHint(rr)
 	}
 	return
 }
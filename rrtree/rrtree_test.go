@@ -0,0 +1,204 @@
+package rrtree
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func NewTestTree(t *testing.T, records ...string) (tree *RRTree) {
+	tree = NewRRTree()
+	for _, s := range records {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			t.Fatalf("parse rr failed: %s", err)
+		}
+		tree.AddRecord(rr)
+	}
+	return
+}
+
+func TestGet(t *testing.T) {
+	tree := NewTestTree(t,
+		"www.example.com. 300 IN A 192.0.2.1",
+		"www.example.com. 300 IN A 192.0.2.2",
+		"www.example.com. 300 IN A 192.0.2.2",
+		"example.com. 300 IN NS ns.example.com.")
+
+	rrs := tree.Get("www.example.com.", dns.TypeA)
+	if len(rrs) != 2 {
+		t.Fatalf("wrong records: %v", rrs)
+	}
+	if rrs[0].Header().Ttl > 300 || rrs[0].Header().Ttl < 298 {
+		t.Fatalf("wrong ttl: %d", rrs[0].Header().Ttl)
+	}
+
+	if len(tree.Get("WWW.Example.COM", dns.TypeA)) != 2 {
+		t.Fatalf("get should be case insensitive.")
+	}
+	if len(tree.Get("www.example.com.", dns.TypeAAAA)) != 0 {
+		t.Fatalf("wrong type matched.")
+	}
+	if len(tree.Get("example.com.", dns.TypeA)) != 0 {
+		t.Fatalf("parent node should not have records.")
+	}
+	if len(tree.Get("ample.com.", dns.TypeNS)) != 0 {
+		t.Fatalf("partial label should not match.")
+	}
+}
+
+func TestExpire(t *testing.T) {
+	tree := NewTestTree(t,
+		"www.example.com. 0 IN A 192.0.2.1",
+		"www.example.com. 300 IN A 192.0.2.2")
+	hint, _ := dns.NewRR("a.root-servers.net. 0 IN A 198.41.0.4")
+	tree.AddHint(hint)
+
+	rrs := tree.Get("www.example.com.", dns.TypeA)
+	if len(rrs) != 1 || rrs[0].(*dns.A).A.String() != "192.0.2.2" {
+		t.Fatalf("expired record returned: %v", rrs)
+	}
+	if len(tree.Get("a.root-servers.net.", dns.TypeA)) != 1 {
+		t.Fatalf("hint should never expire.")
+	}
+
+	if n := tree.Prune(); n != 1 {
+		t.Fatalf("wrong number of records pruned: %d", n)
+	}
+
+	tree = NewTestTree(t, "www.example.com. 0 IN A 192.0.2.1")
+	tree.Prune()
+	if !tree.root.Empty() {
+		t.Fatalf("empty nodes should be pruned.")
+	}
+}
+
+func TestClosest(t *testing.T) {
+	tree := NewTestTree(t,
+		". 300 IN NS a.root-servers.net.",
+		"com. 300 IN NS a.gtld-servers.net.",
+		"example.com. 300 IN NS ns1.example.com.",
+		"example.com. 300 IN NS ns2.example.com.")
+
+	owner, rrs := tree.Closest("www.example.com.", dns.TypeNS)
+	if owner != "example.com." || len(rrs) != 2 {
+		t.Fatalf("wrong closest: %s %v", owner, rrs)
+	}
+
+	owner, _ = tree.Closest("www.ample.com.", dns.TypeNS)
+	if owner != "com." {
+		t.Fatalf("closest should match label boundary: %s", owner)
+	}
+
+	owner, _ = tree.Closest("www.example.org.", dns.TypeNS)
+	if owner != "." {
+		t.Fatalf("wrong closest: %s", owner)
+	}
+
+	owner, _ = tree.Closest("example.com.", dns.TypeNS)
+	if owner != "example.com." {
+		t.Fatalf("name itself should be matched: %s", owner)
+	}
+
+	owner, rrs = tree.Closest("www.example.com.", dns.TypeDS)
+	if owner != "" || rrs != nil {
+		t.Fatalf("nothing should be matched: %s", owner)
+	}
+}
+
+func TestRemove(t *testing.T) {
+	tree := NewTestTree(t,
+		"www.example.com. 300 IN A 192.0.2.1",
+		"www.example.com. 300 IN AAAA 2001:db8::1",
+		"a.b.example.com. 300 IN A 192.0.2.3")
+
+	tree.Remove("www.example.com.", dns.TypeA)
+	if len(tree.Get("www.example.com.", dns.TypeA)) != 0 {
+		t.Fatalf("record not removed.")
+	}
+	if len(tree.Get("www.example.com.", dns.TypeAAAA)) != 1 {
+		t.Fatalf("other type removed.")
+	}
+
+	tree.Remove("a.b.example.com.", dns.TypeANY)
+	if _, ok := tree.root.Subs["com"].Subs["example"].Subs["b"]; ok {
+		t.Fatalf("empty nodes not removed.")
+	}
+
+	tree.Remove("www.example.com.", dns.TypeANY)
+	if !tree.root.Empty() {
+		t.Fatalf("empty nodes not removed.")
+	}
+}
+
+func TestWildcard(t *testing.T) {
+	tree := NewTestTree(t,
+		"*.example.com. 300 IN A 192.0.2.1",
+		"www.example.com. 300 IN A 192.0.2.2",
+		"sub.www.example.com. 300 IN TXT sub")
+
+	rrs := tree.Get("foo.example.com.", dns.TypeA)
+	if len(rrs) != 1 || rrs[0].Header().Name != "foo.example.com." {
+		t.Fatalf("wildcard not matched: %v", rrs)
+	}
+
+	rrs = tree.Get("a.b.example.com.", dns.TypeA)
+	if len(rrs) != 1 || rrs[0].Header().Name != "a.b.example.com." {
+		t.Fatalf("wildcard not matched: %v", rrs)
+	}
+
+	rrs = tree.Get("www.example.com.", dns.TypeA)
+	if len(rrs) != 1 || rrs[0].(*dns.A).A.String() != "192.0.2.2" {
+		t.Fatalf("existing name should not match wildcard: %v", rrs)
+	}
+
+	if len(tree.Get("foo.www.example.com.", dns.TypeA)) != 0 {
+		t.Fatalf("wildcard should not match under an existing name.")
+	}
+	if len(tree.Get("example.com.", dns.TypeA)) != 0 {
+		t.Fatalf("wildcard should not match its parent.")
+	}
+}
+
+func TestConcurrency(t *testing.T) {
+	tree := NewRRTree()
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				name := fmt.Sprintf("h%d.n%d.example.com.", j, i)
+				rr, _ := dns.NewRR(fmt.Sprintf("%s 300 IN A 192.0.2.%d", name, j))
+				tree.AddRecord(rr)
+				tree.Get(name, dns.TypeA)
+				tree.Closest(name, dns.TypeNS)
+				if j%10 == 0 {
+					tree.Remove(name, dns.TypeA)
+					tree.Prune()
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if len(tree.Get("h1.n1.example.com.", dns.TypeA)) != 1 {
+		t.Fatalf("record lost.")
+	}
+}
+
+func BenchmarkGet(b *testing.B) {
+	tree := NewRRTree()
+	for i := 0; i < 1000; i++ {
+		rr, _ := dns.NewRR(fmt.Sprintf("h%d.example.com. 300 IN A 192.0.2.1", i))
+		tree.AddRecord(rr)
+	}
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		tree.Get("h500.example.com.", dns.TypeA)
+	}
+	return
+}